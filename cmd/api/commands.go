@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"url-shortener/pkg/janitor"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/transfer"
+)
+
+// commands holds the dependencies of the one-shot maintenance commands
+type commands struct {
+	janitor  *janitor.Janitor
+	repo     repository.URLRepository
+	importer *transfer.Importer
+}
+
+// run runs the command named by args[0] instead of the server
+func (c *commands) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "purge":
+		purged, err := c.janitor.Purge(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d expired URLs\n", purged)
+		return nil
+	case "export":
+		return c.export(ctx, args[1:])
+	case "import":
+		return c.importLinks(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// export writes every link to a file or stdout, e.g. "export -format jsonl -output links.jsonl"
+func (c *commands) export(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := flags.String("format", "csv", "csv or jsonl")
+	output := flags.String("output", "", "file to write, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	format, err := transfer.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	count, err := transfer.Export(ctx, w, format, c.repo, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d links\n", count)
+	return nil
+}
+
+// importLinks imports links from a file and prints the conflict report,
+// e.g. "import -format bitly bitly-export.csv"
+func (c *commands) importLinks(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	formatName := flags.String("format", "csv", "csv, jsonl, bitly or yourls")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-format csv|jsonl|bitly|yourls] FILE")
+	}
+	format, err := transfer.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := transfer.NewReader(file, format)
+	if err != nil {
+		return err
+	}
+
+	report, importErr := c.importer.Import(ctx, reader)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	return importErr
+}
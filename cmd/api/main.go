@@ -3,23 +3,37 @@ package main
 import (
 	"context"
 	"fmt"
+	"image"
 	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
+	"url-shortener/pkg/access"
+	"url-shortener/pkg/clickstream"
 	"url-shortener/pkg/config"
+	"url-shortener/pkg/geoip"
 	"url-shortener/pkg/handler"
+	"url-shortener/pkg/health"
+	"url-shortener/pkg/janitor"
+	"url-shortener/pkg/metadata"
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/pages"
+	"url-shortener/pkg/qr"
 
 	"url-shortener/pkg/repository"
 	"url-shortener/pkg/shortener"
+	"url-shortener/pkg/transfer"
+	"url-shortener/pkg/useragent"
+	"url-shortener/pkg/webhook"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const (
-	maxRetries    = 5
-	retryInterval = 2 * time.Second
+	maxRetries     = 5
+	retryInterval  = 2 * time.Second
+	shortURLPrefix = "/r/" // Path short URLs are served under
 )
 
 func main() {
@@ -27,41 +41,242 @@ func main() {
 
 	cfg, err := config.LoadConfig(logger)
 	if err != nil {
-		logger.Error("Failed to load configuration: %v", err)
+		logger.Error("Failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+	deepLinkSchemes, err := model.ParseDeepLinkSchemes(cfg.DeepLinkSchemes)
+	if err != nil {
+		logger.Error("Invalid deep link schemes", "error", err)
 		os.Exit(1)
 	}
 	ctx := context.Background()
 	// Database setup
-	conn, err := setupDatabse(ctx, logger, cfg.DATABASE_URL)
+	pool, err := setupDatabse(ctx, logger, cfg.DATABASE_URL)
 	if err != nil {
-		logger.Error("Unable to connect to database: %v", err)
+		logger.Error("Unable to connect to database", "error", err)
 		os.Exit(1)
 	}
 
-	defer conn.Close(ctx)
+	defer pool.Close()
 
 	// Repository and Shortener setup
-	repo := repository.NewPostgresURLRepository(conn)
+	repo := repository.NewPostgresURLRepository(pool, cfg.PurgeGracePeriod, deepLinkSchemes)
 
+	signing, err := shortener.ParseSigning(cfg.SlugSigningKeys, cfg.SlugSigningKeyID, cfg.SlugChecksumLength, cfg.SlugAlphabet)
+	if err != nil {
+		logger.Error("Invalid slug signing keys", "error", err)
+		os.Exit(1)
+	}
+	if signing != nil {
+		signing.AcceptUnsigned = cfg.SlugAcceptUnsigned
+	}
+	accessSigner, err := access.New(access.Config{
+		Secrets:    cfg.AccessSecrets,
+		ClockSkew:  cfg.AccessClockSkew,
+		DefaultTTL: cfg.AccessDefaultTTL,
+		MaxTTL:     cfg.AccessMaxTTL,
+	})
+	if err != nil {
+		logger.Error("Invalid access signing configuration", "error", err)
+		os.Exit(1)
+	}
+	slugLengths := make(map[string]int, len(cfg.Domains))
+	for _, domain := range cfg.Domains {
+		if domain.SlugLength > 0 {
+			slugLengths[domain.Host] = domain.SlugLength
+		}
+	}
 	config := shortener.Config{
-		Domain:     cfg.Domain,
-		Prefix:     "/r/",
-		SlugLength: 6,
-		Logger:     logger,
+		Domain:            cfg.Domain,
+		Prefix:            shortURLPrefix,
+		SlugLength:        cfg.SlugLength,
+		DomainSlugLengths: slugLengths,
+		MaxSlugLength:     cfg.SlugMaxLength,
+		GrowthThreshold:   cfg.SlugGrowthThreshold,
+		Alphabet:          cfg.SlugAlphabet,
+		CaseInsensitive:   cfg.SlugCaseInsensitive,
+		Logger:            logger,
+		Canonicalization: shortener.Canonicalization{
+			StripWWW:       cfg.CanonicalStripWWW,
+			StripFragment:  cfg.CanonicalStripFragment,
+			TrackingParams: cfg.CanonicalTrackingParams,
+		},
+		Signing: signing,
+		Filter: shortener.SlugFilter{
+			Blocklist:        cfg.SlugBlocklist,
+			Reserved:         cfg.SlugReserved,
+			ExcludeAmbiguous: cfg.SlugExcludeAmbiguous,
+		},
 	}
 	urlShortener := shortener.NewShortener(config)
+	// With signed slugs, only the paths of stored prefixes are looked up
+	if err := urlShortener.LoadPrefixes(ctx, repo); err != nil {
+		logger.Error("Unable to load prefixes", "error", err)
+		os.Exit(1)
+	}
+
+	// Webhooks setup, events are enqueued in the transaction of the change they report
+	transactor := repository.NewPostgresTransactor(pool)
+	webhooks := repository.NewPostgresWebhookRepository(pool)
+	dispatcher := webhook.New(webhook.Config{
+		Logger:          logger,
+		Repository:      webhooks,
+		Timeout:         cfg.WebhookTimeout,
+		PollInterval:    cfg.WebhookPollInterval,
+		BatchSize:       cfg.WebhookBatchSize,
+		MaxAttempts:     cfg.WebhookMaxAttempts,
+		BackoffBase:     cfg.WebhookBackoffBase,
+		BackoffMax:      cfg.WebhookBackoffMax,
+		ClickSampleRate: cfg.WebhookClickSampleRate,
+	})
+
+	// Expired URLs janitor setup
+	idempotency := repository.NewPostgresIdempotencyRepository(pool)
+	urlJanitor := janitor.New(janitor.Config{
+		Logger:            logger,
+		Purger:            repo,
+		Interval:          cfg.PurgeInterval,
+		GracePeriod:       cfg.PurgeGracePeriod,
+		BatchSize:         cfg.PurgeBatchSize,
+		Events:            dispatcher,
+		Transactor:        transactor,
+		Idempotency:       idempotency,
+		IdempotencyTTL:    cfg.IdempotencyTTL,
+		Deliveries:        webhooks,
+		DeliveryRetention: cfg.WebhookRetention,
+	})
+
+	// Import setup
+	importer := transfer.NewImporter(transfer.Config{
+		Logger:        logger,
+		URLRepository: repo,
+		Shortener:     urlShortener,
+		Events:        dispatcher,
+		Transactor:    transactor,
+
+		DeepLinkSchemes: deepLinkSchemes,
+	})
+
+	// One-shot commands, e.g. "url-shortener purge"
+	if len(os.Args) > 1 {
+		cmds := commands{janitor: urlJanitor, repo: repo, importer: importer}
+		if err := cmds.run(ctx, os.Args[1:]); err != nil {
+			logger.Error("Command failed", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Error pages and fallbacks setup
+	errorPages, err := pages.New(cfg.TemplateDir)
+	if err != nil {
+		logger.Error("Unable to load templates", "error", err)
+		os.Exit(1)
+	}
+	fallbacks := make(map[string]handler.Fallback, len(cfg.Domains))
+	for _, domain := range cfg.Domains {
+		fallbacks[domain.Host] = handler.Fallback{
+			NotFoundURL: domain.NotFoundURL,
+			ExpiredURL:  domain.ExpiredURL,
+		}
+	}
+
+	// QR code logo setup
+	var qrLogo image.Image
+	if cfg.QRLogoFile != "" {
+		if qrLogo, err = qr.LoadLogo(cfg.QRLogoFile); err != nil {
+			logger.Error("Unable to load QR code logo", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Destination metadata fetcher setup
+	var metadataFetcher handler.MetadataFetcher
+	if cfg.MetadataWorkers > 0 {
+		fetcher := metadata.NewFetcher(metadata.Config{
+			Logger:        logger,
+			URLRepository: repo,
+			Workers:       cfg.MetadataWorkers,
+			QueueSize:     cfg.MetadataQueueSize,
+			Timeout:       cfg.MetadataTimeout,
+		})
+		fetcher.Start(ctx)
+		metadataFetcher = fetcher
+	}
+
+	// GeoIP setup
+	var geoResolver *geoip.Resolver
+	if cfg.GeoIPDatabase != "" {
+		if geoResolver, err = geoip.Open(cfg.GeoIPDatabase, cfg.TrustedProxies); err != nil {
+			logger.Error("Unable to load GeoIP database", "error", err)
+			os.Exit(1)
+		}
+		defer geoResolver.Close()
+	}
 
 	handlerConfig := handler.HandlerConfiguration{
 		URLRepository:  repo,
 		Shortener:      urlShortener,
 		Logger:         logger,
 		ExpiryDuration: cfg.Expiry,
+		MinTTL:         cfg.MinTTL,
+		MaxTTL:         cfg.MaxTTL,
+		Fallback: handler.Fallback{
+			NotFoundURL: cfg.NotFoundURL,
+			ExpiredURL:  cfg.ExpiredURL,
+		},
+		Fallbacks:      fallbacks,
+		Pages:          errorPages,
+		Idempotency:    idempotency,
+		IdempotencyTTL: cfg.IdempotencyTTL,
+		Importer:       importer,
+		QRLogo:         qrLogo,
+		Crawlers:       useragent.NewCrawlerMatcher(cfg.Crawlers),
+		Metadata:       metadataFetcher,
+		Webhooks:       webhooks,
+		Events:         dispatcher,
+		Transactor:     transactor,
+		Clicks: clickstream.New(clickstream.Config{
+			Buffer:    cfg.StreamBuffer,
+			History:   cfg.StreamHistory,
+			Retention: cfg.StreamRetention,
+		}),
+		StreamKeepalive: cfg.StreamKeepalive,
+		GeoIP:           geoResolver,
+		Access:          accessSigner,
+		APIKeys:         cfg.APIKeys,
+		DeepLinkSchemes: deepLinkSchemes,
 	}
 	urlHandler := handler.NewHandler(&handlerConfig)
 
 	// HTTP server setup
-	http.HandleFunc("/create", urlHandler.ShortenURL)
-	http.HandleFunc("/r/", urlHandler.Redirect)
+	urlHandler.Routes(http.DefaultServeMux, shortURLPrefix)
+
+	if cfg.PurgeInterval > 0 {
+		go urlJanitor.Run(ctx)
+	}
+	go dispatcher.Run(ctx)
+	if cfg.SlugGrowthThreshold > 0 {
+		go urlShortener.Run(ctx, repo, cfg.SlugGrowthInterval)
+	}
+	if signing != nil {
+		go urlShortener.RunPrefixes(ctx, repo, cfg.SlugPrefixRefresh)
+	}
+	if cfg.HealthCheckInterval > 0 {
+		checker := health.New(health.Config{
+			Logger:           logger,
+			Repository:       repo,
+			Interval:         cfg.HealthCheckInterval,
+			BatchSize:        cfg.HealthCheckBatchSize,
+			Workers:          cfg.HealthCheckWorkers,
+			Timeout:          cfg.HealthCheckTimeout,
+			HostDelay:        cfg.HealthCheckHostDelay,
+			FailureThreshold: cfg.HealthCheckFailures,
+			Events:           dispatcher,
+			Transactor:       transactor,
+		})
+		go checker.Run(ctx)
+	}
 
 	// Start the server
 	logger.Info(fmt.Sprintf("Starting server on %s", cfg.Port))
@@ -71,12 +286,14 @@ func main() {
 	}
 }
 
-func setupDatabse(ctx context.Context, logger *slog.Logger, url string) (*pgx.Conn, error) {
-	var conn *pgx.Conn
-	var err error
+func setupDatabse(ctx context.Context, logger *slog.Logger, url string) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database configuration: %v", err)
+	}
 	// Retry mechanism for database connection
 	for i := 0; i < maxRetries; i++ {
-		conn, err = pgx.Connect(ctx, url)
+		err = pool.Ping(ctx)
 		if err == nil {
 			break
 		}
@@ -85,7 +302,8 @@ func setupDatabse(ctx context.Context, logger *slog.Logger, url string) (*pgx.Co
 	}
 
 	if err != nil {
-		return conn, fmt.Errorf("exceeded maximum retries. Unable to connect to database: %v", err)
+		pool.Close()
+		return nil, fmt.Errorf("exceeded maximum retries. Unable to connect to database: %v", err)
 	}
-	return conn, err
+	return pool, err
 }
@@ -0,0 +1,131 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of signed access URLs
+const (
+	ExpiresParam   = "exp"
+	SignatureParam = "sig"
+)
+
+// minSecretLength is the shortest secret accepted, in bytes
+const minSecretLength = 16
+
+var (
+	ErrInvalidSignature = errors.New("invalid access signature")
+	ErrExpired          = errors.New("access URL expired")
+)
+
+type Config struct {
+	Secrets    []string      // The first one signs new URLs, all of them are verified so secrets can be rotated
+	ClockSkew  time.Duration // Tolerated drift between the clocks of the instance signing and the one verifying
+	DefaultTTL time.Duration // Lifetime of access URLs minted without a ttl
+	MaxTTL     time.Duration // Longest lifetime a client may request
+}
+
+// Signer mints and verifies time-limited access URLs for short links,
+// in the manner of presigned URLs: an expiry and an HMAC of it with the short URL.
+type Signer struct {
+	config  Config
+	secrets [][]byte
+}
+
+// New returns a Signer, or nil when no secret is configured, which disables signed access.
+func New(config Config) (*Signer, error) {
+	if len(config.Secrets) == 0 {
+		return nil, nil
+	}
+	s := &Signer{config: config}
+	for _, secret := range config.Secrets {
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("access secrets must be at least %d bytes", minSecretLength)
+		}
+		s.secrets = append(s.secrets, []byte(secret))
+	}
+	if config.DefaultTTL <= 0 || config.MaxTTL < config.DefaultTTL {
+		return nil, fmt.Errorf("access TTLs must satisfy 0 < default (%s) <= max (%s)", config.DefaultTTL, config.MaxTTL)
+	}
+	return s, nil
+}
+
+// Expires returns the expiry of an access URL minted now with the given lifetime,
+// the default one when it's 0.
+func (s *Signer) Expires(ttl time.Duration, now time.Time) (time.Time, error) {
+	if ttl == 0 {
+		ttl = s.config.DefaultTTL
+	}
+	if ttl < time.Second {
+		return time.Time{}, errors.New("ttl must be at least 1s")
+	}
+	if ttl > s.config.MaxTTL {
+		return time.Time{}, fmt.Errorf("access URLs can't live longer than %s", s.config.MaxTTL)
+	}
+	return now.Add(ttl).Truncate(time.Second), nil
+}
+
+// Sign returns the query parameters granting access to the short URL until the expiry.
+func (s *Signer) Sign(shortURL string, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		ExpiresParam:   {exp},
+		SignatureParam: {signature(s.secrets[0], shortURL, exp)},
+	}
+}
+
+// Verify checks the access parameters of a request for the short URL. The expiry is only
+// looked at once the signature matches, and is extended by the clock skew.
+func (s *Signer) Verify(shortURL string, query url.Values, now time.Time) error {
+	exp, sig := query.Get(ExpiresParam), query.Get(SignatureParam)
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || sig == "" {
+		return ErrInvalidSignature
+	}
+	if !slices.ContainsFunc(s.secrets, func(secret []byte) bool {
+		return hmac.Equal([]byte(sig), []byte(signature(secret, shortURL, exp)))
+	}) {
+		return ErrInvalidSignature
+	}
+	if now.After(time.Unix(unix, 0).Add(s.config.ClockSkew)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Signed reports whether the query carries access parameters
+func Signed(query url.Values) bool {
+	return query.Has(ExpiresParam) || query.Has(SignatureParam)
+}
+
+// Strip removes the access parameters from a raw query, leaving the others as they were sent.
+func Strip(rawQuery string) string {
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && (unescaped == ExpiresParam || unescaped == SignatureParam) {
+			continue
+		}
+		if pair != "" {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+func signature(secret []byte, shortURL, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(exp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(shortURL))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
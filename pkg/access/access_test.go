@@ -0,0 +1,91 @@
+package access
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const shortURL = "http://short.com/r/abc123"
+
+func newSigner(t *testing.T, secrets ...string) *Signer {
+	signer, err := New(Config{Secrets: secrets, ClockSkew: 30 * time.Second, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour})
+	assert.Nil(t, err)
+	return signer
+}
+
+func TestNew(t *testing.T) {
+	signer, err := New(Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, signer)
+
+	_, err = New(Config{Secrets: []string{"short"}, DefaultTTL: time.Hour, MaxTTL: time.Hour})
+	assert.NotNil(t, err)
+
+	_, err = New(Config{Secrets: []string{"0123456789abcdef"}, DefaultTTL: 2 * time.Hour, MaxTTL: time.Hour})
+	assert.NotNil(t, err)
+}
+
+func TestExpires(t *testing.T) {
+	signer := newSigner(t, "0123456789abcdef")
+	now := time.Unix(1_700_000_000, 0)
+
+	expires, err := signer.Expires(0, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Hour), expires)
+
+	expires, err = signer.Expires(15*time.Minute, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(15*time.Minute), expires)
+
+	_, err = signer.Expires(48*time.Hour, now)
+	assert.NotNil(t, err)
+	_, err = signer.Expires(-time.Minute, now)
+	assert.NotNil(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	signer := newSigner(t, "0123456789abcdef")
+	now := time.Unix(1_700_000_000, 0)
+	query := signer.Sign(shortURL, now.Add(time.Minute))
+
+	assert.Nil(t, signer.Verify(shortURL, query, now))
+	// Within the clock skew, the URL still grants access
+	assert.Nil(t, signer.Verify(shortURL, query, now.Add(time.Minute+20*time.Second)))
+	assert.Equal(t, ErrExpired, signer.Verify(shortURL, query, now.Add(time.Minute+31*time.Second)))
+
+	assert.Equal(t, ErrInvalidSignature, signer.Verify("http://short.com/r/other1", query, now))
+	assert.Equal(t, ErrInvalidSignature, newSigner(t, "fedcba9876543210").Verify(shortURL, query, now))
+
+	tampered := url.Values{ExpiresParam: {"1800000000"}, SignatureParam: query[SignatureParam]}
+	assert.Equal(t, ErrInvalidSignature, signer.Verify(shortURL, tampered, now))
+	assert.Equal(t, ErrInvalidSignature, signer.Verify(shortURL, url.Values{ExpiresParam: query[ExpiresParam]}, now))
+}
+
+func TestVerify_RotatedSecrets(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	query := newSigner(t, "old-secret-0123456").Sign(shortURL, now.Add(time.Minute))
+
+	rotated := newSigner(t, "new-secret-0123456", "old-secret-0123456")
+	assert.Nil(t, rotated.Verify(shortURL, query, now))
+	assert.NotEqual(t, query, rotated.Sign(shortURL, now.Add(time.Minute)))
+}
+
+func TestStrip(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"exp=1&sig=abc", ""},
+		{"a=1&exp=1&b=%20x&sig=abc", "a=1&b=%20x"},
+		{"%73ig=abc&c", "c"},
+		{"expires=1", "expires=1"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, Strip(tc.query), tc.query)
+	}
+}
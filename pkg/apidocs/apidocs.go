@@ -0,0 +1,34 @@
+package apidocs
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// spec is the OpenAPI document of the API, kept in line with the handlers by the handler tests
+//
+//go:embed openapi.json
+var spec []byte
+
+// docs renders the document in the browser, without loading anything but the document itself
+//
+//go:embed docs.html
+var docs []byte
+
+// Spec returns the OpenAPI document of the API
+func Spec() []byte {
+	return spec
+}
+
+// ServeSpec serves the OpenAPI document
+func ServeSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Lets hosted tools such as editors and code generators load it
+	w.Write(spec)
+}
+
+// ServeDocs serves the page documenting the API
+func ServeDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docs)
+}
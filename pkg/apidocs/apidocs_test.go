@@ -0,0 +1,62 @@
+package apidocs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpec_References(t *testing.T) {
+	var document map[string]any
+	assert.Nil(t, json.Unmarshal(Spec(), &document))
+	assert.Equal(t, "3.1.0", document["openapi"])
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch node := node.(type) {
+		case map[string]any:
+			if ref, ok := node["$ref"].(string); ok {
+				assert.True(t, resolves(document, ref), "unresolved reference %s", ref)
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []any:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(document)
+}
+
+// resolves reports whether a local reference such as #/components/schemas/Link points to something
+func resolves(document map[string]any, ref string) bool {
+	var node any = document
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return false
+		}
+		if node, ok = object[strings.NewReplacer("~1", "/", "~0", "~").Replace(key)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServe(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ServeSpec(recorder, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.True(t, json.Valid(recorder.Body.Bytes()))
+
+	recorder = httptest.NewRecorder()
+	ServeDocs(recorder, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `fetch("openapi.json")`)
+}
@@ -0,0 +1,136 @@
+package clickstream
+
+import (
+	"sync"
+	"time"
+
+	"url-shortener/pkg/model"
+)
+
+// Event is a click numbered for Last-Event-ID resume
+type Event struct {
+	ID    int64
+	Click model.Click
+}
+
+type Config struct {
+	Buffer    int           // Events a subscriber may lag behind before being dropped
+	History   int           // Events kept per link for subscribers resuming after a disconnect
+	Retention time.Duration // How long the history of a link is kept once nobody follows it
+}
+
+// Broker fans clicks out to the subscribers of each link, in process.
+// Publish never blocks: subscribers that fall behind are dropped and can resume from the history.
+// Replicas could share clicks by relaying a Postgres NOTIFY channel into Publish.
+type Broker struct {
+	config Config
+	mu     sync.Mutex
+	lastID int64
+	topics map[string]*topic
+}
+
+// topic holds the subscribers and recent events of one link
+type topic struct {
+	subscribers map[*Subscription]struct{}
+	history     []Event
+	idleSince   time.Time // When the last subscriber left
+}
+
+// Subscription receives the events of one link until it is closed
+type Subscription struct {
+	Events   <-chan Event
+	events   chan Event
+	shortURL string
+}
+
+func New(config Config) *Broker {
+	return &Broker{
+		config: config,
+		// IDs start from the clock so they keep increasing across restarts
+		lastID: time.Now().UnixMicro(),
+		topics: make(map[string]*topic),
+	}
+}
+
+// Publish sends the click to the subscribers of its link.
+// Clicks of links nobody follows are discarded.
+func (b *Broker) Publish(click model.Click) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[click.ShortURL]
+	if !ok {
+		return
+	}
+	b.lastID++
+	event := Event{ID: b.lastID, Click: click}
+	t.history = append(t.history, event)
+	if len(t.history) > b.config.History {
+		t.history = t.history[len(t.history)-b.config.History:]
+	}
+
+	for sub := range t.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// The subscriber is too slow, dropping it keeps redirects from waiting
+			b.remove(t, sub)
+		}
+	}
+}
+
+// Subscribe follows the clicks of a link. Events after lastEventID still in the history
+// are returned to be sent before the live ones, 0 skips the history.
+func (b *Broker) Subscribe(shortURL string, lastEventID int64) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+
+	t, ok := b.topics[shortURL]
+	if !ok {
+		t = &topic{subscribers: make(map[*Subscription]struct{})}
+		b.topics[shortURL] = t
+	}
+	events := make(chan Event, b.config.Buffer)
+	sub := &Subscription{Events: events, events: events, shortURL: shortURL}
+	t.subscribers[sub] = struct{}{}
+
+	var missed []Event
+	if lastEventID > 0 {
+		for _, event := range t.history {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	return sub, missed
+}
+
+// Unsubscribe stops the subscription, it can be called after the subscriber was dropped
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.topics[sub.shortURL]; ok {
+		if _, subscribed := t.subscribers[sub]; subscribed {
+			b.remove(t, sub)
+		}
+	}
+}
+
+// remove closes the subscription, the caller holds the lock
+func (b *Broker) remove(t *topic, sub *Subscription) {
+	delete(t.subscribers, sub)
+	close(sub.events)
+	if len(t.subscribers) == 0 {
+		t.idleSince = time.Now()
+	}
+}
+
+// expire forgets links nobody followed during the retention, the caller holds the lock
+func (b *Broker) expire(now time.Time) {
+	for shortURL, t := range b.topics {
+		if len(t.subscribers) == 0 && now.Sub(t.idleSince) > b.config.Retention {
+			delete(b.topics, shortURL)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package clickstream
+
+import (
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const shortURL = "http://short.com/r/abc123"
+
+func setupBroker() *Broker {
+	return New(Config{Buffer: 2, History: 3, Retention: time.Minute})
+}
+
+func click(destination string) model.Click {
+	return model.Click{ShortURL: shortURL, Destination: destination, Time: time.Now()}
+}
+
+func TestPublish(t *testing.T) {
+	broker := setupBroker()
+	sub, missed := broker.Subscribe(shortURL, 0)
+	other, _ := broker.Subscribe("http://short.com/r/other", 0)
+	assert.Empty(t, missed)
+
+	broker.Publish(click("http://a.com"))
+
+	event := <-sub.Events
+	assert.Equal(t, "http://a.com", event.Click.Destination)
+	assert.Empty(t, other.Events)
+}
+
+func TestPublish_IDsIncrease(t *testing.T) {
+	broker := setupBroker()
+	sub, _ := broker.Subscribe(shortURL, 0)
+
+	broker.Publish(click("http://a.com"))
+	broker.Publish(click("http://b.com"))
+
+	first, second := <-sub.Events, <-sub.Events
+	assert.Greater(t, first.ID, time.Now().Add(-time.Minute).UnixMicro())
+	assert.Equal(t, first.ID+1, second.ID)
+}
+
+func TestPublish_DropsSlowSubscribers(t *testing.T) {
+	broker := setupBroker()
+	slow, _ := broker.Subscribe(shortURL, 0)
+
+	for i := 0; i < 3; i++ {
+		broker.Publish(click("http://a.com"))
+	}
+
+	// The buffered events are still delivered, then the channel is closed
+	<-slow.Events
+	<-slow.Events
+	_, open := <-slow.Events
+	assert.False(t, open)
+	broker.Unsubscribe(slow)
+}
+
+func TestSubscribe_ResumesFromHistory(t *testing.T) {
+	broker := setupBroker()
+	sub, _ := broker.Subscribe(shortURL, 0)
+	broker.Publish(click("http://a.com"))
+	first := <-sub.Events
+	broker.Unsubscribe(sub)
+
+	for _, destination := range []string{"http://b.com", "http://c.com", "http://d.com", "http://e.com"} {
+		broker.Publish(click(destination))
+	}
+
+	_, missed := broker.Subscribe(shortURL, first.ID)
+	assert.Len(t, missed, 3, "only the last events are kept")
+	assert.Equal(t, "http://c.com", missed[0].Click.Destination)
+	assert.Equal(t, "http://e.com", missed[2].Click.Destination)
+
+	_, missed = broker.Subscribe(shortURL, missed[1].ID)
+	assert.Len(t, missed, 1)
+}
+
+func TestSubscribe_ExpiresIdleLinks(t *testing.T) {
+	broker := setupBroker()
+	sub, _ := broker.Subscribe(shortURL, 0)
+	broker.Publish(click("http://a.com"))
+	broker.Unsubscribe(sub)
+
+	broker.expire(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, broker.topics)
+
+	broker.Publish(click("http://b.com"))
+	assert.Empty(t, broker.topics, "clicks of links nobody follows are discarded")
+}
@@ -0,0 +1,115 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Resolver finds the country of clients in a local MaxMind-format database,
+// such as GeoLite2-Country or GeoIP2-City. No external service is called.
+type Resolver struct {
+	reader         *maxminddb.Reader
+	trustedProxies []netip.Prefix
+}
+
+// countryRecord is the part of the database record that is read
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Open loads the database. X-Forwarded-For is only read from requests
+// coming through one of the trusted proxies, given as addresses or CIDR ranges.
+func Open(path string, trustedProxies []string) (*Resolver, error) {
+	prefixes, err := ParsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open GeoIP database: %v", err)
+	}
+	return &Resolver{reader: reader, trustedProxies: prefixes}, nil
+}
+
+// ParsePrefixes parses addresses and CIDR ranges
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", value, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", value, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (r *Resolver) Close() error {
+	return r.reader.Close()
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the address, or "" when it is unknown
+func (r *Resolver) Country(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	var record countryRecord
+	if err := r.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// RequestCountry returns the country of the client that sent the request
+func (r *Resolver) RequestCountry(req *http.Request) string {
+	return r.Country(r.ClientIP(req))
+}
+
+// ClientIP returns the address of the client. Behind trusted proxies, X-Forwarded-For
+// is read from the right, skipping the trusted hops, so clients can't spoof it by
+// sending the header themselves.
+func (r *Resolver) ClientIP(req *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	client := addrPort.Addr().Unmap()
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && r.isTrusted(client); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap()
+	}
+	return client
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
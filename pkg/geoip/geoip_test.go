@@ -0,0 +1,91 @@
+package geoip
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/country.mmdb is a GeoLite2-Country database holding:
+//
+//	89.160.20.112/28  DE
+//	81.2.69.142/31    GB
+//	216.160.83.56/29  US
+//	2001:db8:1::/48   DE
+const fixture = "testdata/country.mmdb"
+
+func TestCountry(t *testing.T) {
+	resolver, err := Open(fixture, nil)
+	assert.Nil(t, err)
+	defer resolver.Close()
+
+	testCases := []struct {
+		addr    string
+		country string
+	}{
+		{"89.160.20.115", "DE"},
+		{"81.2.69.143", "GB"},
+		{"216.160.83.60", "US"},
+		{"2001:db8:1::42", "DE"},
+		{"::ffff:81.2.69.142", "GB"},
+		{"1.1.1.1", ""},
+		{"2001:db8:2::1", ""},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.country, resolver.Country(netip.MustParseAddr(tc.addr)), tc.addr)
+	}
+	assert.Equal(t, "", resolver.Country(netip.Addr{}))
+}
+
+func TestOpen_Errors(t *testing.T) {
+	_, err := Open("testdata/missing.mmdb", nil)
+	assert.NotNil(t, err)
+
+	_, err = Open(fixture, []string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	resolver, err := Open(fixture, []string{"10.0.0.0/8", "192.168.1.1"})
+	assert.Nil(t, err)
+	defer resolver.Close()
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		client     string
+	}{
+		{"direct", "81.2.69.142:4000", nil, "81.2.69.142"},
+		{"untrusted peer can't spoof", "81.2.69.142:4000", []string{"89.160.20.115"}, "81.2.69.142"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"89.160.20.115"}, "89.160.20.115"},
+		{"chain of trusted proxies", "10.1.2.3:4000", []string{"89.160.20.115, 192.168.1.1"}, "89.160.20.115"},
+		{"spoofed entry left of the client", "10.1.2.3:4000", []string{"1.2.3.4, 89.160.20.115"}, "89.160.20.115"},
+		{"header repeated", "10.1.2.3:4000", []string{"1.2.3.4", "216.160.83.60"}, "216.160.83.60"},
+		{"garbage stops the walk", "10.1.2.3:4000", []string{"89.160.20.115, unknown"}, "10.1.2.3"},
+		{"IPv6 peer", "[2001:db8:1::42]:4000", nil, "2001:db8:1::42"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/r/abc123", nil)
+			request.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tc.client, resolver.ClientIP(request).String())
+		})
+	}
+}
+
+func TestRequestCountry(t *testing.T) {
+	resolver, err := Open(fixture, []string{"10.0.0.0/8"})
+	assert.Nil(t, err)
+	defer resolver.Close()
+
+	request := httptest.NewRequest("GET", "/r/abc123", nil)
+	request.RemoteAddr = "10.1.2.3:4000"
+	request.Header.Set("X-Forwarded-For", "89.160.20.115")
+	assert.Equal(t, "DE", resolver.RequestCountry(request))
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"url-shortener/pkg/access"
+	"url-shortener/pkg/shortener"
+)
+
+// accessKey marks in the request context that a valid access signature was given
+type accessKey struct{}
+
+// accessRequest is the body accepted by CreateAccessURL, both fields are optional
+type accessRequest struct {
+	TTL  string `json:"ttl,omitempty"`  // Lifetime of the access URL, e.g. "15m"
+	Path string `json:"path,omitempty"` // Path under a path forwarding link the URL gives access to
+}
+
+type accessResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SignedAccess wraps Redirect: requests carrying access parameters are refused unless they're
+// signed for the requested short URL and not expired. Valid ones are let through to links
+// requiring a signature, without the parameters so they aren't forwarded to the destination.
+func (h *Handler) SignedAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if h.access == nil || !access.Signed(query) {
+			next(w, r)
+			return
+		}
+
+		url, _ := wantsPreview(r, urlConstruct(r))
+		if err := h.access.Verify(h.shortener.NormalizeShortURL(url), query, time.Now()); err != nil {
+			h.logger.Info("Refused access URL", "URL", url, "error", err)
+			if errors.Is(err, access.ErrExpired) {
+				h.errorPage(w, r, "error.html", newAPIError(http.StatusForbidden, codeExpired, "Access URL expired"), url)
+				return
+			}
+			h.errorPage(w, r, "error.html", newAPIError(http.StatusForbidden, codeAccessDenied, "Invalid access signature"), url)
+			return
+		}
+
+		r = r.Clone(context.WithValue(r.Context(), accessKey{}, true))
+		r.URL.RawQuery = access.Strip(r.URL.RawQuery)
+		next(w, r)
+	}
+}
+
+// hasAccess reports whether SignedAccess verified the signature of the request
+func hasAccess(r *http.Request) bool {
+	granted, _ := r.Context().Value(accessKey{}).(bool)
+	return granted
+}
+
+// CreateAccessURL mints a time-limited signed URL for a link, which also opens links requiring a signature.
+func (h *Handler) CreateAccessURL(w http.ResponseWriter, r *http.Request) {
+	if h.access == nil {
+		h.fail(w, r, newAPIError(http.StatusNotFound, codeNotFound, "Signed access is not enabled"))
+		return
+	}
+
+	req := accessRequest{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Error("invalid request", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid request"))
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			h.logger.Error("invalid JSON format", "error", err)
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON format"))
+			return
+		}
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid ttl: "+err.Error()))
+			return
+		}
+	}
+	expires, err := h.access.Expires(ttl, time.Now())
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	u, ok := h.findLink(w, r)
+	if !ok {
+		return
+	}
+	if u.IsExpired(time.Now()) {
+		h.fail(w, r, newAPIError(http.StatusGone, codeExpired, "URL has expired"))
+		return
+	}
+
+	target := u.ShortURL
+	if path := strings.Trim(req.Path, "/"); path != "" {
+		if !u.ForwardPath {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Paths are only served under path forwarding links"))
+			return
+		}
+		if _, err := shortener.ForwardPath(u.OriginalURL, path); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid path"))
+			return
+		}
+		target += "/" + path
+	}
+
+	signed := target + "?" + h.access.Sign(h.shortener.NormalizeShortURL(target), expires).Encode()
+	h.logger.Info("Access URL created", "URL", target, "expires", expires)
+	writeJSON(w, http.StatusCreated, accessResponse{URL: signed, ExpiresAt: expires.UTC()})
+}
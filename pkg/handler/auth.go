@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"url-shortener/pkg/model"
+)
+
+// bearerPrefix precedes the API key in the Authorization header
+const bearerPrefix = "Bearer "
+
+// RequireAPIKey wraps a handler so that only callers presenting one of the API keys reach it.
+func (h *Handler) RequireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticated(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="url-shortener"`)
+			h.fail(w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, "A valid API key is required"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticated reports whether the request carries one of the API keys as a bearer token
+func (h *Handler) authenticated(r *http.Request) bool {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+	if !ok || key == "" {
+		return false
+	}
+	for _, apiKey := range h.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// visible returns the link as the caller may see it. Links requiring a signature
+// are private: their destinations are only shown to callers presenting an API key.
+func (h *Handler) visible(r *http.Request, u *model.URL) *model.URL {
+	if h.authenticated(r) {
+		return u
+	}
+	return u.Public()
+}
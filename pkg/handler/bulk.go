@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/webhook"
+)
+
+const (
+	bulkBatchSize   = 500     // Links saved per database round trip
+	maxNDJSONLineSz = 1 << 20 // Longest accepted NDJSON line
+	ndjsonMediaType = "application/x-ndjson"
+)
+
+// bulkResult reports the outcome for one entry of a bulk request
+type bulkResult struct {
+	Index    int        `json:"index"`
+	Status   int        `json:"status"` // Status the entry would have gotten from /create
+	ShortURL string     `json:"short_url,omitempty"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Code     string     `json:"code,omitempty"` // Problem code of the error
+}
+
+// bulkItem is an entry waiting for its batch, err is set when it is invalid
+type bulkItem struct {
+	index int
+	url   *model.URL
+	err   *apiError
+}
+
+// BulkShortenURLs creates links from a JSON array or an NDJSON stream of /create bodies.
+// Entries are saved in batches and each gets its own result, so one invalid entry
+// doesn't fail the others.
+func (h *Handler) BulkShortenURLs(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := mediaType == ndjsonMediaType
+
+	out := newBulkWriter(w, ndjson)
+	pending := make([]bulkItem, 0, bulkBatchSize)
+	flush := func() {
+		for _, result := range h.saveBulkItems(r, pending) {
+			out.write(result)
+		}
+		pending = pending[:0]
+	}
+
+	handle := func(index int, raw []byte) {
+		url, err := h.newBulkURL(raw)
+		pending = append(pending, bulkItem{index: index, url: url, err: err})
+		if len(pending) == bulkBatchSize {
+			flush()
+		}
+	}
+
+	var stopped int
+	var err error
+	if ndjson {
+		stopped, err = readNDJSON(r.Body, handle)
+	} else {
+		stopped, err = readJSONArray(r.Body, handle)
+	}
+	flush()
+	if err != nil {
+		h.logger.Error("Bulk request stopped", "index", stopped, "error", err)
+		out.write(bulkResult{Index: stopped, Status: http.StatusBadRequest, Error: err.Error(), Code: codeInvalidRequest})
+	}
+	out.close()
+
+	h.logger.Info("Bulk request processed", "entries", out.count)
+}
+
+// newBulkURL validates one entry and builds the URL to save
+func (h *Handler) newBulkURL(raw []byte) (*model.URL, *apiError) {
+	req := createRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid JSON format: %v", err))
+	}
+	url := req.URL
+	if err := url.Sanitize(h.deepLinkSchemes); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidURL, fmt.Sprintf("invalid input data: %v", err))
+	}
+	if req.Prefix != "" && !h.shortener.IsValidPrefix(req.Prefix) {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidSlug, fmt.Sprintf("invalid prefix %q", req.Prefix))
+	}
+	if url.RequireSignature && h.access == nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "signed access is not enabled")
+	}
+	expiry, err := h.resolveExpiry(req.expiryRequest, time.Now())
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	if err := h.assignShortURL(req.Prefix, &url); err != nil {
+		h.logger.Error("Error generating short URL", "error", err)
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "failed to shorten URL")
+	}
+	url.ForwardPath = url.ForwardPath || req.Prefix != ""
+	url.Expiry = expiry
+	url.ClickCount = 0
+	url.CreatedAt = time.Now()
+	url.Metadata = nil
+	return &url, nil
+}
+
+func (h *Handler) saveBulkItems(r *http.Request, items []bulkItem) []bulkResult {
+	if len(items) == 0 {
+		return nil
+	}
+	var urls []*model.URL
+	for _, item := range items {
+		if item.err == nil {
+			urls = append(urls, item.url)
+		}
+	}
+	// Pages already shortened get their link back, the other links are saved in one round trip
+	found, lookupErr := h.findGenerated(r.Context(), urls)
+	if lookupErr != nil {
+		h.logger.Error("Error looking up shortened pages", "error", lookupErr)
+	}
+	var unsaved []*model.URL
+	for i, url := range urls {
+		if found[i] == nil {
+			unsaved = append(unsaved, url)
+		}
+	}
+	var errs []error
+	if lookupErr == nil && len(unsaved) > 0 {
+		errs = h.saveBatch(r.Context(), unsaved)
+	}
+
+	results := make([]bulkResult, len(items))
+	for i, item := range items {
+		if item.err != nil {
+			results[i] = bulkResult{Index: item.index, Status: item.err.status, Error: item.err.detail, Code: item.err.code}
+			continue
+		}
+		url, existing, err := item.url, found[0], lookupErr
+		found = found[1:]
+		if err == nil && existing == nil {
+			err, errs = errs[0], errs[1:]
+			if errors.Is(err, repository.ErrAlreadyExists) {
+				existing, err = h.create(r.Context(), url)
+			}
+		}
+		status := http.StatusCreated
+		var failure *apiError
+		switch {
+		case errors.Is(err, repository.ErrAlreadyExists):
+			failure = newAPIError(http.StatusConflict, codeSlugTaken, "short URL already taken")
+		case err != nil:
+			h.logger.Error("Error saving URL", "error", err)
+			failure = newAPIError(http.StatusInternalServerError, codeInternal, "failed to save URL")
+		case existing != nil:
+			url, status = existing, http.StatusOK
+		default:
+			h.fetchMetadata(url)
+		}
+
+		if failure != nil {
+			results[i] = bulkResult{Index: item.index, Status: failure.status, Error: failure.detail, Code: failure.code}
+			continue
+		}
+		results[i] = bulkResult{Index: item.index, Status: status, ShortURL: url.ShortURL, Expiry: url.Expiry}
+	}
+	return results
+}
+
+// saveBatch saves the urls with their link.created events in one transaction. Taken short URLs
+// only fail their own link, any other error rolls the batch back and fails every link.
+func (h *Handler) saveBatch(ctx context.Context, urls []*model.URL) []error {
+	var errs []error
+	err := h.inTx(ctx, func(ctx context.Context) error {
+		errs = h.repo.SaveBatch(ctx, urls)
+		for i, u := range urls {
+			switch {
+			case errs[i] == nil:
+				if err := h.emit(ctx, webhook.EventLinkCreated, u.Public()); err != nil {
+					return err
+				}
+			case !errors.Is(errs[i], repository.ErrAlreadyExists):
+				return errs[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = make([]error, len(urls))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for i, u := range urls {
+		if errs[i] == nil && u.ForwardPath {
+			h.shortener.RegisterPrefix(u.ShortURL)
+		}
+	}
+	return errs
+}
+
+// readNDJSON hands each non-empty line to handle. On error, it returns the index of the entry it stopped at.
+func readNDJSON(body io.Reader, handle func(index int, raw []byte)) (int, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineSz)
+	index := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		handle(index, line)
+		index++
+	}
+	return index, scanner.Err()
+}
+
+// readJSONArray hands each element to handle. On error, it returns the index of the entry it stopped at.
+func readJSONArray(body io.Reader, handle func(index int, raw []byte)) (int, error) {
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return 0, errors.New("request body must be a JSON array or NDJSON")
+	}
+	index := 0
+	for ; decoder.More(); index++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return index, fmt.Errorf("invalid JSON format: %v", err)
+		}
+		handle(index, raw)
+	}
+	_, err := decoder.Token()
+	return index, err
+}
+
+// bulkWriter streams results as a JSON array or as NDJSON
+type bulkWriter struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	ndjson  bool
+	count   int
+}
+
+func newBulkWriter(w http.ResponseWriter, ndjson bool) *bulkWriter {
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonMediaType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	if !ndjson {
+		io.WriteString(w, "[")
+	}
+	return &bulkWriter{w: w, encoder: json.NewEncoder(w), ndjson: ndjson}
+}
+
+func (b *bulkWriter) write(result bulkResult) {
+	if !b.ndjson && b.count > 0 {
+		io.WriteString(b.w, ",")
+	}
+	b.encoder.Encode(result)
+	b.count++
+}
+
+func (b *bulkWriter) close() {
+	if !b.ndjson {
+		io.WriteString(b.w, "]\n")
+	}
+}
@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"net/http"
+
+	"url-shortener/pkg/model"
+)
+
+// servesCard reports whether the request comes from a crawler that should get
+// the link's own Open Graph card instead of following the redirect
+func (h *Handler) servesCard(r *http.Request, u *model.URL) bool {
+	return h.pages != nil && h.crawlers != nil && u.HasOpenGraph() && h.crawlers.IsCrawler(r.UserAgent())
+}
+
+// card renders a page carrying the link's Open Graph tags, with a meta refresh to the destination
+func (h *Handler) card(w http.ResponseWriter, r *http.Request, u *model.URL) {
+	if err := h.pages.Render(w, "card.html", http.StatusOK, u); err != nil {
+		h.logger.Error("Failed to render card page", "error", err)
+	}
+}
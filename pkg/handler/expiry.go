@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"url-shortener/pkg/webhook"
+)
+
+// expiryRequest holds the expiry options a client can set on a link.
+// At most one of them may be given; when none is, the default expiry applies.
+type expiryRequest struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Absolute expiry date
+	TTL       string     `json:"ttl,omitempty"`        // Lifetime from now, e.g. "72h"
+	Expires   *bool      `json:"expires,omitempty"`    // false for links that never expire
+}
+
+func (e expiryRequest) isEmpty() bool {
+	return e.ExpiresAt == nil && e.TTL == "" && e.Expires == nil
+}
+
+// resolveExpiry turns the requested options into an expiry date, enforcing the TTL bounds.
+// A nil expiry means the link never expires.
+func (h *Handler) resolveExpiry(req expiryRequest, now time.Time) (*time.Time, error) {
+	options := 0
+	if req.ExpiresAt != nil {
+		options++
+	}
+	if req.TTL != "" {
+		options++
+	}
+	if req.Expires != nil {
+		options++
+	}
+	if options > 1 {
+		return nil, errors.New("only one of expires_at, ttl and expires can be set")
+	}
+
+	ttl := h.expiryDuration
+	switch {
+	case req.Expires != nil:
+		if *req.Expires {
+			break
+		}
+		if h.maxTTL > 0 {
+			return nil, fmt.Errorf("links can't live longer than %s", h.maxTTL)
+		}
+		return nil, nil
+	case req.ExpiresAt != nil:
+		ttl = req.ExpiresAt.Sub(now)
+	case req.TTL != "":
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl: %v", err)
+		}
+		ttl = parsed
+	}
+
+	if ttl < h.minTTL {
+		return nil, fmt.Errorf("links must live at least %s", h.minTTL)
+	}
+	if h.maxTTL > 0 && ttl > h.maxTTL {
+		return nil, fmt.Errorf("links can't live longer than %s", h.maxTTL)
+	}
+	expiry := now.Add(ttl)
+	return &expiry, nil
+}
+
+// UpdateExpiry extends or shortens the lifetime of an existing link
+func (h *Handler) UpdateExpiry(w http.ResponseWriter, r *http.Request) {
+	var req expiryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error("invalid JSON format", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON format"))
+		return
+	}
+	if req.isEmpty() {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "One of expires_at, ttl and expires is required"))
+		return
+	}
+
+	expiry, err := h.resolveExpiry(req, time.Now())
+	if err != nil {
+		h.logger.Error("Invalid expiry", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	u, ok := h.findLink(w, r)
+	if !ok {
+		return
+	}
+	shortURL := u.ShortURL
+
+	err = h.inTx(r.Context(), func(ctx context.Context) error {
+		if err := h.repo.UpdateExpiry(ctx, shortURL, expiry); err != nil {
+			return err
+		}
+		u.Expiry = expiry
+		return h.emit(ctx, webhook.EventLinkUpdated, u.Public())
+	})
+	if err != nil {
+		h.logger.Error("Error updating expiry", "URL", shortURL, "error", err)
+		h.fail(w, r, err)
+		return
+	}
+
+	h.logger.Info("URL expiry updated", "shortURL", shortURL, "expiry", expiry)
+	writeJSON(w, http.StatusOK, h.visible(r, u))
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"url-shortener/pkg/model"
+)
+
+// Fallback holds the destinations visitors are sent to when a short URL can't be served.
+type Fallback struct {
+	NotFoundURL string
+	ExpiredURL  string
+}
+
+// pageData is passed to the HTML error page templates.
+type pageData struct {
+	ShortURL string
+	Title    string // Status text, such as Forbidden
+	Detail   string
+}
+
+// notFound sends the visitor to the not-found fallback of the domain, or renders an error.
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request, shortURL string) {
+	if destination := h.fallbackFor(r.Host).NotFoundURL; destination != "" {
+		http.Redirect(w, r, destination, http.StatusFound)
+		return
+	}
+	h.errorPage(w, r, "not_found.html", newAPIError(http.StatusNotFound, codeNotFound, "URL not found"), shortURL)
+}
+
+// expired sends the visitor to the link's own expired destination, then the domain's,
+// or renders an error when neither is set.
+func (h *Handler) expired(w http.ResponseWriter, r *http.Request, u *model.URL) {
+	destination := u.ExpiredRedirectURL
+	if destination == "" {
+		destination = h.fallbackFor(r.Host).ExpiredURL
+	}
+	if destination != "" {
+		http.Redirect(w, r, destination, http.StatusFound)
+		return
+	}
+	h.errorPage(w, r, "expired.html", newAPIError(http.StatusGone, codeExpired, "URL has expired"), u.ShortURL)
+}
+
+// fallbackFor returns the fallback configured for host, merged with the default one.
+func (h *Handler) fallbackFor(host string) Fallback {
+	fallback, ok := h.fallbacks[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			fallback = h.fallbacks[hostname]
+		}
+	}
+	if fallback.NotFoundURL == "" {
+		fallback.NotFoundURL = h.fallback.NotFoundURL
+	}
+	if fallback.ExpiredURL == "" {
+		fallback.ExpiredURL = h.fallback.ExpiredURL
+	}
+	return fallback
+}
+
+// errorPage renders the named template for browsers and falls back to a problem otherwise.
+func (h *Handler) errorPage(w http.ResponseWriter, r *http.Request, page string, e *apiError, shortURL string) {
+	if h.pages == nil || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeProblem(w, r, e)
+		return
+	}
+	data := pageData{ShortURL: shortURL, Title: http.StatusText(e.status), Detail: e.detail}
+	if err := h.pages.Render(w, page, e.status, data); err != nil {
+		h.logger.Error("Failed to render error page", "page", page, "error", err)
+	}
+}
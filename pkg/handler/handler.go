@@ -1,136 +1,465 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"url-shortener/pkg/access"
+	"url-shortener/pkg/clickstream"
+	"url-shortener/pkg/geoip"
 	"url-shortener/pkg/model"
+	"url-shortener/pkg/pages"
 	"url-shortener/pkg/repository"
 	"url-shortener/pkg/shortener"
+	"url-shortener/pkg/transfer"
+	"url-shortener/pkg/useragent"
+	"url-shortener/pkg/webhook"
 )
 
 type HandlerConfiguration struct {
-	URLRepository  repository.URLRepository
-	Logger         *slog.Logger
-	Domain         string
-	ExpiryDuration time.Duration
-	Shortener      shortener.Shortener
+	URLRepository   repository.URLRepository
+	Logger          *slog.Logger
+	Domain          string
+	ExpiryDuration  time.Duration // Lifetime of links created without expiry options
+	MinTTL          time.Duration // Shortest lifetime a client may request
+	MaxTTL          time.Duration // Longest lifetime a client may request, 0 means unbounded
+	Shortener       shortener.Shortener
+	Fallback        Fallback            // Used when no domain-specific fallback is configured
+	Fallbacks       map[string]Fallback // Per-domain fallbacks, keyed by host
+	Pages           *pages.Renderer     // Optional, renders HTML error pages for browsers
+	Idempotency     repository.IdempotencyRepository
+	IdempotencyTTL  time.Duration // How long responses are replayed for a given Idempotency-Key
+	Importer        *transfer.Importer
+	QRLogo          image.Image               // Optional, drawn at the center of QR codes requested with logo=true
+	Crawlers        *useragent.CrawlerMatcher // Crawlers served Open Graph cards instead of redirects
+	Metadata        MetadataFetcher           // Optional, fetches the destination of new links
+	Webhooks        repository.WebhookRepository
+	Events          webhook.Emitter       // Optional, records link events for webhooks
+	Transactor      repository.Transactor // Optional, commits link changes with their events
+	Clicks          *clickstream.Broker   // Streams clicks to live dashboards
+	StreamKeepalive time.Duration         // Time between keepalive comments on idle click streams
+	GeoIP           *geoip.Resolver       // Optional, resolves visitor countries for per-country destinations
+	Access          *access.Signer        // Optional, signs time-limited access URLs
+	APIKeys         []string              // Keys of the clients allowed to mint access URLs and see private destinations
+	DeepLinkSchemes model.DeepLinkSchemes // Custom schemes device rules may send visitors to
 }
 
 // Handler struct holds the dependencies for the HTTP handlers
 type Handler struct {
-	repo           repository.URLRepository
-	logger         *slog.Logger
-	shortener      shortener.Shortener
-	domain         string
-	expiryDuration time.Duration
+	repo            repository.URLRepository
+	logger          *slog.Logger
+	shortener       shortener.Shortener
+	domain          string
+	expiryDuration  time.Duration
+	minTTL          time.Duration
+	maxTTL          time.Duration
+	fallback        Fallback
+	fallbacks       map[string]Fallback
+	pages           *pages.Renderer
+	idempotency     repository.IdempotencyRepository
+	idempotencyTTL  time.Duration
+	importer        *transfer.Importer
+	qrLogo          image.Image
+	crawlers        *useragent.CrawlerMatcher
+	metadata        MetadataFetcher
+	webhooks        repository.WebhookRepository
+	events          webhook.Emitter
+	transactor      repository.Transactor
+	clicks          *clickstream.Broker
+	streamKeepalive time.Duration
+	geo             *geoip.Resolver
+	access          *access.Signer
+	apiKeys         []string
+	deepLinkSchemes model.DeepLinkSchemes
 }
 
 // NewHandler creates a new Handler with the given configuration
 func NewHandler(config *HandlerConfiguration) *Handler {
 	return &Handler{
-		repo:           config.URLRepository,
-		logger:         config.Logger,
-		domain:         config.Domain,
-		expiryDuration: config.ExpiryDuration,
-		shortener:      config.Shortener,
+		repo:            config.URLRepository,
+		logger:          config.Logger,
+		domain:          config.Domain,
+		expiryDuration:  config.ExpiryDuration,
+		minTTL:          config.MinTTL,
+		maxTTL:          config.MaxTTL,
+		shortener:       config.Shortener,
+		fallback:        config.Fallback,
+		fallbacks:       config.Fallbacks,
+		pages:           config.Pages,
+		idempotency:     config.Idempotency,
+		idempotencyTTL:  config.IdempotencyTTL,
+		importer:        config.Importer,
+		qrLogo:          config.QRLogo,
+		crawlers:        config.Crawlers,
+		metadata:        config.Metadata,
+		webhooks:        config.Webhooks,
+		events:          config.Events,
+		transactor:      config.Transactor,
+		clicks:          config.Clicks,
+		streamKeepalive: config.StreamKeepalive,
+		geo:             config.GeoIP,
+		access:          config.Access,
+		apiKeys:         config.APIKeys,
+		deepLinkSchemes: config.DeepLinkSchemes,
 	}
 }
 
+// createRequest is the body accepted by ShortenURL
+type createRequest struct {
+	model.URL
+	expiryRequest
+	Prefix string `json:"prefix,omitempty"` // Serves the link at this path, forwarding the paths under it
+}
+
 // ShortenURL handles the shortening of URLs
 func (h *Handler) ShortenURL(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, r, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		h.logger.Error("invalid request", "error", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid request"))
 		return
 	}
 
-	url := model.URL{}
-	if err := json.Unmarshal(body, &url); err != nil {
+	req := createRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
 		h.logger.Error("invalid JSON format", "error", err)
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON format"))
 		return
 	}
+	url := req.URL
 
-	if err := url.Sanitize(); err != nil {
+	if err := url.Sanitize(h.deepLinkSchemes); err != nil {
 		h.logger.Error("Invalid input data", "error", err)
-		http.Error(w, "Invalid input data", http.StatusBadRequest)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidURL, "Invalid input data: "+err.Error()))
+		return
+	}
+
+	if req.Prefix != "" && !h.shortener.IsValidPrefix(req.Prefix) {
+		h.logger.Error("Invalid prefix", "prefix", req.Prefix)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidSlug, "Invalid prefix, use up to 5 segments of letters, digits, - and _ without reserved or blocked words"))
 		return
 	}
 
-	shortURL, err := h.shortener.GenerateShortURL(url.OriginalURL)
+	if url.RequireSignature && h.access == nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Signed access is not enabled"))
+		return
+	}
+
+	expiry, err := h.resolveExpiry(req.expiryRequest, time.Now())
 	if err != nil {
+		h.logger.Error("Invalid expiry", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	if err := h.assignShortURL(req.Prefix, &url); err != nil {
 		h.logger.Error("Error generating short URL", "error", err)
-		http.Error(w, "Failed to shorten URL", http.StatusInternalServerError)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to shorten URL"))
 		return
 	}
-	url.ShortURL = shortURL
-	url.Expiry = time.Now().Add(h.expiryDuration) // Sets expiry to 30 days from now
+	url.ForwardPath = url.ForwardPath || req.Prefix != ""
+	url.Expiry = expiry
+	url.ClickCount = 0
+	url.CreatedAt = time.Now()
+	url.Metadata = nil
 
-	if err := h.repo.Save(r.Context(), &url); err != nil {
+	// The page may already be shortened, hand that link back untouched
+	found, err := h.findGenerated(r.Context(), []*model.URL{&url})
+	existing := found[0]
+	if err == nil && existing == nil {
+		existing, err = h.create(r.Context(), &url)
+	}
+	switch {
+	case errors.Is(err, repository.ErrAlreadyExists):
+		h.logger.Error("Short URL already taken", "shortURL", url.ShortURL)
+		h.fail(w, r, newAPIError(http.StatusConflict, codeSlugTaken, "Short URL already taken"))
+	case err != nil:
 		h.logger.Error("Error saving URL", "error", err)
-		http.Error(w, "Failed to save URL", http.StatusInternalServerError)
-		return
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to save URL"))
+	case existing != nil:
+		h.logger.Info("URL already shortened", "originalURL", existing.OriginalURL, "shortURL", existing.ShortURL)
+		writeJSON(w, http.StatusOK, existing)
+	default:
+		h.logger.Info("URL shortened successfully", "originalURL", url.OriginalURL, "shortURL", url.ShortURL)
+		h.fetchMetadata(&url)
+		writeJSON(w, http.StatusCreated, url)
 	}
+}
 
-	h.logger.Info("URL shortened successfully", "originalURL", url.OriginalURL, "shortURL", shortURL)
-	w.Header().Set("Content-Type", "text/plain")
+// create saves u with its link.created event in one transaction. When the short URL of u is taken,
+// it returns the link shortening the same page or saves u under a re-rolled one, see resolveTaken.
+func (h *Handler) create(ctx context.Context, u *model.URL) (*model.URL, error) {
+	var existing *model.URL
+	err := h.inTx(ctx, func(ctx context.Context) error {
+		err := h.repo.Save(ctx, u)
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			existing, err = h.resolveTaken(ctx, u)
+		}
+		if err != nil || existing != nil {
+			return err
+		}
+		return h.emit(ctx, webhook.EventLinkCreated, u.Public())
+	})
+	if err == nil && existing == nil && u.ForwardPath {
+		h.shortener.RegisterPrefix(u.ShortURL)
+	}
+	return existing, err
+}
 
-	um, err := json.Marshal(url)
+// findGenerated returns, for each of the urls, the live link generated from the same canonical URL
+// with the same signature requirement, or nil. Links under a prefix are never looked up.
+func (h *Handler) findGenerated(ctx context.Context, urls []*model.URL) ([]*model.URL, error) {
+	found := make([]*model.URL, len(urls))
+	var canonicalURLs []string
+	for _, u := range urls {
+		if u.CanonicalURL != "" {
+			canonicalURLs = append(canonicalURLs, u.CanonicalURL)
+		}
+	}
+	if len(canonicalURLs) == 0 {
+		return found, nil
+	}
+	existing, err := h.repo.FindByCanonicalURLs(ctx, canonicalURLs)
 	if err != nil {
-		h.logger.Error("error marshalling response %s", err)
-		http.Error(w, "Error marshalling response", http.StatusInternalServerError)
-		return
+		return found, err
+	}
+	for i, u := range urls {
+		for _, e := range existing {
+			// Handing back a public link to a client asking for a private one would expose the destination
+			if u.CanonicalURL != "" && e.CanonicalURL == u.CanonicalURL && e.RequireSignature == u.RequireSignature {
+				found[i] = e
+				break
+			}
+		}
 	}
+	return found, nil
+}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write(um)
+// resolveTaken handles a link whose short URL is held by another link. It returns that link when it
+// shortens the same page, and otherwise saves u under the next generated short URLs and returns nil.
+// Short URLs under a prefix are chosen by the client and never re-rolled, ErrAlreadyExists is returned.
+func (h *Handler) resolveTaken(ctx context.Context, u *model.URL) (*model.URL, error) {
+	for attempt := 1; ; attempt++ {
+		// Concurrent requests for the same page both miss findGenerated, the loser gets the winner's link
+		if existing, err := h.findSameLink(ctx, u); err == nil {
+			return existing, nil
+		}
+		if u.CanonicalURL == "" {
+			return nil, repository.ErrAlreadyExists
+		}
+		shortURL, err := h.shortener.GenerateShortURL(u.OriginalURL, attempt)
+		if errors.Is(err, shortener.ErrNoAllowedSlug) {
+			return nil, repository.ErrAlreadyExists
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.logger.Info("Short URL held by another page, re-rolling", "shortURL", u.ShortURL, "attempt", attempt)
+		u.ShortURL = shortURL
+		if err := h.repo.Save(ctx, u); !errors.Is(err, repository.ErrAlreadyExists) {
+			return nil, err
+		}
+	}
+}
+
+// findSameLink returns the live link stored under the short URL of u
+// when both point to the same canonical URL and require a signature alike.
+func (h *Handler) findSameLink(ctx context.Context, u *model.URL) (*model.URL, error) {
+	existing, err := h.repo.Find(ctx, u.ShortURL)
+	if err != nil {
+		return nil, err
+	}
+	// Expired links keep their short URL during the purge grace period
+	if existing.IsExpired(time.Now()) {
+		return nil, errors.New("short URL is held by an expired link")
+	}
+	canonical, err := h.shortener.CanonicalizeURL(u.OriginalURL)
+	if err != nil {
+		return nil, err
+	}
+	existingCanonical, err := h.shortener.CanonicalizeURL(existing.OriginalURL)
+	if err != nil {
+		return nil, err
+	}
+	if canonical != existingCanonical {
+		return nil, fmt.Errorf("short URL points to %s", existing.OriginalURL)
+	}
+	// Handing back a public link to a client asking for a private one would expose the destination
+	if existing.RequireSignature != u.RequireSignature {
+		return nil, errors.New("short URL is held by a link with another signature requirement")
+	}
+	return existing, nil
 }
 
-// Redirect handles redirection to the original URL
+// Redirect handles redirection to the original URL.
+// Short URLs ending with "+", or requested as JSON, show a preview of the link instead.
 func (h *Handler) Redirect(w http.ResponseWriter, r *http.Request) {
-	url := urlConstruct(r)
+	url, preview := wantsPreview(r, urlConstruct(r))
 	if !h.shortener.IsValidShortURL(url) {
 		h.logger.Error("Invalid short URL provided", "URL", url)
-		http.Error(w, "Invalid slug", http.StatusBadRequest)
+		h.errorPage(w, r, "error.html", newAPIError(http.StatusBadRequest, codeInvalidSlug, "Invalid slug"), url)
 		return
 	}
 
-	u, err := h.repo.Find(r.Context(), url)
+	u, path, err := h.lookup(r.Context(), url)
+	if errors.Is(err, repository.ErrNotFound) {
+		h.logger.Info("URL not found", "URL", url)
+		h.notFound(w, r, url)
+		return
+	}
 	if err != nil {
-		h.logger.Error("URL not found", "URL", url, "error", err)
-		http.Error(w, "URL not found", http.StatusNotFound)
+		h.errorPage(w, r, "error.html", h.toAPIError(err), url)
 		return
 	}
 
-	if time.Now().After(u.Expiry) {
+	if u.IsExpired(time.Now()) {
 		h.logger.Info("Attempted to access expired URL", "URL", url)
-		http.Error(w, "URL has expired", http.StatusGone)
+		h.expired(w, r, u)
 		return
 	}
 
-	h.redirect(w, r, u.OriginalURL, url)
+	if u.RequireSignature && !hasAccess(r) {
+		h.logger.Info("Refused unsigned access", "URL", url)
+		h.errorPage(w, r, "error.html", newAPIError(http.StatusForbidden, codeAccessDenied, "A valid access signature is required"), url)
+		return
+	}
+
+	if preview {
+		h.preview(w, r, u)
+		return
+	}
+
+	// Unfurling bots are not visitors, their requests aren't counted as clicks
+	if h.servesCard(r, u) {
+		h.card(w, r, u)
+		return
+	}
+
+	h.redirect(w, r, u, path)
+}
+
+// lookup returns the link served at the short URL: the link stored under it, or else
+// the path forwarding link with its longest prefix, along with the path after the prefix.
+func (h *Handler) lookup(ctx context.Context, shortURL string) (*model.URL, string, error) {
+	u, err := h.repo.Find(ctx, h.shortener.NormalizeShortURL(shortURL))
+	if err == nil {
+		return u, "", nil
+	}
+	candidates := h.shortener.PrefixCandidates(shortURL)
+	if len(candidates) == 0 || !errors.Is(err, repository.ErrNotFound) {
+		return nil, "", err
+	}
+	u, err = h.repo.FindPrefix(ctx, candidates)
+	if err != nil {
+		return nil, "", err
+	}
+	// The path keeps its case even when the prefix doesn't
+	return u, strings.TrimPrefix(shortURL[len(u.ShortURL):], "/"), nil
 }
 
-func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, originalURL string, shortURL string) {
-	// Increment the click count before redirecting
-	if err := h.repo.IncrementClickCount(r.Context(), shortURL); err != nil {
-		h.logger.Error("Failed to increment click count", "error", err)
+// redirect sends the visitor to the destination of the link that applies to them,
+// with the path under the short URL appended for path forwarding links
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, u *model.URL, path string) {
+	device := useragent.Parse(r.UserAgent())
+	visitor := model.Visitor{OS: device.OS, Device: device.Type}
+	if h.geo != nil {
+		visitor.Country = h.geo.RequestCountry(r)
+	}
+	if len(u.Variants) > 0 {
+		visitor.Variant = h.variant(w, r, u)
+	}
+	destination, variant := u.Destination(visitor)
+	destination, err := shortener.ForwardPath(destination, path)
+	if err != nil {
+		h.logger.Info("Refused forwarded path", "URL", u.ShortURL, "path", path, "error", err)
+		h.errorPage(w, r, "error.html", newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid path"), u.ShortURL)
+		return
+	}
+	destination = withQuery(destination, r, u)
+
+	click := model.Click{
+		ShortURL:    u.ShortURL,
+		Destination: destination,
+		Referrer:    r.Referer(),
+		UserAgent:   r.UserAgent(),
+		Country:     visitor.Country,
+		Variant:     variant,
+		Time:        time.Now(),
+	}
+	// Count the click before redirecting, the sampled link.clicked event commits with it
+	err = h.inTx(r.Context(), func(ctx context.Context) error {
+		if err := h.repo.IncrementClickCount(ctx, u.ShortURL, variant); err != nil {
+			return err
+		}
+		event := click
+		if u.RequireSignature {
+			event.Destination = "" // Private links don't give their destinations away
+		}
+		return h.emit(ctx, webhook.EventLinkClicked, &event)
+	})
+	if err != nil {
+		h.logger.Error("Failed to record click", "error", err)
 		// Decide if we want to stop the redirect if the click count fails
 	}
-	http.Redirect(w, r, originalURL, http.StatusFound)
+	h.clicks.Publish(click)
+	http.Redirect(w, r, destination, http.StatusFound)
 }
 
+// withQuery adds the UTM defaults of the link to the destination, then the query
+// of the short URL when the link forwards it. Parameters of the short URL override those
+// of the destination, which override the UTM defaults.
+func withQuery(destination string, r *http.Request, u *model.URL) string {
+	if u.UTM != nil {
+		destination = shortener.MergeQuery(destination, u.UTM.Values(), false)
+	}
+	if u.ForwardQuery && r.URL.RawQuery != "" {
+		// Malformed pairs are skipped, the others are still forwarded
+		destination = shortener.MergeQuery(destination, r.URL.Query(), true)
+	}
+	return destination
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// urlConstruct returns the short URL requested, with its path escaped as it was received
 func urlConstruct(r *http.Request) string {
-	return fmt.Sprintf("%s%s", r.Host, r.URL.Path)
+	return fmt.Sprintf("%s%s", r.Host, r.URL.EscapedPath())
+}
+
+// assignShortURL sets the short URL of a new link: the one of its prefix, or the first one generated
+// from its canonical URL, which is kept to find the link again
+func (h *Handler) assignShortURL(prefix string, u *model.URL) error {
+	if prefix != "" {
+		u.ShortURL = h.shortener.BuildShortURL(prefix)
+		u.CanonicalURL = ""
+		return nil
+	}
+	canonical, err := h.shortener.CanonicalizeURL(u.OriginalURL)
+	if err != nil {
+		return err
+	}
+	shortURL, err := h.shortener.GenerateShortURL(u.OriginalURL, 0)
+	if err != nil {
+		return err
+	}
+	u.ShortURL, u.CanonicalURL = shortURL, canonical
+	return nil
 }
@@ -1,118 +1,1742 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"url-shortener/pkg/access"
+	"url-shortener/pkg/apidocs"
+	"url-shortener/pkg/clickstream"
+	"url-shortener/pkg/geoip"
 	"url-shortener/pkg/model"
+	"url-shortener/pkg/pages"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/transfer"
+	"url-shortener/pkg/useragent"
 
+	"github.com/santhosh-tekuri/jsonschema/v6"
 	"github.com/stretchr/testify/assert"
 )
 
-const shortDomain = "http://short.com"
+const (
+	shortDomain = "http://short.com"
+	testAPIKey  = "key-0123456789abcdef"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+type MockURLRepository struct {
+	Store map[string]*model.URL
+}
+
+func (m *MockURLRepository) Save(ctx context.Context, url *model.URL) error {
+	if url.OriginalURL == "http://error.com" {
+		return errors.New("failed to save URL")
+	}
+	if existing, ok := m.Store[url.ShortURL]; ok && !existing.IsExpired(time.Now()) {
+		return repository.ErrAlreadyExists
+	}
+	m.Store[url.ShortURL] = url
+	return nil
+}
+
+func (m *MockURLRepository) SaveBatch(ctx context.Context, urls []*model.URL) []error {
+	errs := make([]error, len(urls))
+	for i, url := range urls {
+		errs[i] = m.Save(ctx, url)
+	}
+	return errs
+}
+
+func (m *MockURLRepository) Find(ctx context.Context, shortURL string) (*model.URL, error) {
+	if u, ok := m.Store[shortURL]; ok {
+		return u, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (m *MockURLRepository) FindByCanonicalURLs(ctx context.Context, canonicalURLs []string) ([]*model.URL, error) {
+	var urls []*model.URL
+	for _, u := range m.Store {
+		if u.CanonicalURL != "" && slices.Contains(canonicalURLs, u.CanonicalURL) && !u.IsExpired(time.Now()) {
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
+func (m *MockURLRepository) CountSlugs(ctx context.Context, shortURLPrefix string) (map[int]int64, error) {
+	counts := map[int]int64{}
+	for shortURL := range m.Store {
+		if slug, ok := strings.CutPrefix(shortURL, shortURLPrefix); ok {
+			counts[len(slug)]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *MockURLRepository) FindPrefix(ctx context.Context, shortURLs []string) (*model.URL, error) {
+	for _, shortURL := range shortURLs {
+		if u, ok := m.Store[shortURL]; ok && u.ForwardPath {
+			return u, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (m *MockURLRepository) ListPrefixes(ctx context.Context) ([]string, error) {
+	var shortURLs []string
+	for shortURL, u := range m.Store {
+		if u.ForwardPath {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+	return shortURLs, nil
+}
+
+func (m *MockURLRepository) List(ctx context.Context, options repository.ListOptions) ([]*model.URL, error) {
+	shortURLs := make([]string, 0, len(m.Store))
+	for shortURL := range m.Store {
+		if shortURL > options.After && (!options.Broken || m.Store[shortURL].Health != nil && m.Store[shortURL].Health.Broken) {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+	sort.Strings(shortURLs)
+	urls := []*model.URL{}
+	for _, shortURL := range shortURLs {
+		if len(urls) == options.Limit {
+			break
+		}
+		urls = append(urls, m.Store[shortURL])
+	}
+	return urls, nil
+}
+
+func (m *MockURLRepository) ForEach(ctx context.Context, fn func(url *model.URL) error) error {
+	for _, url := range m.Store {
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockURLRepository) IncrementClickCount(ctx context.Context, shortURL string, variant string) error {
+	if url, ok := m.Store[shortURL]; ok {
+		url.ClickCount += 1
+		if variant != "" {
+			if url.VariantClicks == nil {
+				url.VariantClicks = map[string]int64{}
+			}
+			url.VariantClicks[variant]++
+		}
+		m.Store[shortURL] = url
+		return nil
+	}
+	return errors.New("failed to increment click count")
+}
+
+func (m *MockURLRepository) UpdateExpiry(ctx context.Context, shortURL string, expiry *time.Time) error {
+	if url, ok := m.Store[shortURL]; ok {
+		url.Expiry = expiry
+		return nil
+	}
+	return repository.ErrNotFound
+}
+
+func (m *MockURLRepository) SaveMetadata(ctx context.Context, shortURL string, metadata *model.Metadata) error {
+	if url, ok := m.Store[shortURL]; ok {
+		url.Metadata = metadata
+		return nil
+	}
+	return repository.ErrNotFound
+}
+
+func (m *MockURLRepository) ListDueForCheck(ctx context.Context, checkedBefore time.Time, limit int) ([]*model.URL, error) {
+	return nil, nil
+}
+
+func (m *MockURLRepository) SaveHealth(ctx context.Context, shortURL string, health *model.Health) error {
+	if url, ok := m.Store[shortURL]; ok {
+		url.Health = health
+		return nil
+	}
+	return repository.ErrNotFound
+}
+
+func (m *MockURLRepository) PurgeExpired(ctx context.Context, expiredBefore time.Time, limit int) ([]*model.URL, error) {
+	return nil, nil
+}
+
+type MockIdempotencyRepository struct {
+	Responses map[string]*model.StoredResponse
+}
+
+func (m *MockIdempotencyRepository) FindResponse(ctx context.Context, key string, storedAfter time.Time) (*model.StoredResponse, error) {
+	if response, ok := m.Responses[key]; ok && response.CreatedAt.After(storedAfter) {
+		return response, nil
+	}
+	return nil, nil
+}
+
+func (m *MockIdempotencyRepository) Reserve(ctx context.Context, key, requestHash string, reservedAt, storedAfter, startedAfter time.Time) (bool, error) {
+	if response, ok := m.Responses[key]; ok {
+		if response.StatusCode != 0 && response.CreatedAt.After(storedAfter) || response.StatusCode == 0 && response.CreatedAt.After(startedAfter) {
+			return false, nil
+		}
+	}
+	m.Responses[key] = &model.StoredResponse{RequestHash: requestHash, CreatedAt: reservedAt}
+	return true, nil
+}
+
+func (m *MockIdempotencyRepository) SaveResponse(ctx context.Context, key string, response *model.StoredResponse) error {
+	m.Responses[key] = response
+	return nil
+}
+
+func (m *MockIdempotencyRepository) Release(ctx context.Context, key string) error {
+	if response, ok := m.Responses[key]; ok && response.StatusCode == 0 {
+		delete(m.Responses, key)
+	}
+	return nil
+}
+
+func (m *MockIdempotencyRepository) PurgeResponses(ctx context.Context, storedBefore time.Time, limit int) (int64, error) {
+	return 0, nil
+}
+
+// MockMetadataFetcher records the links scheduled for fetching
+type MockMetadataFetcher struct {
+	Queued map[string]string
+}
+
+func (m *MockMetadataFetcher) Enqueue(shortURL, originalURL string) bool {
+	m.Queued[shortURL] = originalURL
+	return true
+}
+
+// MockWebhookRepository keeps subscriptions and deliveries in memory
+type MockWebhookRepository struct {
+	repository.WebhookRepository
+	Subscriptions []*model.Subscription
+	Deliveries    []*model.Delivery
+}
+
+func (m *MockWebhookRepository) SaveSubscription(ctx context.Context, subscription *model.Subscription) error {
+	subscription.ID = int64(len(m.Subscriptions) + 1)
+	subscription.CreatedAt = time.Now()
+	m.Subscriptions = append(m.Subscriptions, subscription)
+	return nil
+}
+
+func (m *MockWebhookRepository) ListSubscriptions(ctx context.Context) ([]*model.Subscription, error) {
+	subscriptions := []*model.Subscription{}
+	for _, subscription := range m.Subscriptions {
+		listed := *subscription
+		listed.Secret = ""
+		subscriptions = append(subscriptions, &listed)
+	}
+	return subscriptions, nil
+}
+
+func (m *MockWebhookRepository) DeleteSubscription(ctx context.Context, id int64) error {
+	for i, subscription := range m.Subscriptions {
+		if subscription.ID == id {
+			m.Subscriptions = append(m.Subscriptions[:i], m.Subscriptions[i+1:]...)
+			return nil
+		}
+	}
+	return repository.ErrWebhookNotFound
+}
+
+func (m *MockWebhookRepository) ListDeliveries(ctx context.Context, subscriptionID int64, status string, limit int) ([]*model.Delivery, error) {
+	deliveries := []*model.Delivery{}
+	for _, d := range m.Deliveries {
+		if d.SubscriptionID == subscriptionID && (status == "" || d.Status == status) && len(deliveries) < limit {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MockWebhookRepository) Redeliver(ctx context.Context, id int64) error {
+	for _, d := range m.Deliveries {
+		if d.ID == id {
+			d.Status = model.DeliveryPending
+			return nil
+		}
+	}
+	return repository.ErrWebhookNotFound
+}
+
+// MockEmitter records emitted events and their data, or fails with Err
+type MockEmitter struct {
+	Events []string
+	Data   []any
+	Err    error
+}
+
+func (m *MockEmitter) Emit(ctx context.Context, event string, data any) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Events = append(m.Events, event)
+	m.Data = append(m.Data, data)
+	return nil
+}
+
+// MockTransactor counts the transactions rolled back
+type MockTransactor struct {
+	Rollbacks int
+}
+
+func (m *MockTransactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	err := fn(ctx)
+	if err != nil {
+		m.Rollbacks++
+	}
+	return err
+}
+
+// MockShortener is a mock implementation of Shortener
+type MockShortener struct {
+	Slugs    map[string]string // Slugs to use for specific URLs, others get "xyz"
+	Prefixes []string          // Short URLs of the registered path forwarding links
+}
+
+// GenerateShortURL appends the attempt to the slug of later attempts
+func (m *MockShortener) GenerateShortURL(url string, attempt int) (string, error) {
+	if url == "http://error.com" {
+		return "", errors.New("failed to generate short URL")
+	}
+	slug := "xyz"
+	if s, ok := m.Slugs[url]; ok {
+		slug = s
+	}
+	if attempt > 0 {
+		slug += strconv.Itoa(attempt)
+	}
+	return m.BuildShortURL(slug), nil
+}
+
+func (m *MockShortener) IsValidShortURL(url string) bool {
+	return url == shortDomain+"/redirect/xyz" || url == shortDomain+"/redirect/404" || strings.HasPrefix(url, shortDomain+"/redirect/docs")
+}
+
+func (m *MockShortener) IsValidPrefix(prefix string) bool {
+	return prefix == "docs" || prefix == "docs/internal"
+}
+
+// PrefixCandidates returns the docs prefixes of the short URL
+func (m *MockShortener) PrefixCandidates(url string) []string {
+	var candidates []string
+	for _, prefix := range []string{"docs/internal", "docs"} {
+		if strings.HasPrefix(url, m.BuildShortURL(prefix)+"/") {
+			candidates = append(candidates, m.BuildShortURL(prefix))
+		}
+	}
+	return candidates
+}
+
+func (m *MockShortener) RegisterPrefix(url string) {
+	m.Prefixes = append(m.Prefixes, url)
+}
+
+func (m *MockShortener) IsValidSlug(slug string) bool {
+	return slug == "xyz" || slug == "404"
+}
+
+func (m *MockShortener) AllowsSlug(slug string) bool {
+	return true
+}
+
+func (m *MockShortener) BuildShortURL(slug string) string {
+	return shortDomain + "/redirect/" + slug
+}
+
+func (m *MockShortener) NormalizeShortURL(url string) string {
+	return url
+}
+
+func (m *MockShortener) CanonicalizeURL(url string) (string, error) {
+	return strings.TrimSuffix(url, "/"), nil
+}
+
+func TestShortenURL_MethodNotAllowed(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/shorten", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestShortenURL_InvalidRequestBody(t *testing.T) {
+	handler := setupHandler()
+	body := bytes.NewReader([]byte("{invalid json"))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestShortenURL_InvalidInputData(t *testing.T) {
+	handler := setupHandler()
+	body := bytes.NewReader([]byte(`{"OriginalURL":"invalid url"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestShortenURL_Success(t *testing.T) {
+	handler := setupHandler()
+	url := model.URL{OriginalURL: "http://test.com"}
+	bodyBytes, _ := json.Marshal(url)
+	request := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewReader(bodyBytes))
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.NotEmpty(t, resBody.ShortURL)
+}
+
+func TestShortenURL_ExistingURL(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		Expiry:      expiresIn(24 * time.Hour),
+		ClickCount:  42,
+	})
+
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com/","ttl":"2h"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.Equal(t, int64(42), resBody.ClickCount)
+	assert.Equal(t, int64(42), mockRepo.Store[shortDomain+"/redirect/xyz"].ClickCount)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), *resBody.Expiry, time.Minute)
+}
+
+func TestShortenURL_ExpiredURLReplaced(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://old.com",
+		Expiry:      expiresIn(-24 * time.Hour),
+		ClickCount:  42,
+	})
+
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+	assert.Equal(t, "http://test.com", mockRepo.Store[shortDomain+"/redirect/xyz"].OriginalURL)
+	assert.Equal(t, int64(0), mockRepo.Store[shortDomain+"/redirect/xyz"].ClickCount)
+}
+
+func TestShortenURL_ShortURLTaken(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://other.com",
+		Expiry:      expiresIn(24 * time.Hour),
+	})
+
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	// The generated slug is re-rolled
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+	assert.Equal(t, "http://other.com", mockRepo.Store[shortDomain+"/redirect/xyz"].OriginalURL)
+	assert.Equal(t, "http://test.com", mockRepo.Store[shortDomain+"/redirect/xyz1"].OriginalURL)
+	assert.Equal(t, "http://test.com", mockRepo.Store[shortDomain+"/redirect/xyz1"].CanonicalURL)
+}
+
+func TestShortenURL_RegistersPrefix(t *testing.T) {
+	handler := setupHandler()
+	mockShortener := handler.shortener.(*MockShortener)
+
+	handler.ShortenURL(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://test.com"}`)))
+	recorder := httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://docs.com","prefix":"docs"}`)))
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+	handler.ShortenURL(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://other.com","prefix":"docs"}`)))
+
+	assert.Equal(t, []string{shortDomain + "/redirect/docs"}, mockShortener.Prefixes)
+}
+
+func TestShortenURL_PrefixTaken(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/docs",
+		OriginalURL: "http://other.com",
+		Expiry:      expiresIn(24 * time.Hour),
+	})
+
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com","prefix":"docs"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	assert.Equal(t, "http://other.com", mockRepo.Store[shortDomain+"/redirect/docs"].OriginalURL)
+	assertProblem(t, recorder, http.StatusConflict, "slug_taken")
+}
+
+func TestShortenURL_FoundByCanonicalURL(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:     shortDomain + "/redirect/xyz1",
+		OriginalURL:  "http://test.com/",
+		CanonicalURL: "http://test.com",
+		Expiry:       expiresIn(24 * time.Hour),
+	})
+
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Result().StatusCode)
+	assert.Contains(t, recorder.Body.String(), shortDomain+"/redirect/xyz1")
+	assert.NotContains(t, mockRepo.Store, shortDomain+"/redirect/xyz")
+}
+
+func TestIdempotent_ReplaysResponse(t *testing.T) {
+	handler := setupHandler()
+	calls := 0
+	next := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		handler.ShortenURL(w, r)
+	}
+	idempotent := handler.Idempotent(next)
+
+	var responses []string
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+		request.Header.Set("Idempotency-Key", "retry-1")
+		recorder := httptest.NewRecorder()
+
+		idempotent(recorder, request)
+
+		assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+		responses = append(responses, recorder.Body.String())
+	}
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, responses[0], responses[1])
+}
+
+func TestIdempotent_KeyReusedForDifferentRequest(t *testing.T) {
+	handler := setupHandler()
+	idempotent := handler.Idempotent(handler.ShortenURL)
+
+	request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+	request.Header.Set("Idempotency-Key", "retry-1")
+	idempotent(httptest.NewRecorder(), request)
+
+	request = httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://other.com"}`)))
+	request.Header.Set("Idempotency-Key", "retry-1")
+	recorder := httptest.NewRecorder()
+	idempotent(recorder, request)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Result().StatusCode)
+}
+
+func TestIdempotent_ExpiredKey(t *testing.T) {
+	handler := setupHandler()
+	mockIdempotency := handler.idempotency.(*MockIdempotencyRepository)
+	mockIdempotency.Responses["retry-1"] = &model.StoredResponse{
+		RequestHash: "stale",
+		StatusCode:  http.StatusCreated,
+		CreatedAt:   time.Now().Add(-48 * time.Hour),
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+	request.Header.Set("Idempotency-Key", "retry-1")
+	recorder := httptest.NewRecorder()
+	handler.Idempotent(handler.ShortenURL)(recorder, request)
+
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+	assert.NotEqual(t, "stale", mockIdempotency.Responses["retry-1"].RequestHash)
+}
+
+func TestIdempotent_RequestInProgress(t *testing.T) {
+	handler := setupHandler()
+	idempotent := handler.Idempotent(handler.ShortenURL)
+
+	var recorder *httptest.ResponseRecorder
+	first := handler.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		// The retry arrives while the first request is still running
+		request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+		request.Header.Set("Idempotency-Key", "retry-1")
+		recorder = httptest.NewRecorder()
+		idempotent(recorder, request)
+
+		handler.ShortenURL(w, r)
+	})
+	request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+	request.Header.Set("Idempotency-Key", "retry-1")
+	first(httptest.NewRecorder(), request)
+
+	assert.Equal(t, http.StatusConflict, recorder.Result().StatusCode)
+	assert.Contains(t, recorder.Body.String(), codeIdempotencyInProgress)
+}
+
+func TestIdempotent_ServerErrorReleasesKey(t *testing.T) {
+	handler := setupHandler()
+	mockIdempotency := handler.idempotency.(*MockIdempotencyRepository)
+	idempotent := handler.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`)))
+	request.Header.Set("Idempotency-Key", "retry-1")
+	idempotent(httptest.NewRecorder(), request)
+
+	assert.NotContains(t, mockIdempotency.Responses, "retry-1")
+}
+
+func TestBulkShortenURLs_JSONArray(t *testing.T) {
+	handler := setupHandler()
+	handler.shortener.(*MockShortener).Slugs = map[string]string{"http://a.com": "aaa", "http://b.com": "bbb"}
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://other.com",
+		Expiry:      expiresIn(24 * time.Hour),
+	})
+	body := `[
+		{"original_url":"http://a.com"},
+		{"original_url":"not a url"},
+		{"original_url":"http://b.com","ttl":"2h"},
+		{"original_url":"http://a.com"},
+		{"original_url":"http://c.com"}
+	]`
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+
+	handler.BulkShortenURLs(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var results []bulkResult
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&results))
+	assert.Len(t, results, 5)
+	for i, result := range results {
+		assert.Equal(t, i, result.Index)
+	}
+	assert.Equal(t, http.StatusCreated, results[0].Status)
+	assert.Equal(t, shortDomain+"/redirect/aaa", results[0].ShortURL)
+	assert.Equal(t, http.StatusBadRequest, results[1].Status)
+	assert.NotEmpty(t, results[1].Error)
+	assert.Equal(t, http.StatusCreated, results[2].Status)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), *results[2].Expiry, time.Minute)
+	assert.Equal(t, http.StatusOK, results[3].Status)
+	assert.Equal(t, shortDomain+"/redirect/aaa", results[3].ShortURL)
+	assert.Equal(t, http.StatusCreated, results[4].Status)
+	assert.Equal(t, shortDomain+"/redirect/xyz1", results[4].ShortURL)
+	assert.Equal(t, "http://b.com", mockRepo.Store[shortDomain+"/redirect/bbb"].OriginalURL)
+}
+
+func TestBulkShortenURLs_NDJSON(t *testing.T) {
+	handler := setupHandler()
+	handler.shortener.(*MockShortener).Slugs = map[string]string{"http://a.com": "aaa"}
+	body := "{\"original_url\":\"http://a.com\"}\n\n{invalid\n{\"original_url\":\"http://test.com\"}\n"
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	recorder := httptest.NewRecorder()
+
+	handler.BulkShortenURLs(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+	decoder := json.NewDecoder(res.Body)
+	var statuses []int
+	for decoder.More() {
+		var result bulkResult
+		assert.Nil(t, decoder.Decode(&result))
+		assert.Equal(t, len(statuses), result.Index)
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal(t, []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated}, statuses)
+}
+
+func TestBulkShortenURLs_InvalidBody(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(`{"original_url":"http://a.com"}`))
+	recorder := httptest.NewRecorder()
+
+	handler.BulkShortenURLs(recorder, request)
+
+	var results []bulkResult
+	assert.Nil(t, json.NewDecoder(recorder.Result().Body).Decode(&results))
+	assert.Len(t, results, 1)
+	assert.Equal(t, http.StatusBadRequest, results[0].Status)
+}
+
+func TestBulkShortenURLs_StreamBroken(t *testing.T) {
+	handler := setupHandler()
+	body := "{\"original_url\":\"http://a.com\"}\n\n\n{\"original_url\":\"" + strings.Repeat("a", maxNDJSONLineSz) + "\"}\n"
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	recorder := httptest.NewRecorder()
+
+	handler.BulkShortenURLs(recorder, request)
+
+	decoder := json.NewDecoder(recorder.Result().Body)
+	var results []bulkResult
+	for decoder.More() {
+		var result bulkResult
+		assert.Nil(t, decoder.Decode(&result))
+		results = append(results, result)
+	}
+	assert.Len(t, results, 2)
+	assert.Equal(t, 1, results[1].Index)
+	assert.Equal(t, http.StatusBadRequest, results[1].Status)
+
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(`[{"original_url":"http://a.com"},{"original_url":"http://b.com"},{"original_url":`))
+	recorder = httptest.NewRecorder()
+
+	handler.BulkShortenURLs(recorder, request)
+
+	results = nil
+	assert.Nil(t, json.NewDecoder(recorder.Result().Body).Decode(&results))
+	assert.Len(t, results, 3)
+	assert.Equal(t, 2, results[2].Index)
+	assert.Equal(t, http.StatusBadRequest, results[2].Status)
+}
+
+func TestIdempotent_IgnoresNDJSON(t *testing.T) {
+	handler := setupHandler()
+	idempotent := handler.Idempotent(handler.BulkShortenURLs)
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader("{\"original_url\":\"http://a.com\"}\n"))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	request.Header.Set("Idempotency-Key", "stream-1")
+
+	idempotent(httptest.NewRecorder(), request)
+
+	assert.NotContains(t, handler.idempotency.(*MockIdempotencyRepository).Responses, "stream-1")
+}
+
+func TestExportLinks(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		ClickCount:  3,
+	})
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/export?format=jsonl", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.ExportLinks(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+	var exported model.URL
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&exported))
+	assert.Equal(t, int64(3), exported.ClickCount)
+}
+
+func TestExportLinks_InvalidFormat(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/export?format=bitly", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.ExportLinks(recorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
+}
+
+func TestImportLinks(t *testing.T) {
+	handler := setupHandler()
+	body := "keyword,url,clicks\nxyz,http://test.com,5\nlonger,http://other.com,1\n"
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links/import?format=yourls", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+
+	handler.ImportLinks(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var report transfer.Report
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&report))
+	assert.Equal(t, 2, report.Imported)
+	assert.Len(t, report.Failed, 0)
+	assert.Len(t, report.Renamed, 1)
+	assert.Equal(t, int64(5), handler.repo.(*MockURLRepository).Store[shortDomain+"/redirect/xyz"].ClickCount)
+	assert.Equal(t, "http://other.com", handler.repo.(*MockURLRepository).Store[shortDomain+"/redirect/xyz1"].OriginalURL)
+}
+
+func TestQRCode(t *testing.T) {
+	testCases := []struct {
+		query       string
+		status      int
+		contentType string
+	}{
+		{"", http.StatusOK, "image/png"},
+		{"?format=svg&size=128&level=H&margin=0&fg=ff0000&bg=00000000", http.StatusOK, "image/svg+xml"},
+		{"?format=gif", http.StatusBadRequest, ""},
+		{"?size=big", http.StatusBadRequest, ""},
+		{"?size=10", http.StatusBadRequest, ""},
+		{"?level=Z", http.StatusBadRequest, ""},
+		{"?fg=red", http.StatusBadRequest, ""},
+		{"?logo=true", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			handler := setupHandler()
+			mockRepo := handler.repo.(*MockURLRepository)
+			mockRepo.Save(context.Background(), &model.URL{
+				ShortURL:    shortDomain + "/redirect/xyz",
+				OriginalURL: "http://test.com",
+			})
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/links/xyz/qr"+tc.query, nil)
+			request.SetPathValue("slug", "xyz")
+			recorder := httptest.NewRecorder()
+
+			handler.QRCode(recorder, request)
+
+			res := recorder.Result()
+			assert.Equal(t, tc.status, res.StatusCode)
+			if tc.contentType != "" {
+				assert.Equal(t, tc.contentType, res.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestQRCode_URLNotFound(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/404/qr", nil)
+	request.SetPathValue("slug", "404")
+	recorder := httptest.NewRecorder()
+
+	handler.QRCode(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Result().StatusCode)
+}
+
+func TestShortenURL_FetchesMetadata(t *testing.T) {
+	handler := setupHandler()
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com","metadata":{"title":"Forged"}}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.Nil(t, resBody.Metadata)
+	queued := handler.metadata.(*MockMetadataFetcher).Queued
+	assert.Equal(t, map[string]string{shortDomain + "/redirect/xyz": "http://test.com"}, queued)
+
+	// Existing links already have their metadata
+	recorder = httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewReader([]byte(`{"original_url":"http://test.com"}`))))
+	assert.Equal(t, http.StatusOK, recorder.Result().StatusCode)
+	assert.Len(t, queued, 1)
+}
+
+func TestGetLink(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+	})
+	mockRepo.SaveMetadata(context.Background(), shortDomain+"/redirect/xyz", &model.Metadata{Title: "Test", StatusCode: http.StatusOK})
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/xyz", nil)
+	request.SetPathValue("slug", "xyz")
+	recorder := httptest.NewRecorder()
+
+	handler.GetLink(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.Equal(t, "http://test.com", resBody.OriginalURL)
+	assert.Equal(t, "Test", resBody.Metadata.Title)
+	assert.Equal(t, http.StatusOK, resBody.Metadata.StatusCode)
+}
+
+func TestGetLink_URLNotFound(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/404", nil)
+	request.SetPathValue("slug", "404")
+	recorder := httptest.NewRecorder()
+
+	handler.GetLink(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Result().StatusCode)
+}
+
+func TestListLinks(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	for _, slug := range []string{"c", "a", "b"} {
+		mockRepo.Save(context.Background(), &model.URL{ShortURL: shortDomain + "/redirect/" + slug, OriginalURL: "http://" + slug + ".com"})
+	}
+
+	list := func(query string) (int, listResponse) {
+		recorder := httptest.NewRecorder()
+		handler.ListLinks(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/links"+query, nil))
+		var resBody listResponse
+		json.NewDecoder(recorder.Result().Body).Decode(&resBody)
+		return recorder.Result().StatusCode, resBody
+	}
+
+	status, page := list("?limit=2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, page.Links, 2)
+	assert.Equal(t, "http://a.com", page.Links[0].OriginalURL)
+	assert.Equal(t, shortDomain+"/redirect/b", page.Next)
+
+	status, page = list("?limit=2&after=" + page.Next)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, page.Links, 1)
+	assert.Equal(t, "http://c.com", page.Links[0].OriginalURL)
+	assert.Empty(t, page.Next)
+
+	status, _ = list("?limit=0")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestListLinks_Broken(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	for _, slug := range []string{"a", "b", "c"} {
+		mockRepo.Save(context.Background(), &model.URL{ShortURL: shortDomain + "/redirect/" + slug, OriginalURL: "http://" + slug + ".com"})
+	}
+	mockRepo.SaveHealth(context.Background(), shortDomain+"/redirect/b", &model.Health{StatusCode: http.StatusNotFound, Failures: 3, Broken: true})
+	mockRepo.SaveHealth(context.Background(), shortDomain+"/redirect/c", &model.Health{StatusCode: http.StatusOK})
+
+	recorder := httptest.NewRecorder()
+	handler.ListLinks(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/links?broken=true", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Result().StatusCode)
+	var resBody listResponse
+	json.NewDecoder(recorder.Result().Body).Decode(&resBody)
+	assert.Len(t, resBody.Links, 1)
+	assert.Equal(t, "http://b.com", resBody.Links[0].OriginalURL)
+	assert.True(t, resBody.Links[0].Health.Broken)
+}
+
+func TestCreateWebhook(t *testing.T) {
+	handler := setupHandler()
+	body := `{"url":"https://hooks.example.com/links","events":["link.created","link.broken"]}`
+	recorder := httptest.NewRecorder()
+
+	handler.CreateWebhook(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", strings.NewReader(body)))
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var subscription model.Subscription
+	json.NewDecoder(res.Body).Decode(&subscription)
+	assert.Equal(t, int64(1), subscription.ID)
+	assert.Equal(t, []string{"link.created", "link.broken"}, subscription.Events)
+	assert.True(t, strings.HasPrefix(subscription.Secret, "whsec_"))
+}
+
+func TestCreateWebhook_Invalid(t *testing.T) {
+	testCases := []string{
+		`{"url":"http://localhost:8080/hook"}`,
+		`{"url":"https://hooks.example.com","events":["link.renamed"]}`,
+		`{"url":`,
+	}
+	for _, body := range testCases {
+		handler := setupHandler()
+		recorder := httptest.NewRecorder()
+
+		handler.CreateWebhook(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", strings.NewReader(body)))
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode, body)
+	}
+}
+
+func TestListDeliveries(t *testing.T) {
+	handler := setupHandler()
+	mockWebhooks := handler.webhooks.(*MockWebhookRepository)
+	mockWebhooks.Deliveries = []*model.Delivery{
+		{ID: 1, SubscriptionID: 1, Event: "link.created", Status: model.DeliveryDelivered},
+		{ID: 2, SubscriptionID: 1, Event: "link.created", Status: model.DeliveryDead, LastError: "receiver responded 500"},
+		{ID: 3, SubscriptionID: 2, Event: "link.created", Status: model.DeliveryDead},
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/1/deliveries?status=dead", nil)
+	request.SetPathValue("id", "1")
+	recorder := httptest.NewRecorder()
+
+	handler.ListDeliveries(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Result().StatusCode)
+	var deliveries []model.Delivery
+	json.NewDecoder(recorder.Result().Body).Decode(&deliveries)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, "receiver responded 500", deliveries[0].LastError)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/1/deliveries?status=lost", nil)
+	request.SetPathValue("id", "1")
+	recorder = httptest.NewRecorder()
+	handler.ListDeliveries(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
+}
+
+func TestRedeliver(t *testing.T) {
+	handler := setupHandler()
+	mockWebhooks := handler.webhooks.(*MockWebhookRepository)
+	mockWebhooks.Deliveries = []*model.Delivery{{ID: 1, SubscriptionID: 1, Status: model.DeliveryDead}}
+
+	for _, tc := range []struct {
+		id     string
+		status int
+	}{{"1", http.StatusAccepted}, {"2", http.StatusNotFound}, {"x", http.StatusBadRequest}} {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/deliveries/"+tc.id+"/redeliver", nil)
+		request.SetPathValue("id", tc.id)
+		recorder := httptest.NewRecorder()
+
+		handler.Redeliver(recorder, request)
+
+		assert.Equal(t, tc.status, recorder.Result().StatusCode, tc.id)
+	}
+	assert.Equal(t, model.DeliveryPending, mockWebhooks.Deliveries[0].Status)
+}
+
+func TestLinkEvents(t *testing.T) {
+	handler := setupHandler()
+	events := handler.events.(*MockEmitter)
+
+	handler.ShortenURL(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://test.com"}`)))
+	handler.ShortenURL(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://test.com"}`)))
+
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/xyz/expiry", strings.NewReader(`{"ttl":"2h"}`))
+	request.SetPathValue("slug", "xyz")
+	handler.UpdateExpiry(httptest.NewRecorder(), request)
+
+	handler.Redirect(httptest.NewRecorder(), RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+
+	assert.Equal(t, []string{"link.created", "link.updated", "link.clicked"}, events.Events)
+}
+
+func TestLinkEvents_PrivateLinksRedacted(t *testing.T) {
+	handler := setupHandler()
+	signer, err := access.New(access.Config{Secrets: []string{"0123456789abcdef"}, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour})
+	assert.Nil(t, err)
+	handler.access = signer
+	events := handler.events.(*MockEmitter)
+
+	body := `{"original_url":"https://files.example.com/private","prefix":"docs","require_signature":true}`
+	handler.ShortenURL(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/docs/expiry", strings.NewReader(`{"ttl":"2h"}`))
+	request.SetPathValue("slug", "docs")
+	handler.UpdateExpiry(httptest.NewRecorder(), request)
+
+	assert.Equal(t, []string{"link.created", "link.updated"}, events.Events)
+	for _, data := range events.Data {
+		link := data.(*model.URL)
+		assert.True(t, link.RequireSignature)
+		assert.Empty(t, link.OriginalURL)
+	}
+}
+
+func TestLinkEvents_EmitFailureRollsBack(t *testing.T) {
+	handler := setupHandler()
+	transactor := &MockTransactor{}
+	handler.transactor = transactor
+	handler.events = &MockEmitter{Err: errors.New("connection lost")}
+
+	recorder := httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://test.com"}`)))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Result().StatusCode)
+
+	recorder = httptest.NewRecorder()
+	handler.BulkShortenURLs(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/links/bulk", strings.NewReader(`[{"original_url":"http://other.com"}]`)))
+	var results []bulkResult
+	json.NewDecoder(recorder.Body).Decode(&results)
+	assert.Equal(t, http.StatusInternalServerError, results[0].Status)
+
+	assert.Equal(t, 2, transactor.Rollbacks)
+}
+
+// readEvent reads the next SSE block, skipping keepalive comments
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(event) > 0 {
+			return event
+		}
+		if field, value, ok := strings.Cut(line, ": "); ok && field != "" {
+			event[field] = value
+		}
+	}
+}
+
+func TestClickStream(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{ShortURL: shortDomain + "/redirect/xyz", OriginalURL: "http://test.com"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/links/{slug}/events", handler.ClickStream)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/links/xyz/events")
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+
+	// A keepalive comment shows the stream is up before clicking
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, ": keepalive\n", line)
+
+	handler.Redirect(httptest.NewRecorder(), RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+	event := readEvent(t, reader)
+	assert.Equal(t, "click", event["event"])
+	var click model.Click
+	json.Unmarshal([]byte(event["data"]), &click)
+	assert.Equal(t, "http://test.com", click.Destination)
+
+	// Reconnecting with Last-Event-ID replays the clicks missed in between
+	res.Body.Close()
+	handler.Redirect(httptest.NewRecorder(), RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+	handler.Redirect(httptest.NewRecorder(), RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/links/xyz/events", nil)
+	request.Header.Set("Last-Event-ID", event["id"])
+	res, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	reader = bufio.NewReader(res.Body)
+	id, _ := strconv.ParseInt(event["id"], 10, 64)
+	assert.Equal(t, strconv.FormatInt(id+1, 10), readEvent(t, reader)["id"])
+	assert.Equal(t, strconv.FormatInt(id+2, 10), readEvent(t, reader)["id"])
+}
+
+func TestClickStream_URLNotFound(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/404/events", nil)
+	request.SetPathValue("slug", "404")
+	recorder := httptest.NewRecorder()
+
+	handler.ClickStream(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Result().StatusCode)
+}
+
+func TestRedirect_CountryDestination(t *testing.T) {
+	handler := setupHandler()
+	resolver, err := geoip.Open("../geoip/testdata/country.mmdb", []string{"10.0.0.0/8"})
+	assert.Nil(t, err)
+	defer resolver.Close()
+	handler.geo = resolver
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://store.com",
+		CountryURLs: map[string]string{"DE": "http://store.com/de", "GB": "http://store.co.uk"},
+	})
+	sub, _ := handler.clicks.Subscribe(shortDomain+"/redirect/xyz", 0)
+	defer handler.clicks.Unsubscribe(sub)
+
+	testCases := []struct {
+		remoteAddr  string
+		forwarded   string
+		destination string
+		country     string
+	}{
+		{"89.160.20.115:4000", "", "http://store.com/de", "DE"},
+		{"10.0.0.1:4000", "81.2.69.142", "http://store.co.uk", "GB"},
+		{"216.160.83.60:4000", "89.160.20.115", "http://store.com", "US"},
+		{"1.1.1.1:4000", "", "http://store.com", ""},
+	}
+	for _, tc := range testCases {
+		request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+		request.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			request.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		recorder := httptest.NewRecorder()
+
+		handler.Redirect(recorder, request)
+
+		assert.Equal(t, tc.destination, recorder.Result().Header.Get("Location"), tc.remoteAddr)
+		event := <-sub.Events
+		assert.Equal(t, tc.country, event.Click.Country)
+		assert.Equal(t, tc.destination, event.Click.Destination)
+	}
+}
+
+func TestShortenURL_InvalidCountryURLs(t *testing.T) {
+	testCases := []string{
+		`{"original_url":"http://store.com","country_urls":{"Germany":"http://store.com/de"}}`,
+		`{"original_url":"http://store.com","country_urls":{"de":"ftp://store.com/de"}}`,
+	}
+	for _, body := range testCases {
+		handler := setupHandler()
+		recorder := httptest.NewRecorder()
+
+		handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode, body)
+	}
+
+	handler := setupHandler()
+	recorder := httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"http://store.com","country_urls":{"de":"http://store.com/de"}}`)))
+	var resBody model.URL
+	json.NewDecoder(recorder.Result().Body).Decode(&resBody)
+	assert.Equal(t, map[string]string{"DE": "http://store.com/de"}, resBody.CountryURLs)
+}
+
+func TestRedirect_DeviceRules(t *testing.T) {
+	handler := setupHandler()
+	handler.deepLinkSchemes = model.DeepLinkSchemes{"myapp": true}
+	body := `{"original_url":"http://app.com","country_urls":{"DE":"http://app.com/de"},"device_rules":[
+		{"os":"ios","device":"tablet","url":"myapp://open?screen=home"},
+		{"os":"iOS","url":"https://apps.apple.com/app/id123"},
+		{"os":"android","url":"https://play.google.com/store/apps/details?id=com.app"}
+	]}`
+	recorder := httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+
+	testCases := []struct {
+		userAgent   string
+		destination string
+	}{
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) Mobile/15E148", "myapp://open?screen=home"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) Mobile/15E148", "https://apps.apple.com/app/id123"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36", "https://play.google.com/store/apps/details?id=com.app"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/119.0.0.0", "http://app.com"},
+	}
+	for _, tc := range testCases {
+		request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+		request.Header.Set("User-Agent", tc.userAgent)
+		recorder := httptest.NewRecorder()
+
+		handler.Redirect(recorder, request)
+
+		assert.Equal(t, http.StatusFound, recorder.Result().StatusCode)
+		assert.Equal(t, tc.destination, recorder.Result().Header.Get("Location"), tc.userAgent)
+	}
+}
+
+func TestShortenURL_InvalidDeviceRules(t *testing.T) {
+	schemes, err := model.ParseDeepLinkSchemes([]string{"myapp://"})
+	assert.Nil(t, err)
+	assert.Equal(t, model.DeepLinkSchemes{"myapp": true}, schemes)
+	testCases := []string{
+		`{"original_url":"http://app.com","device_rules":[{"os":"ios","url":"otherapp://open"}]}`,
+		`{"original_url":"http://app.com","device_rules":[{"os":"ios","url":"javascript:alert(1)"}]}`,
+		`{"original_url":"http://app.com","device_rules":[{"os":"symbian","url":"http://app.com/symbian"}]}`,
+		`{"original_url":"http://app.com","device_rules":[{"device":"watch","url":"http://app.com/watch"}]}`,
+		`{"original_url":"myapp://open"}`,
+	}
+	for _, body := range testCases {
+		handler := setupHandler()
+		handler.deepLinkSchemes = schemes
+		recorder := httptest.NewRecorder()
+
+		handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode, body)
+	}
+
+	_, err = model.ParseDeepLinkSchemes([]string{"javascript"})
+	assert.NotNil(t, err)
+}
+
+func TestRedirect_Variants(t *testing.T) {
+	handler := setupHandler()
+	body := `{"original_url":"http://landing.com","variants":[
+		{"name":"control","url":"http://landing.com/a","weight":3},
+		{"url":"http://landing.com/b"}
+	]}`
+	recorder := httptest.NewRecorder()
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+
+	destinations := map[string]int{}
+	for i := 0; i < 400; i++ {
+		recorder := httptest.NewRecorder()
+		handler.Redirect(recorder, RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+		assert.Empty(t, recorder.Result().Cookies())
+		destinations[recorder.Result().Header.Get("Location")]++
+	}
+	assert.Len(t, destinations, 2)
+	assert.Greater(t, destinations["http://landing.com/a"], destinations["http://landing.com/b"])
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/xyz/stats", nil)
+	request.SetPathValue("slug", "xyz")
+	recorder = httptest.NewRecorder()
+	handler.GetLinkStats(recorder, request)
+	var stats statsResponse
+	json.NewDecoder(recorder.Result().Body).Decode(&stats)
+	assert.Equal(t, int64(400), stats.Clicks)
+	assert.Equal(t, "control", stats.Variants[0].Name)
+	assert.Equal(t, "b", stats.Variants[1].Name)
+	assert.Equal(t, 1, stats.Variants[1].Weight)
+	assert.Equal(t, int64(destinations["http://landing.com/a"]), stats.Variants[0].Clicks)
+	assert.Equal(t, int64(destinations["http://landing.com/b"]), stats.Variants[1].Clicks)
+}
+
+func TestRedirect_StickyVariants(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:       shortDomain + "/redirect/xyz",
+		OriginalURL:    "http://landing.com",
+		CountryURLs:    map[string]string{"DE": "http://landing.com/de"},
+		Variants:       []model.Variant{{Name: "a", URL: "http://landing.com/a", Weight: 1}, {Name: "b", URL: "http://landing.com/b", Weight: 1}},
+		StickyVariants: true,
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.Redirect(recorder, RedirectRequest(http.MethodGet, "/redirect/xyz", nil))
+	cookies := recorder.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "/redirect/xyz", cookies[0].Path)
+	assert.True(t, cookies[0].HttpOnly)
+	destination := recorder.Result().Header.Get("Location")
+	assert.Equal(t, "http://landing.com/"+cookies[0].Value, destination)
+
+	for i := 0; i < 20; i++ {
+		request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+		request.AddCookie(cookies[0])
+		recorder := httptest.NewRecorder()
+		handler.Redirect(recorder, request)
+		assert.Equal(t, destination, recorder.Result().Header.Get("Location"))
+		assert.Empty(t, recorder.Result().Cookies())
+	}
+
+	// A cookie naming a variant that no longer exists is replaced
+	request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+	request.AddCookie(&http.Cookie{Name: variantCookie, Value: "removed"})
+	recorder = httptest.NewRecorder()
+	handler.Redirect(recorder, request)
+	assert.Len(t, recorder.Result().Cookies(), 1)
+	assert.NotEqual(t, "removed", recorder.Result().Cookies()[0].Value)
+	assert.Equal(t, int64(22), mockRepo.Store[shortDomain+"/redirect/xyz"].VariantClicks["a"]+mockRepo.Store[shortDomain+"/redirect/xyz"].VariantClicks["b"])
+}
+
+func TestRedirect_Query(t *testing.T) {
+	testCases := []struct {
+		link        model.URL
+		target      string
+		destination string
+	}{
+		{
+			model.URL{OriginalURL: "http://shop.com/p?id=1#reviews", UTM: &model.UTM{Source: "twitter", Campaign: "launch"}},
+			"/redirect/xyz?utm_source=ignored",
+			"http://shop.com/p?id=1&utm_campaign=launch&utm_source=twitter#reviews",
+		},
+		{
+			model.URL{OriginalURL: "http://shop.com/p?utm_source=site", UTM: &model.UTM{Source: "twitter", Medium: "social"}},
+			"/redirect/xyz",
+			"http://shop.com/p?utm_source=site&utm_medium=social",
+		},
+		{
+			model.URL{OriginalURL: "http://shop.com/p?id=1&q=a%20b", UTM: &model.UTM{Source: "twitter"}, ForwardQuery: true},
+			"/redirect/xyz?id=2&utm_source=newsletter",
+			"http://shop.com/p?q=a%20b&id=2&utm_source=newsletter",
+		},
+		{
+			model.URL{OriginalURL: "http://shop.com/p?id=1"},
+			"/redirect/xyz?id=2",
+			"http://shop.com/p?id=1",
+		},
+	}
+	for _, tc := range testCases {
+		handler := setupHandler()
+		link := tc.link
+		link.ShortURL = shortDomain + "/redirect/xyz"
+		handler.repo.Save(context.Background(), &link)
+		recorder := httptest.NewRecorder()
+
+		handler.Redirect(recorder, RedirectRequest(http.MethodGet, tc.target, nil))
+
+		assert.Equal(t, http.StatusFound, recorder.Result().StatusCode)
+		assert.Equal(t, tc.destination, recorder.Result().Header.Get("Location"), tc.target)
+	}
+}
+
+func TestRedirect_PathForwarding(t *testing.T) {
+	handler := setupHandler()
+	for _, body := range []string{
+		`{"original_url":"https://docs.example.com/v1?lang=en","prefix":"docs","forward_query":true}`,
+		`{"original_url":"https://internal.example.com","prefix":"docs/internal"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+		assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode, body)
+	}
+	mockRepo := handler.repo.(*MockURLRepository)
+	assert.True(t, mockRepo.Store[shortDomain+"/redirect/docs"].ForwardPath)
+
+	testCases := []struct {
+		target      string
+		status      int
+		destination string
+	}{
+		{"/redirect/docs", http.StatusFound, "https://docs.example.com/v1?lang=en"},
+		{"/redirect/docs/api/v2", http.StatusFound, "https://docs.example.com/v1/api/v2?lang=en"},
+		{"/redirect/docs/api/v2?lang=fr&page=2", http.StatusFound, "https://docs.example.com/v1/api/v2?lang=fr&page=2"},
+		{"/redirect/docs/caf%C3%A9/a%20b", http.StatusFound, "https://docs.example.com/v1/caf%C3%A9/a%20b?lang=en"},
+		{"/redirect/docs/internal/runbooks/", http.StatusFound, "https://internal.example.com/runbooks/"},
+		{"/redirect/docs/internalx", http.StatusFound, "https://docs.example.com/v1/internalx?lang=en"},
+		{"/redirect/docs/%2e%2e/admin", http.StatusBadRequest, ""},
+		{"/redirect/docs/%252e%252e/admin", http.StatusBadRequest, ""},
+		{"/redirect/docs/api/..%2f..%2fadmin", http.StatusBadRequest, ""},
+		{"/redirect/docs/a%2Fb", http.StatusBadRequest, ""},
+	}
+	for _, tc := range testCases {
+		recorder := httptest.NewRecorder()
+
+		handler.Redirect(recorder, RedirectRequest(http.MethodGet, tc.target, nil))
+
+		assert.Equal(t, tc.status, recorder.Result().StatusCode, tc.target)
+		assert.Equal(t, tc.destination, recorder.Result().Header.Get("Location"), tc.target)
+	}
+	assert.Equal(t, int64(5), mockRepo.Store[shortDomain+"/redirect/docs"].ClickCount)
+}
+
+func TestSignedAccess(t *testing.T) {
+	handler := setupHandler()
+	signer, err := access.New(access.Config{Secrets: []string{"0123456789abcdef"}, ClockSkew: 30 * time.Second, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour})
+	assert.Nil(t, err)
+	handler.access = signer
+	redirect := handler.SignedAccess(handler.Redirect)
+
+	recorder := httptest.NewRecorder()
+	body := `{"original_url":"https://files.example.com/private","prefix":"docs","forward_query":true,"require_signature":true}`
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+
+	mint := func(body string) (int, accessResponse) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/links/docs/access", strings.NewReader(body))
+		request.SetPathValue("slug", "docs")
+		request.Header.Set("Authorization", "Bearer "+testAPIKey)
+		handler.RequireAPIKey(handler.CreateAccessURL)(recorder, request)
+		var response accessResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Result().StatusCode, response
+	}
+	visit := func(target string) *http.Response {
+		recorder := httptest.NewRecorder()
+		redirect(recorder, RedirectRequest(http.MethodGet, strings.TrimPrefix(target, shortDomain), nil))
+		return recorder.Result()
+	}
+
+	assert.Equal(t, http.StatusForbidden, visit("/redirect/docs").StatusCode)
+
+	status, link := mint(`{"ttl":"15m"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), link.ExpiresAt, 2*time.Second)
+	response := visit(link.URL + "&page=2")
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "https://files.example.com/private?page=2", response.Header.Get("Location"))
+	assert.Equal(t, http.StatusForbidden, visit(strings.Replace(link.URL, "sig=", "sig=x", 1)).StatusCode)
+	assert.Equal(t, http.StatusForbidden, visit(strings.Replace(link.URL, "/docs?", "/docs/report.pdf?", 1)).StatusCode)
+
+	status, link = mint(`{"path":"report.pdf"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	response = visit(link.URL)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "https://files.example.com/private/report.pdf", response.Header.Get("Location"))
+
+	expired := signer.Sign(shortDomain+"/redirect/docs", time.Now().Add(-time.Minute))
+	response = visit("/redirect/docs?" + expired.Encode())
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	message, _ := io.ReadAll(response.Body)
+	assert.Contains(t, string(message), "expired")
+
+	status, _ = mint(`{"ttl":"720h"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = mint(`{"path":"../admin"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestPrivateLinks(t *testing.T) {
+	handler := setupHandler()
+	signer, err := access.New(access.Config{Secrets: []string{"0123456789abcdef"}, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour})
+	assert.Nil(t, err)
+	handler.access = signer
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Store[shortDomain+"/redirect/docs"] = &model.URL{
+		ShortURL:         shortDomain + "/redirect/docs",
+		OriginalURL:      "https://files.example.com/private",
+		Variants:         []model.Variant{{Name: "a", URL: "https://files.example.com/a", Weight: 1}},
+		CountryURLs:      map[string]string{"FR": "https://files.example.com/fr"},
+		Metadata:         &model.Metadata{Title: "Private report"},
+		Health:           &model.Health{URL: "https://files.example.com/fr", Redirects: []string{"https://files.example.com/moved"}},
+		RequireSignature: true,
+	}
+
+	mux := http.NewServeMux()
+	handler.Routes(mux, "/redirect/")
+	serve := func(method, target string, key string) string {
+		request := RedirectRequest(method, target, nil)
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), 20*time.Millisecond)
+		defer cancel()
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request.WithContext(ctx))
+		return fmt.Sprintf("%d %s", recorder.Code, recorder.Body.String())
+	}
 
-var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	// Anonymous callers can't mint access URLs, a wrong key is no better
+	assert.True(t, strings.HasPrefix(serve(http.MethodPost, "/api/v1/links/docs/access", ""), "401 "))
+	assert.True(t, strings.HasPrefix(serve(http.MethodPost, "/api/v1/links/docs/access", "key-wrong"), "401 "))
+	assert.True(t, strings.HasPrefix(serve(http.MethodPost, "/api/v1/links/docs/access", testAPIKey), "201 "))
 
-type MockURLRepository struct {
-	Store map[string]*model.URL
+	// Nor can they read where the link goes
+	sub, _ := handler.clicks.Subscribe(shortDomain+"/redirect/docs", 0)
+	handler.clicks.Publish(model.Click{ShortURL: shortDomain + "/redirect/docs", Destination: "https://files.example.com/private", Time: time.Now()})
+	handler.clicks.Unsubscribe(sub)
+	for _, target := range []string{
+		"/api/v1/links/docs",
+		"/api/v1/links",
+		"/api/v1/links/export?format=csv",
+		"/api/v1/links/export?format=jsonl",
+		"/api/v1/links/docs/stats",
+		"/api/v1/links/docs/events?last_event_id=1",
+	} {
+		response := serve(http.MethodGet, target, "")
+		assert.True(t, strings.HasPrefix(response, "200 "), target)
+		assert.NotContains(t, response, "files.example.com", target)
+		assert.NotContains(t, response, "Private report", target)
+		assert.Contains(t, serve(http.MethodGet, target, testAPIKey), "files.example.com", target)
+	}
+	assert.Equal(t, "https://files.example.com/private", mockRepo.Store[shortDomain+"/redirect/docs"].OriginalURL)
 }
 
-func (m *MockURLRepository) Save(ctx context.Context, url *model.URL) error {
-	if url.OriginalURL == "http://error.com" {
-		return errors.New("failed to save URL")
-	}
-	m.Store[url.ShortURL] = url
-	return nil
+func TestShortenURL_RequireSignatureDisabled(t *testing.T) {
+	handler := setupHandler()
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"https://files.example.com","require_signature":true}`)))
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
 }
 
-func (m *MockURLRepository) Find(ctx context.Context, shortURL string) (*model.URL, error) {
-	if u, ok := m.Store[shortURL]; ok {
-		return u, nil
-	}
-	return nil, errors.New("URL not found")
+func TestShortenURL_InvalidPrefix(t *testing.T) {
+	handler := setupHandler()
+	recorder := httptest.NewRecorder()
+
+	handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(`{"original_url":"https://docs.example.com","prefix":"../docs"}`)))
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
 }
 
-func (m *MockURLRepository) IncrementClickCount(ctx context.Context, shortURL string) error {
-	if url, ok := m.Store[shortURL]; ok {
-		url.ClickCount += 1
-		m.Store[shortURL] = url
-		return nil
+func TestShortenURL_InvalidVariants(t *testing.T) {
+	testCases := []string{
+		`{"original_url":"http://landing.com","variants":[{"name":"a b","url":"http://landing.com/a"}]}`,
+		`{"original_url":"http://landing.com","variants":[{"name":"a","url":"http://landing.com/a"},{"name":"a","url":"http://landing.com/b"}]}`,
+		`{"original_url":"http://landing.com","variants":[{"url":"http://landing.com/a","weight":-1}]}`,
+		`{"original_url":"http://landing.com","variants":[{"url":"ftp://landing.com/a"}]}`,
 	}
-	return errors.New("failed to increment click count")
-}
+	for _, body := range testCases {
+		handler := setupHandler()
+		recorder := httptest.NewRecorder()
 
-// MockShortener is a mock implementation of Shortener
-type MockShortener struct{}
+		handler.ShortenURL(recorder, httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(body)))
 
-func (m *MockShortener) GenerateShortURL(url string) (string, error) {
-	if url == "http://error.com" {
-		return "", errors.New("failed to generate short URL")
+		assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode, body)
 	}
-	return shortDomain + "/redirect/xyz", nil
 }
 
-func (m *MockShortener) IsValidShortURL(url string) bool {
-	return url == shortDomain+"/redirect/xyz" || url == shortDomain+"/redirect/404"
-}
-
-func TestShortenURL_MethodNotAllowed(t *testing.T) {
+func TestShortenURL_TTL(t *testing.T) {
 	handler := setupHandler()
-	request := httptest.NewRequest(http.MethodGet, "/shorten", nil)
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com","ttl":"2h"}`))
+	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
 	recorder := httptest.NewRecorder()
 
 	handler.ShortenURL(recorder, request)
 
 	res := recorder.Result()
-	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), *resBody.Expiry, time.Minute)
 }
 
-func TestShortenURL_InvalidRequestBody(t *testing.T) {
+func TestShortenURL_ExpiresAt(t *testing.T) {
 	handler := setupHandler()
-	body := bytes.NewReader([]byte("{invalid json"))
+	expiresAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com","expires_at":"` + expiresAt.Format(time.RFC3339) + `"}`))
 	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
 	recorder := httptest.NewRecorder()
 
 	handler.ShortenURL(recorder, request)
 
 	res := recorder.Result()
-	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var resBody model.URL
+	json.NewDecoder(res.Body).Decode(&resBody)
+	assert.True(t, expiresAt.Equal(*resBody.Expiry))
 }
 
-func TestShortenURL_InvalidInputData(t *testing.T) {
+func TestShortenURL_NeverExpires(t *testing.T) {
 	handler := setupHandler()
-	body := bytes.NewReader([]byte(`{"OriginalURL":"invalid url"}`))
+	body := bytes.NewReader([]byte(`{"original_url":"http://test.com","expires":false}`))
 	request := httptest.NewRequest(http.MethodPost, "/shorten", body)
 	recorder := httptest.NewRecorder()
 
 	handler.ShortenURL(recorder, request)
 
 	res := recorder.Result()
-	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	mockRepo := handler.repo.(*MockURLRepository)
+	assert.Nil(t, mockRepo.Store[shortDomain+"/redirect/xyz"].Expiry)
 }
 
-func TestShortenURL_Success(t *testing.T) {
+func TestShortenURL_InvalidExpiry(t *testing.T) {
+	testCases := []struct {
+		name string
+		body string
+	}{
+		{"below min TTL", `{"original_url":"http://test.com","ttl":"30s"}`},
+		{"above max TTL", `{"original_url":"http://test.com","ttl":"9000h"}`},
+		{"in the past", `{"original_url":"http://test.com","expires_at":"2001-01-01T00:00:00Z"}`},
+		{"invalid TTL", `{"original_url":"http://test.com","ttl":"forever"}`},
+		{"permanent above max TTL", `{"original_url":"http://test.com","expires":false}`},
+		{"conflicting options", `{"original_url":"http://test.com","ttl":"2h","expires":false}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := setupHandler()
+			handler.maxTTL = 365 * 24 * time.Hour
+			request := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewReader([]byte(tc.body)))
+			recorder := httptest.NewRecorder()
+
+			handler.ShortenURL(recorder, request)
+
+			assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
+		})
+	}
+}
+
+func TestUpdateExpiry_Success(t *testing.T) {
 	handler := setupHandler()
-	url := model.URL{OriginalURL: "http://test.com"}
-	bodyBytes, _ := json.Marshal(url)
-	request := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewReader(bodyBytes))
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		Expiry:      expiresIn(-time.Hour),
+	})
+
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/xyz/expiry", bytes.NewReader([]byte(`{"ttl":"24h"}`)))
+	request.SetPathValue("slug", "xyz")
 	recorder := httptest.NewRecorder()
 
-	handler.ShortenURL(recorder, request)
+	handler.UpdateExpiry(recorder, request)
 
 	res := recorder.Result()
-	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, mockRepo.Store[shortDomain+"/redirect/xyz"].IsExpired(time.Now()))
+}
 
-	var resBody model.URL
-	json.NewDecoder(res.Body).Decode(&resBody)
-	assert.NotEmpty(t, resBody.ShortURL)
+func TestUpdateExpiry_NeverExpires(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		Expiry:      expiresIn(time.Hour),
+	})
+
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/xyz/expiry", bytes.NewReader([]byte(`{"expires":false}`)))
+	request.SetPathValue("slug", "xyz")
+	recorder := httptest.NewRecorder()
+
+	handler.UpdateExpiry(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Result().StatusCode)
+	assert.Nil(t, mockRepo.Store[shortDomain+"/redirect/xyz"].Expiry)
+}
+
+func TestUpdateExpiry_EmptyBody(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/xyz/expiry", bytes.NewReader([]byte(`{}`)))
+	request.SetPathValue("slug", "xyz")
+	recorder := httptest.NewRecorder()
+
+	handler.UpdateExpiry(recorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Result().StatusCode)
+}
+
+func TestUpdateExpiry_URLNotFound(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodPatch, "/api/v1/links/404/expiry", bytes.NewReader([]byte(`{"ttl":"24h"}`)))
+	request.SetPathValue("slug", "404")
+	recorder := httptest.NewRecorder()
+
+	handler.UpdateExpiry(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Result().StatusCode)
 }
 
 func TestRedirect_InvalidShortURL(t *testing.T) {
@@ -135,6 +1759,7 @@ func TestRedirect_URLNotFound(t *testing.T) {
 
 	res := recorder.Result()
 	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assertProblem(t, recorder, http.StatusNotFound, "not_found")
 }
 
 func TestRedirect_ExpiredURL(t *testing.T) {
@@ -143,7 +1768,7 @@ func TestRedirect_ExpiredURL(t *testing.T) {
 	mockRepo.Save(context.Background(), &model.URL{
 		ShortURL:    shortDomain + "/redirect/xyz",
 		OriginalURL: "http://test.com",
-		Expiry:      time.Now().Add(-24 * time.Hour),
+		Expiry:      expiresIn(-24 * time.Hour),
 	})
 
 	request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
@@ -161,7 +1786,48 @@ func TestRedirect_Success(t *testing.T) {
 	mockRepo.Save(context.Background(), &model.URL{
 		ShortURL:    shortDomain + "/redirect/xyz",
 		OriginalURL: "http://test.com",
-		Expiry:      time.Now().Add(24 * time.Hour),
+		Expiry:      expiresIn(24 * time.Hour),
+	})
+
+	request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+}
+
+func TestRedirect_ExpiredURLLinkFallback(t *testing.T) {
+	handler := setupHandler()
+	handler.fallback = Fallback{ExpiredURL: "http://default.com/expired"}
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:           shortDomain + "/redirect/xyz",
+		OriginalURL:        "http://test.com",
+		Expiry:             expiresIn(-24 * time.Hour),
+		ExpiredRedirectURL: "http://test.com/expired",
+	})
+
+	request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "http://test.com/expired", res.Header.Get("Location"))
+}
+
+func TestRedirect_ExpiredURLDomainFallback(t *testing.T) {
+	handler := setupHandler()
+	handler.fallback = Fallback{ExpiredURL: "http://default.com/expired"}
+	handler.fallbacks = map[string]Fallback{shortDomain: {ExpiredURL: "http://short.com/expired"}}
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		Expiry:      expiresIn(-24 * time.Hour),
 	})
 
 	request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
@@ -171,6 +1837,206 @@ func TestRedirect_Success(t *testing.T) {
 
 	res := recorder.Result()
 	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "http://short.com/expired", res.Header.Get("Location"))
+}
+
+func TestRedirect_URLNotFoundFallback(t *testing.T) {
+	handler := setupHandler()
+	handler.fallback = Fallback{NotFoundURL: "http://default.com/404"}
+	handler.fallbacks = map[string]Fallback{"other.com": {NotFoundURL: "http://other.com/404"}}
+	request := RedirectRequest(http.MethodGet, "/redirect/404", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "http://default.com/404", res.Header.Get("Location"))
+}
+
+func TestRedirect_URLNotFoundErrorPage(t *testing.T) {
+	handler := setupHandler()
+	renderer, err := pages.New("")
+	assert.Nil(t, err)
+	handler.pages = renderer
+	request := RedirectRequest(http.MethodGet, "/redirect/404", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+}
+
+func TestRedirect_InvalidShortURLErrorPage(t *testing.T) {
+	handler := setupHandler()
+	renderer, err := pages.New("")
+	assert.Nil(t, err)
+	handler.pages = renderer
+	request := RedirectRequest(http.MethodGet, "/redirect", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "Bad Request")
+}
+
+func TestProblem_InternalErrorHidden(t *testing.T) {
+	handler := setupHandler()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.fail(recorder, request, errors.New("connection refused"))
+
+	problem := assertProblem(t, recorder, http.StatusInternalServerError, "internal_error")
+	assert.Equal(t, "Internal server error", problem.Detail)
+	assert.Equal(t, "/api/v1/links", problem.Instance)
+}
+
+// assertProblem checks that the response is a problem with the given status and code, and returns it
+func assertProblem(t *testing.T, recorder *httptest.ResponseRecorder, status int, code string) problem {
+	t.Helper()
+	assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"))
+	var body problem
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, "about:blank", body.Type)
+	assert.Equal(t, http.StatusText(status), body.Title)
+	assert.Equal(t, status, body.Status)
+	assert.Equal(t, code, body.Code)
+	return body
+}
+
+func TestRedirect_Preview(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+		accept string
+	}{
+		{"plus suffix", "/redirect/xyz+", ""},
+		{"accept JSON", "/redirect/xyz", "application/json"},
+		{"plus suffix accepting JSON", "/redirect/xyz+", "application/json, text/plain;q=0.5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := setupHandler()
+			mockRepo := handler.repo.(*MockURLRepository)
+			mockRepo.Save(context.Background(), &model.URL{
+				ShortURL:    shortDomain + "/redirect/xyz",
+				OriginalURL: "http://test.com",
+				ClickCount:  3,
+				CreatedAt:   time.Now(),
+			})
+			request := RedirectRequest(http.MethodGet, tc.target, nil)
+			request.Header.Set("Accept", tc.accept)
+			recorder := httptest.NewRecorder()
+
+			handler.Redirect(recorder, request)
+
+			res := recorder.Result()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			var preview model.URL
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(&preview))
+			assert.Equal(t, "http://test.com", preview.OriginalURL)
+			assert.Equal(t, int64(3), preview.ClickCount)
+			assert.Equal(t, int64(3), mockRepo.Store[shortDomain+"/redirect/xyz"].ClickCount)
+		})
+	}
+}
+
+func TestRedirect_PreviewPage(t *testing.T) {
+	handler := setupHandler()
+	renderer, err := pages.New("")
+	assert.Nil(t, err)
+	handler.pages = renderer
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com/landing",
+		CreatedAt:   time.Now(),
+	})
+	request := RedirectRequest(http.MethodGet, "/redirect/xyz+", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml,application/json;q=0.9")
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	res := recorder.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `href="http://test.com/landing"`)
+	assert.Contains(t, recorder.Body.String(), "Never")
+}
+
+func TestRedirect_PreviewExpiredURL(t *testing.T) {
+	handler := setupHandler()
+	mockRepo := handler.repo.(*MockURLRepository)
+	mockRepo.Save(context.Background(), &model.URL{
+		ShortURL:    shortDomain + "/redirect/xyz",
+		OriginalURL: "http://test.com",
+		Expiry:      expiresIn(-time.Hour),
+	})
+	request := RedirectRequest(http.MethodGet, "/redirect/xyz+", nil)
+	recorder := httptest.NewRecorder()
+
+	handler.Redirect(recorder, request)
+
+	assert.Equal(t, http.StatusGone, recorder.Result().StatusCode)
+}
+
+func TestRedirect_OpenGraphCard(t *testing.T) {
+	testCases := []struct {
+		name      string
+		userAgent string
+		ogTitle   string
+		ogImage   string
+		card      bool
+	}{
+		{"crawler", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "Spring sale", "http://test.com/sale.png", true},
+		{"browser", "Mozilla/5.0 (X11; Linux x86_64) Firefox/126.0", "Spring sale", "http://test.com/sale.png", false},
+		{"crawler without card", "Twitterbot/1.0", "", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := setupHandler()
+			renderer, err := pages.New("")
+			assert.Nil(t, err)
+			handler.pages = renderer
+			handler.crawlers = useragent.NewCrawlerMatcher(useragent.DefaultCrawlers)
+			mockRepo := handler.repo.(*MockURLRepository)
+			mockRepo.Save(context.Background(), &model.URL{
+				ShortURL:    shortDomain + "/redirect/xyz",
+				OriginalURL: "http://test.com/sale",
+				OGTitle:     tc.ogTitle,
+				OGImage:     tc.ogImage,
+			})
+			request := RedirectRequest(http.MethodGet, "/redirect/xyz", nil)
+			request.Header.Set("User-Agent", tc.userAgent)
+			recorder := httptest.NewRecorder()
+
+			handler.Redirect(recorder, request)
+
+			res := recorder.Result()
+			if !tc.card {
+				assert.Equal(t, http.StatusFound, res.StatusCode)
+				return
+			}
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			body := recorder.Body.String()
+			assert.Contains(t, body, `<meta property="og:title" content="Spring sale">`)
+			assert.Contains(t, body, `<meta property="og:image" content="http://test.com/sale.png">`)
+			assert.Contains(t, body, `<meta http-equiv="refresh" content="0; url=http://test.com/sale">`)
+			assert.Equal(t, int64(0), mockRepo.Store[shortDomain+"/redirect/xyz"].ClickCount)
+		})
+	}
 }
 
 func TestIncrementClickCount(t *testing.T) {
@@ -180,7 +2046,7 @@ func TestIncrementClickCount(t *testing.T) {
 	mockRepo.Save(context.Background(), &model.URL{
 		ShortURL:    shortURL,
 		OriginalURL: "http://test.com",
-		Expiry:      time.Now().Add(24 * time.Hour),
+		Expiry:      expiresIn(24 * time.Hour),
 	})
 	url, err := mockRepo.Find(context.Background(), shortURL)
 	assert.Nil(t, err)
@@ -207,15 +2073,272 @@ func TestIncrementClickCount(t *testing.T) {
 	assert.Equal(t, firstCounter, counter-2)
 }
 
+// contract checks responses against the OpenAPI document, recording the operations checked
+type contract struct {
+	t        *testing.T
+	document map[string]any
+	compiler *jsonschema.Compiler
+	checked  map[string]bool
+}
+
+func newContract(t *testing.T) *contract {
+	var document map[string]any
+	assert.Nil(t, json.Unmarshal(apidocs.Spec(), &document))
+	resource, err := jsonschema.UnmarshalJSON(bytes.NewReader(apidocs.Spec()))
+	assert.Nil(t, err)
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	assert.Nil(t, compiler.AddResource("openapi.json", resource))
+	return &contract{t: t, document: document, compiler: compiler, checked: make(map[string]bool)}
+}
+
+// check validates a response of the operation against the one documented for its status
+func (c *contract) check(method, path string, response *http.Response) {
+	t := c.t
+	operation := fmt.Sprintf("%s %s", method, path)
+	c.checked[operation] = true
+
+	pointer := "/paths/" + escapePointer(path) + "/" + strings.ToLower(method) + "/responses/" + strconv.Itoa(response.StatusCode)
+	documented, ok := c.lookup(pointer).(map[string]any)
+	if !assert.True(t, ok, "%s: undocumented status %d", operation, response.StatusCode) {
+		return
+	}
+	if ref, ok := documented["$ref"].(string); ok {
+		pointer = strings.TrimPrefix(ref, "#")
+		documented = c.lookup(pointer).(map[string]any)
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	content, ok := documented["content"].(map[string]any)
+	if !ok {
+		assert.Empty(t, body, "%s: undocumented body for status %d", operation, response.StatusCode)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if _, ok := content[mediaType]; !ok {
+		t.Errorf("%s: undocumented content type %q for status %d", operation, mediaType, response.StatusCode)
+		return
+	}
+	media := pointer + "/content/" + escapePointer(mediaType)
+	if c.lookup(media+"/schema") == nil {
+		return
+	}
+	schema, err := c.compiler.Compile("openapi.json#" + media + "/schema")
+	if !assert.Nil(t, err, operation) {
+		return
+	}
+
+	instances := [][]byte{body}
+	if mediaType == ndjsonMediaType {
+		instances = bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+	}
+	for _, instance := range instances {
+		var value any
+		if json.Unmarshal(instance, &value) != nil {
+			if strings.HasSuffix(mediaType, "json") {
+				t.Errorf("%s: invalid JSON %q", operation, instance)
+				continue
+			}
+			value = string(instance) // Plain text, HTML and binary bodies
+		}
+		assert.Nil(t, schema.Validate(value), "%s: %s", operation, instance)
+	}
+}
+
+// lookup returns the node of the document at the JSON pointer, nil when there is none
+func (c *contract) lookup(pointer string) any {
+	var node any = c.document
+	for _, key := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = object[strings.NewReplacer("~1", "/", "~0", "~").Replace(key)]
+	}
+	return node
+}
+
+// operations returns every operation of the document
+func (c *contract) operations() []string {
+	var operations []string
+	for path, item := range c.document["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			operations = append(operations, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	handler := setupHandler()
+	signer, err := access.New(access.Config{Secrets: []string{"0123456789abcdef"}, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour})
+	assert.Nil(t, err)
+	handler.access = signer
+	handler.webhooks.(*MockWebhookRepository).Deliveries = []*model.Delivery{
+		{ID: 1, SubscriptionID: 1, EventID: "evt", Event: "link.created", Payload: json.RawMessage(`{}`), Status: model.DeliveryDead, Attempts: 10},
+	}
+
+	// The routes of cmd/api, with the redirect prefix of the mock shortener
+	mux := http.NewServeMux()
+	handler.Routes(mux, "/redirect/")
+
+	authorized := http.Header{"Authorization": {"Bearer " + testAPIKey}}
+	testCases := []struct {
+		method string
+		target string
+		body   string
+		header http.Header
+		status int
+	}{
+		{http.MethodPost, "/create", `{"original_url":"https://example.com","ttl":"1h","utm":{"source":"news"}}`, nil, http.StatusCreated},
+		{http.MethodPost, "/create", `{"original_url":"https://example.com"}`, nil, http.StatusOK},
+		{http.MethodPost, "/create", `{"original_url":"https://files.example.com","prefix":"docs","require_signature":true}`, nil, http.StatusCreated},
+		{http.MethodPost, "/create", `{"original_url":`, nil, http.StatusBadRequest},
+		{http.MethodPost, "/create", `{"original_url":"https://other.example.com","prefix":"docs"}`, nil, http.StatusConflict},
+		{http.MethodPost, "/create", `{"original_url":"https://example.org","prefix":"docs"}`, http.Header{"Idempotency-Key": {"k"}}, http.StatusConflict},
+		{http.MethodPost, "/create", `{"original_url":"https://example.net"}`, http.Header{"Idempotency-Key": {"k"}}, http.StatusUnprocessableEntity},
+		{http.MethodPost, "/create", `{"original_url":"http://error.com"}`, nil, http.StatusInternalServerError},
+		{http.MethodGet, "/redirect/xyz", "", nil, http.StatusFound},
+		{http.MethodGet, "/redirect/xyz+", "", nil, http.StatusOK},
+		{http.MethodGet, "/redirect/404", "", nil, http.StatusNotFound},
+		{http.MethodGet, "/redirect/abc", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/redirect/docs", "", nil, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/links/bulk", `[{"original_url":"https://example.com"},{"original_url":""}]`, nil, http.StatusOK},
+		{http.MethodPost, "/api/v1/links/bulk", "{\"original_url\":\"https://example.com\"}\n", http.Header{"Content-Type": {ndjsonMediaType}}, http.StatusOK},
+		{http.MethodGet, "/api/v1/links?limit=1", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links?limit=0", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/links/xyz", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/404", "", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/links/export?format=csv", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/export?format=jsonl", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/export?format=bitly", "", nil, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/links/import?format=jsonl", `{"short_url":"imported","original_url":"https://example.com/imported"}`, authorized, http.StatusOK},
+		{http.MethodPost, "/api/v1/links/import?format=xml", "", authorized, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/links/import?format=jsonl", "", nil, http.StatusUnauthorized},
+		{http.MethodPatch, "/api/v1/links/xyz/expiry", `{"ttl":"2h"}`, authorized, http.StatusOK},
+		{http.MethodPatch, "/api/v1/links/xyz/expiry", `{}`, authorized, http.StatusBadRequest},
+		{http.MethodPatch, "/api/v1/links/xyz/expiry", `{"ttl":"2h"}`, nil, http.StatusUnauthorized},
+		{http.MethodPatch, "/api/v1/links/404/expiry", `{"ttl":"2h"}`, authorized, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/links/xyz/qr", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/xyz/qr?format=svg", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/xyz/qr?size=1", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/links/404/qr", "", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/links/xyz/events", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/xyz/events?last_event_id=x", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/links/404/events", "", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/links/xyz/stats", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/v1/links/404/stats", "", nil, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/links/docs/access", `{"ttl":"10m"}`, authorized, http.StatusCreated},
+		{http.MethodPost, "/api/v1/links/docs/access", `{"ttl":"ever"}`, authorized, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/links/docs/access", `{"ttl":"10m"}`, nil, http.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/links/404/access", "", authorized, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/webhooks", `{"url":"https://hooks.example.com","events":["link.created"]}`, authorized, http.StatusCreated},
+		{http.MethodPost, "/api/v1/webhooks", `{"url":"ftp://hooks.example.com"}`, authorized, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/webhooks", "", authorized, http.StatusOK},
+		{http.MethodGet, "/api/v1/webhooks/1/deliveries", "", authorized, http.StatusOK},
+		{http.MethodGet, "/api/v1/webhooks/1/deliveries?status=lost", "", authorized, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/webhooks/deliveries/1/redeliver", "", authorized, http.StatusAccepted},
+		{http.MethodPost, "/api/v1/webhooks/deliveries/2/redeliver", "", authorized, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/webhooks/deliveries/x/redeliver", "", authorized, http.StatusBadRequest},
+		{http.MethodDelete, "/api/v1/webhooks/1", "", authorized, http.StatusNoContent},
+		{http.MethodDelete, "/api/v1/webhooks/7", "", authorized, http.StatusNotFound},
+		{http.MethodDelete, "/api/v1/webhooks/x", "", authorized, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/webhooks", `{"url":"https://hooks.example.com"}`, nil, http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/webhooks", "", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/webhooks/1/deliveries", "", nil, http.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/webhooks/deliveries/1/redeliver", "", nil, http.StatusUnauthorized},
+		{http.MethodDelete, "/api/v1/webhooks/1", "", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/api/openapi.json", "", nil, http.StatusOK},
+		{http.MethodGet, "/api/docs", "", nil, http.StatusOK},
+	}
+
+	spec := newContract(t)
+	for _, tc := range testCases {
+		request := RedirectRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		for key, values := range tc.header {
+			request.Header[key] = values
+		}
+		// Click streams run until the client leaves
+		ctx, cancel := context.WithTimeout(request.Context(), 20*time.Millisecond)
+		request = request.WithContext(ctx)
+		recorder := httptest.NewRecorder()
+
+		mux.ServeHTTP(recorder, request)
+		cancel()
+
+		_, pattern := mux.Handler(request)
+		_, path, _ := strings.Cut(pattern, " ")
+		if path == "" {
+			path = pattern
+		}
+		if path == "/redirect/" {
+			path = "/r/{slug}"
+		}
+		assert.Equal(t, tc.status, recorder.Code, "%s %s: %s", tc.method, tc.target, recorder.Body.String())
+		spec.check(tc.method, path, recorder.Result())
+	}
+
+	for _, operation := range spec.operations() {
+		assert.True(t, spec.checked[operation], "%s isn't checked against live responses", operation)
+	}
+}
+
+// TestOpenAPIRoutes walks the spec against the routes of cmd/api: every operation is served, and every route is documented
+func TestOpenAPIRoutes(t *testing.T) {
+	handler := setupHandler()
+	mux := http.NewServeMux()
+	handler.Routes(mux, "/r/")
+	spec := newContract(t)
+
+	documented := map[string]bool{}
+	for _, operation := range spec.operations() {
+		method, path, _ := strings.Cut(operation, " ")
+		target := strings.NewReplacer("{slug}", "xyz", "{id}", "1").Replace(path)
+		_, pattern := mux.Handler(httptest.NewRequest(method, target, nil))
+		routed := pattern
+		if _, p, ok := strings.Cut(pattern, " "); ok {
+			routed = p
+		}
+		if routed == "/r/" {
+			routed = "/r/{slug}"
+		}
+		assert.Equal(t, path, routed, "%s is served by %q", operation, pattern)
+		documented[pattern] = true
+	}
+	for _, route := range handler.routes("/r/") {
+		assert.True(t, documented[route.pattern], "%s isn't in the spec", route.pattern)
+	}
+}
+
 func setupHandler() *Handler {
 	mockRepo := &MockURLRepository{Store: make(map[string]*model.URL)}
 	mockShortener := &MockShortener{}
+	importer := transfer.NewImporter(transfer.Config{
+		Logger:        mockLogger,
+		URLRepository: mockRepo,
+		Shortener:     mockShortener,
+	})
 	return NewHandler(&HandlerConfiguration{
-		URLRepository:  mockRepo,
-		Logger:         mockLogger,
-		Domain:         shortDomain,
-		ExpiryDuration: 30 * 24 * time.Hour,
-		Shortener:      mockShortener,
+		URLRepository:   mockRepo,
+		Logger:          mockLogger,
+		Domain:          shortDomain,
+		ExpiryDuration:  30 * 24 * time.Hour,
+		MinTTL:          time.Minute,
+		Shortener:       mockShortener,
+		Idempotency:     &MockIdempotencyRepository{Responses: make(map[string]*model.StoredResponse)},
+		IdempotencyTTL:  24 * time.Hour,
+		Importer:        importer,
+		Metadata:        &MockMetadataFetcher{Queued: make(map[string]string)},
+		Webhooks:        &MockWebhookRepository{},
+		Events:          &MockEmitter{},
+		Clicks:          clickstream.New(clickstream.Config{Buffer: 8, History: 8, Retention: time.Minute}),
+		StreamKeepalive: 50 * time.Millisecond,
+		APIKeys:         []string{testAPIKey},
 	})
 }
 
@@ -224,3 +2347,8 @@ func RedirectRequest(method, target string, body io.Reader) *http.Request {
 	request.Host = shortDomain
 	return request
 }
+
+func expiresIn(d time.Duration) *time.Time {
+	expiry := time.Now().Add(d)
+	return &expiry
+}
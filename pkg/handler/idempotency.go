@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"url-shortener/pkg/model"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyLease is how long a request can stay in progress before its key is taken over,
+// in case the instance processing it died without storing a response
+const idempotencyLease = 5 * time.Minute
+
+// Idempotent wraps a handler so that a request retried with the same Idempotency-Key
+// gets the stored response replayed instead of being processed again.
+// NDJSON requests are streamed and would have to be buffered whole, so their key is ignored.
+func (h *Handler) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if key == "" || h.idempotency == nil || mediaType == ndjsonMediaType {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Idempotency-Key is too long"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			h.logger.Error("invalid request", "error", err)
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid request"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := hashRequest(r, body)
+
+		now := time.Now()
+		storedAfter := now.Add(-h.idempotencyTTL)
+		reserved, err := h.idempotency.Reserve(r.Context(), key, requestHash, now, storedAfter, now.Add(-idempotencyLease))
+		if err != nil {
+			// Processing the request is better than failing it, at worst it's not deduplicated
+			h.logger.Error("Failed to reserve idempotency key", "key", key, "error", err)
+			next(w, r)
+			return
+		}
+		if !reserved {
+			stored, err := h.idempotency.FindResponse(r.Context(), key, storedAfter)
+			if err != nil {
+				h.logger.Error("Failed to look up idempotency key", "key", key, "error", err)
+				h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error"))
+				return
+			}
+			switch {
+			case stored != nil && stored.RequestHash != requestHash:
+				h.fail(w, r, newAPIError(http.StatusUnprocessableEntity, codeIdempotencyConflict, "Idempotency-Key was already used for a different request"))
+			case stored == nil || stored.StatusCode == 0:
+				// The first request is still running, or finished between the two lookups
+				h.fail(w, r, newAPIError(http.StatusConflict, codeIdempotencyInProgress, "A request with this Idempotency-Key is still in progress"))
+			default:
+				h.logger.Info("Replaying stored response", "key", key)
+				w.Header().Set("Content-Type", stored.ContentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		// Server errors are transient, the client should be able to retry them
+		if recorder.status >= http.StatusInternalServerError {
+			if err := h.idempotency.Release(r.Context(), key); err != nil {
+				h.logger.Error("Failed to release idempotency key", "key", key, "error", err)
+			}
+			return
+		}
+		response := &model.StoredResponse{
+			RequestHash: requestHash,
+			StatusCode:  recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}
+		if err := h.idempotency.SaveResponse(r.Context(), key, response); err != nil {
+			h.logger.Error("Failed to store response", "key", key, "error", err)
+		}
+	}
+}
+
+func hashRequest(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response written through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
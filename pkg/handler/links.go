@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// MetadataFetcher schedules fetching the destination metadata of new links
+type MetadataFetcher interface {
+	Enqueue(shortURL, originalURL string) bool
+}
+
+// listResponse is a page of links, Next is passed as after to get the following page
+type listResponse struct {
+	Links []*model.URL `json:"links"`
+	Next  string       `json:"next,omitempty"`
+}
+
+// GetLink returns a link with its stats and destination metadata
+func (h *Handler) GetLink(w http.ResponseWriter, r *http.Request) {
+	if u, ok := h.findLink(w, r); ok {
+		writeJSON(w, http.StatusOK, h.visible(r, u))
+	}
+}
+
+// findLink returns the link of the slug in the request path, or answers with a problem when it can't
+func (h *Handler) findLink(w http.ResponseWriter, r *http.Request) (*model.URL, bool) {
+	shortURL := h.shortener.BuildShortURL(r.PathValue("slug"))
+	u, err := h.repo.Find(r.Context(), shortURL)
+	if errors.Is(err, repository.ErrNotFound) {
+		h.logger.Info("URL not found", "URL", shortURL)
+		h.fail(w, r, newAPIError(http.StatusNotFound, codeNotFound, "URL not found"))
+		return nil, false
+	}
+	if err != nil {
+		h.fail(w, r, fmt.Errorf("finding %s: %w", shortURL, err))
+		return nil, false
+	}
+	return u, true
+}
+
+// ListLinks returns links ordered by short URL.
+// Query parameters: limit, after to continue from the previous page, and broken=true
+// to only list links whose destination is failing.
+func (h *Handler) ListLinks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := repository.ListOptions{After: query.Get("after"), Limit: defaultListLimit}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if options.Limit, err = strconv.Atoi(limit); err != nil || options.Limit < 1 || options.Limit > maxListLimit {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+			return
+		}
+	}
+	if broken := query.Get("broken"); broken != "" {
+		var err error
+		if options.Broken, err = strconv.ParseBool(broken); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid broken"))
+			return
+		}
+	}
+
+	links, err := h.repo.List(r.Context(), options)
+	if err != nil {
+		h.logger.Error("Error listing URLs", "error", err)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to list URLs"))
+		return
+	}
+
+	response := listResponse{Links: make([]*model.URL, len(links))}
+	for i, link := range links {
+		response.Links[i] = h.visible(r, link)
+	}
+	if len(links) == options.Limit {
+		response.Next = links[len(links)-1].ShortURL
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// fetchMetadata schedules fetching the destination of a newly created link
+func (h *Handler) fetchMetadata(u *model.URL) {
+	if h.metadata != nil {
+		h.metadata.Enqueue(u.ShortURL, u.OriginalURL)
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"url-shortener/pkg/model"
+)
+
+// previewSuffix appended to a short URL shows where it goes instead of redirecting
+const previewSuffix = "+"
+
+// wantsPreview reports whether the request asks to inspect the link rather than follow it,
+// and returns the short URL without the preview suffix
+func wantsPreview(r *http.Request, shortURL string) (string, bool) {
+	if trimmed, ok := strings.CutSuffix(shortURL, previewSuffix); ok {
+		return trimmed, true
+	}
+	return shortURL, acceptsJSON(r)
+}
+
+// acceptsJSON reports whether the client asked for JSON rather than a web page
+func acceptsJSON(r *http.Request) bool {
+	json := false
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			json = true
+		case "text/html":
+			return false
+		}
+	}
+	return json
+}
+
+// preview shows the destination and stats of a link without counting a click
+func (h *Handler) preview(w http.ResponseWriter, r *http.Request, u *model.URL) {
+	if h.pages == nil || acceptsJSON(r) {
+		writeJSON(w, http.StatusOK, u)
+		return
+	}
+	if err := h.pages.Render(w, "preview.html", http.StatusOK, u); err != nil {
+		h.logger.Error("Failed to render preview page", "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"url-shortener/pkg/repository"
+)
+
+// problemMediaType is the media type of RFC 9457 problem details
+const problemMediaType = "application/problem+json"
+
+// Error codes carried by problem responses, for clients to tell failures apart without parsing messages.
+// There is no rate limiting, hence no rate_limited code.
+const (
+	codeInvalidRequest        = "invalid_request"         // Malformed body or query parameters
+	codeInvalidURL            = "invalid_url"             // The URL to shorten or one of the link destinations is refused
+	codeInvalidSlug           = "invalid_slug"            // Not a slug or prefix that can be served
+	codeSlugTaken             = "slug_taken"              // A link to another page holds the short URL
+	codeNotFound              = "not_found"               // No such link, webhook or delivery
+	codeExpired               = "expired"                 // The link or the access URL has expired
+	codeAccessDenied          = "access_denied"           // The link requires a valid access signature
+	codeUnauthorized          = "unauthorized"            // The endpoint requires an API key
+	codeIdempotencyConflict   = "idempotency_conflict"    // The Idempotency-Key was used for another request
+	codeIdempotencyInProgress = "idempotency_in_progress" // A request with the Idempotency-Key is still being processed
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeInternal              = "internal_error"
+)
+
+// apiError is a failure answered with a problem response
+type apiError struct {
+	status int
+	code   string
+	detail string
+}
+
+func newAPIError(status int, code, detail string) *apiError {
+	return &apiError{status: status, code: code, detail: detail}
+}
+
+func (e *apiError) Error() string {
+	return e.detail
+}
+
+// problem is the body of problem responses, code is an extension member
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// fail answers the request with the problem matching err
+func (h *Handler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, h.toAPIError(err))
+}
+
+// toAPIError returns err when it's an apiError and maps the repository errors to their status.
+// Other errors are logged and hidden behind an internal error.
+func (h *Handler) toAPIError(err error) *apiError {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, repository.ErrNotFound):
+		return newAPIError(http.StatusNotFound, codeNotFound, "Not found")
+	case errors.Is(err, repository.ErrAlreadyExists):
+		return newAPIError(http.StatusConflict, codeSlugTaken, "Short URL already taken")
+	default:
+		h.logger.Error("Internal error", "error", err)
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, e *apiError) {
+	w.Header().Set("Content-Type", problemMediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(problem{
+		Type:     "about:blank", // The code tells problems apart, the title is the one of the status
+		Title:    http.StatusText(e.status),
+		Status:   e.status,
+		Detail:   e.detail,
+		Instance: r.URL.Path,
+		Code:     e.code,
+	})
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"url-shortener/pkg/qr"
+)
+
+// QRCode renders the QR code of a short URL as PNG or SVG.
+// Query parameters: format (png, svg), size, level (L, M, Q, H), margin, fg, bg and logo.
+func (h *Handler) QRCode(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.findLink(w, r)
+	if !ok {
+		return
+	}
+	shortURL := u.ShortURL
+
+	query := r.URL.Query()
+	options := qr.DefaultOptions()
+	var err error
+	if size := query.Get("size"); size != "" {
+		if options.Size, err = strconv.Atoi(size); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid size"))
+			return
+		}
+	}
+	if margin := query.Get("margin"); margin != "" {
+		if options.Margin, err = strconv.Atoi(margin); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid margin"))
+			return
+		}
+	}
+	if level := query.Get("level"); level != "" {
+		if options.Level, err = qr.ParseLevel(level); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+			return
+		}
+	}
+	if fg := query.Get("fg"); fg != "" {
+		if options.Foreground, err = qr.ParseColor(fg); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+			return
+		}
+	}
+	if bg := query.Get("bg"); bg != "" {
+		if options.Background, err = qr.ParseColor(bg); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+			return
+		}
+	}
+	if logo, _ := strconv.ParseBool(query.Get("logo")); logo {
+		if h.qrLogo == nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "No logo is configured"))
+			return
+		}
+		options.Logo = h.qrLogo
+	}
+	if err := options.Validate(); err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	// Scanners only open URLs with a scheme
+	content := shortURL
+	if !strings.Contains(content, "://") {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		content = scheme + "://" + content
+	}
+
+	var rendered bytes.Buffer
+	contentType := "image/png"
+	switch query.Get("format") {
+	case "", "png":
+		err = qr.PNG(&rendered, content, options)
+	case "svg":
+		contentType = "image/svg+xml"
+		err = qr.SVG(&rendered, content, options)
+	default:
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Format must be png or svg"))
+		return
+	}
+	if err != nil {
+		h.logger.Error("Error rendering QR code", "URL", shortURL, "error", err)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to render QR code"))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(rendered.Bytes())
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+
+	"url-shortener/pkg/apidocs"
+)
+
+// route is a pattern of the HTTP API and the handler serving it
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// routes lists the patterns served, with short URLs followed under redirectPrefix
+func (h *Handler) routes(redirectPrefix string) []route {
+	return []route{
+		{"/create", h.Idempotent(h.ShortenURL)},
+		{redirectPrefix, h.SignedAccess(h.Redirect)},
+		{"POST /api/v1/links/bulk", h.Idempotent(h.BulkShortenURLs)},
+		{"GET /api/v1/links", h.ListLinks},
+		{"GET /api/v1/links/{slug}", h.GetLink},
+		{"GET /api/v1/links/export", h.ExportLinks},
+		{"POST /api/v1/links/import", h.RequireAPIKey(h.ImportLinks)},
+		{"PATCH /api/v1/links/{slug}/expiry", h.RequireAPIKey(h.UpdateExpiry)},
+		{"GET /api/v1/links/{slug}/qr", h.QRCode},
+		{"GET /api/v1/links/{slug}/events", h.ClickStream},
+		{"GET /api/v1/links/{slug}/stats", h.GetLinkStats},
+		{"POST /api/v1/links/{slug}/access", h.RequireAPIKey(h.CreateAccessURL)},
+		{"POST /api/v1/webhooks", h.RequireAPIKey(h.CreateWebhook)},
+		{"GET /api/v1/webhooks", h.RequireAPIKey(h.ListWebhooks)},
+		{"DELETE /api/v1/webhooks/{id}", h.RequireAPIKey(h.DeleteWebhook)},
+		{"GET /api/v1/webhooks/{id}/deliveries", h.RequireAPIKey(h.ListDeliveries)},
+		{"POST /api/v1/webhooks/deliveries/{id}/redeliver", h.RequireAPIKey(h.Redeliver)},
+		{"GET /api/openapi.json", apidocs.ServeSpec},
+		{"GET /api/docs", apidocs.ServeDocs},
+	}
+}
+
+// Routes registers the HTTP API on mux. Short URLs are followed under redirectPrefix,
+// the path the shortener builds them with.
+func (h *Handler) Routes(mux *http.ServeMux, redirectPrefix string) {
+	for _, route := range h.routes(redirectPrefix) {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"url-shortener/pkg/clickstream"
+)
+
+// ClickStream streams the clicks of a link as Server-Sent Events.
+// Clients reconnecting with Last-Event-ID get the clicks they missed, while they are still in the history.
+func (h *Handler) ClickStream(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.findLink(w, r)
+	if !ok {
+		return
+	}
+	shortURL := u.ShortURL
+	// Clicks of private links are streamed without the destination they were sent to
+	redact := u.RequireSignature && !h.authenticated(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Streaming unsupported"))
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var after int64
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid Last-Event-ID"))
+			return
+		}
+	}
+
+	sub, missed := h.clicks.Subscribe(shortURL, after)
+	defer h.clicks.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keeps nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(w, event, redact)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(h.streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			// Comments keep proxies from closing idle connections
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, open := <-sub.Events:
+			if !open {
+				h.logger.Warn("Dropped slow click stream consumer", "shortURL", shortURL)
+				return
+			}
+			writeEvent(w, event, redact)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event clickstream.Event, redact bool) {
+	if redact {
+		event.Click.Destination = ""
+	}
+	data, _ := json.Marshal(event.Click)
+	fmt.Fprintf(w, "id: %d\nevent: click\ndata: %s\n\n", event.ID, data)
+}
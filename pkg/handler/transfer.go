@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/transfer"
+)
+
+// ExportLinks streams every link and its stats as CSV or JSON Lines.
+// Private links are exported without their destinations unless the caller presents an API key.
+func (h *Handler) ExportLinks(w http.ResponseWriter, r *http.Request) {
+	format, err := transfer.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil || (format != transfer.FormatCSV && format != transfer.FormatJSONL) {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Format must be csv or jsonl"))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="links-%s.%s"`, time.Now().Format("20060102"), format))
+	count, err := transfer.Export(r.Context(), w, format, h.repo, func(u *model.URL) *model.URL {
+		return h.visible(r, u)
+	})
+	if err != nil {
+		// Headers are already sent, the client sees a truncated file
+		h.logger.Error("Export failed", "exported", count, "error", err)
+		return
+	}
+	h.logger.Info("Links exported", "format", format, "count", count)
+}
+
+// ImportLinks imports links from one of our exports or from a Bitly or YOURLS CSV export,
+// and responds with a report of the links that could not be imported as they were
+func (h *Handler) ImportLinks(w http.ResponseWriter, r *http.Request) {
+	format, err := transfer.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+	reader, err := transfer.NewReader(r.Body, format)
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error()))
+		return
+	}
+
+	report, err := h.importer.Import(r.Context(), reader)
+	if err != nil {
+		h.logger.Error("Import stopped", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Import stopped after %d links: %v", report.Imported, err)))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"url-shortener/pkg/model"
+)
+
+const (
+	variantCookie    = "variant"
+	variantCookieAge = 30 * 24 * time.Hour
+)
+
+// variantStats is the clicks of one destination of a link
+type variantStats struct {
+	model.Variant
+	Clicks int64 `json:"clicks"`
+}
+
+// statsResponse is the clicks of a link, split by variant
+type statsResponse struct {
+	ShortURL string         `json:"short_url"`
+	Clicks   int64          `json:"clicks"`
+	Variants []variantStats `json:"variants"`
+}
+
+// variant picks the variant of the visitor. With sticky variants, the variant
+// from a previous visit is kept, and a new one is remembered in a cookie scoped to the link.
+func (h *Handler) variant(w http.ResponseWriter, r *http.Request, u *model.URL) string {
+	if u.StickyVariants {
+		if cookie, err := r.Cookie(variantCookie); err == nil && u.Variant(cookie.Value) != nil {
+			return cookie.Value
+		}
+	}
+	name := u.PickVariant(rand.Float64())
+	if u.StickyVariants {
+		http.SetCookie(w, &http.Cookie{
+			Name:     variantCookie,
+			Value:    name,
+			Path:     r.URL.Path,
+			MaxAge:   int(variantCookieAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return name
+}
+
+// GetLinkStats returns the clicks of a link and of each of its variants
+func (h *Handler) GetLinkStats(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.findLink(w, r)
+	if !ok {
+		return
+	}
+	u = h.visible(r, u)
+
+	response := statsResponse{ShortURL: u.ShortURL, Clicks: u.ClickCount, Variants: []variantStats{}}
+	for _, variant := range u.Variants {
+		response.Variants = append(response.Variants, variantStats{Variant: variant, Clicks: u.VariantClicks[variant.Name]})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
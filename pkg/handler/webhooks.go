@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/webhook"
+)
+
+const maxDeliveriesLimit = 500
+
+// CreateWebhook subscribes an endpoint to link events.
+// The signing secret is generated unless given, and only returned in this response.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var subscription model.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		h.logger.Error("invalid JSON format", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON format"))
+		return
+	}
+	if err := subscription.Sanitize(); err != nil {
+		h.logger.Error("Invalid webhook URL", "error", err)
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidURL, "Invalid webhook URL"))
+		return
+	}
+	for _, event := range subscription.Events {
+		if !slices.Contains(webhook.Events, event) {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Unknown event "+event))
+			return
+		}
+	}
+	if subscription.Events == nil {
+		subscription.Events = []string{}
+	}
+	if subscription.Secret == "" {
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			h.logger.Error("Error generating webhook secret", "error", err)
+			h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to create webhook"))
+			return
+		}
+		subscription.Secret = secret
+	}
+	subscription.ID = 0
+	subscription.CreatedAt = time.Time{}
+
+	if err := h.webhooks.SaveSubscription(r.Context(), &subscription); err != nil {
+		h.logger.Error("Error saving webhook", "error", err)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to create webhook"))
+		return
+	}
+	h.logger.Info("Webhook created", "id", subscription.ID, "URL", subscription.URL)
+	writeJSON(w, http.StatusCreated, subscription)
+}
+
+// ListWebhooks returns every subscription, without their secrets
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := h.webhooks.ListSubscriptions(r.Context())
+	if err != nil {
+		h.logger.Error("Error listing webhooks", "error", err)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to list webhooks"))
+		return
+	}
+	writeJSON(w, http.StatusOK, subscriptions)
+}
+
+// DeleteWebhook removes a subscription and its delivery log
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid webhook ID"))
+		return
+	}
+	if err := h.webhooks.DeleteSubscription(r.Context(), id); err != nil {
+		h.webhookError(w, r, "Error deleting webhook", err)
+		return
+	}
+	h.logger.Info("Webhook deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries returns the latest deliveries of a subscription.
+// Query parameters: status (pending, delivered, dead) and limit.
+func (h *Handler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid webhook ID"))
+		return
+	}
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != model.DeliveryPending && status != model.DeliveryDelivered && status != model.DeliveryDead {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid status"))
+		return
+	}
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDeliveriesLimit {
+			h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxDeliveriesLimit)))
+			return
+		}
+	}
+
+	deliveries, err := h.webhooks.ListDeliveries(r.Context(), id, status, limit)
+	if err != nil {
+		h.logger.Error("Error listing webhook deliveries", "error", err)
+		h.fail(w, r, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to list deliveries"))
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// Redeliver sends a delivery again, typically one that was dead-lettered
+func (h *Handler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.fail(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid delivery ID"))
+		return
+	}
+	if err := h.webhooks.Redeliver(r.Context(), id); err != nil {
+		h.webhookError(w, r, "Error requeuing webhook delivery", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) webhookError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	if errors.Is(err, repository.ErrWebhookNotFound) {
+		h.fail(w, r, newAPIError(http.StatusNotFound, codeNotFound, "Webhook not found"))
+		return
+	}
+	h.fail(w, r, fmt.Errorf("%s: %w", message, err))
+}
+
+// emit records a link event for webhook subscribers. Call it in inTx with the change
+// the event reports, so both commit or neither does.
+func (h *Handler) emit(ctx context.Context, event string, data any) error {
+	if h.events == nil {
+		return nil
+	}
+	return h.events.Emit(ctx, event, data)
+}
+
+// inTx runs fn in a transaction when a Transactor is configured
+func (h *Handler) inTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if h.transactor == nil {
+		return fn(ctx)
+	}
+	return h.transactor.InTx(ctx, fn)
+}
@@ -0,0 +1,254 @@
+package health
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/netguard"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/webhook"
+)
+
+const (
+	userAgent    = "url-shortener-health/1.0"
+	pollInterval = time.Minute // Wait before looking for due links again once all are checked
+)
+
+// metrics is published on /debug/vars
+var metrics = expvar.NewMap("health")
+
+type Config struct {
+	Logger           *slog.Logger
+	Repository       repository.HealthRepository
+	Interval         time.Duration   // Time between two checks of the same link
+	BatchSize        int             // Links loaded per query
+	Workers          int             // Concurrent checks
+	Timeout          time.Duration   // Limit for a single check, redirects included
+	HostDelay        time.Duration   // Minimum time between two requests to the same host
+	FailureThreshold int             // Consecutive failures after which a link is marked broken
+	Events           webhook.Emitter // Optional, notified when a link becomes broken
+	Client           *http.Client    // Optional, defaults to a client refusing non-public addresses
+
+	Transactor repository.Transactor // Optional, commits the health of a link with the event it raises
+}
+
+// Checker periodically requests the destinations of every live link to detect link rot.
+type Checker struct {
+	config  Config
+	client  *http.Client
+	limiter *hostLimiter
+}
+
+func New(config Config) *Checker {
+	client := config.Client
+	if client == nil {
+		client = netguard.Client(config.Timeout)
+	}
+	return &Checker{
+		config:  config,
+		client:  client,
+		limiter: newHostLimiter(config.HostDelay),
+	}
+}
+
+// Run checks due links until the context is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		checked, err := c.CheckDue(ctx)
+		if err != nil {
+			c.config.Logger.Error("Failed to check links", "error", err)
+		}
+
+		// A full batch means more links are waiting
+		wait := pollInterval
+		if err == nil && checked == c.config.BatchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// CheckDue checks one batch of links not checked within the interval and returns how many were checked.
+func (c *Checker) CheckDue(ctx context.Context) (int, error) {
+	urls, err := c.config.Repository.ListDueForCheck(ctx, time.Now().Add(-c.config.Interval), c.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	jobs := make(chan *model.URL)
+	var wg sync.WaitGroup
+	for i := 0; i < c.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				c.checkLink(ctx, u)
+			}
+		}()
+	}
+	for _, u := range urls {
+		jobs <- u
+	}
+	close(jobs)
+	wg.Wait()
+
+	return len(urls), ctx.Err()
+}
+
+// checkLink checks the destinations of u in turn and stores the result of the first failing one,
+// or of the original URL when all of them respond
+func (c *Checker) checkLink(ctx context.Context, u *model.URL) {
+	var health *model.Health
+	for _, destination := range u.Destinations() {
+		if parsed, err := url.Parse(destination); err == nil {
+			if err := c.limiter.wait(ctx, parsed.Hostname()); err != nil {
+				return
+			}
+		}
+		result := c.Check(ctx, destination)
+		result.URL = destination
+		metrics.Add("checks", 1)
+		if health == nil || isFailure(result) {
+			health = result
+		}
+		if isFailure(result) {
+			break
+		}
+	}
+
+	if isFailure(health) {
+		metrics.Add("failures", 1)
+		health.Failures = 1
+		if u.Health != nil {
+			health.Failures += u.Health.Failures
+		}
+	}
+	health.Broken = health.Failures >= c.config.FailureThreshold
+
+	wasBroken := u.Health != nil && u.Health.Broken
+	broke := health.Broken && !wasBroken
+	save := func(ctx context.Context) error {
+		if err := c.config.Repository.SaveHealth(ctx, u.ShortURL, health); err != nil {
+			return err
+		}
+		if !broke || c.config.Events == nil {
+			return nil
+		}
+		u.Health = health
+		return c.config.Events.Emit(ctx, webhook.EventLinkBroken, u.Public())
+	}
+	var err error
+	if c.config.Transactor != nil {
+		err = c.config.Transactor.InTx(ctx, save)
+	} else {
+		err = save(ctx)
+	}
+	if err != nil {
+		c.config.Logger.Error("Failed to save health", "shortURL", u.ShortURL, "error", err)
+		return
+	}
+
+	if broke {
+		metrics.Add("broken", 1)
+		c.config.Logger.Warn("Link destination is broken", "shortURL", u.ShortURL, "URL", health.URL, "failures", health.Failures)
+	}
+}
+
+// Check requests rawURL with HEAD, falling back to GET for servers that don't support it.
+// Failures are reported in the returned health rather than as an error.
+func (c *Checker) Check(ctx context.Context, rawURL string) *model.Health {
+	health := c.request(ctx, http.MethodHead, rawURL)
+	if health.StatusCode == http.StatusMethodNotAllowed || health.StatusCode == http.StatusNotImplemented {
+		health = c.request(ctx, http.MethodGet, rawURL)
+	}
+	return health
+}
+
+func (c *Checker) request(ctx context.Context, method, rawURL string) *model.Health {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	health := &model.Health{CheckedAt: time.Now()}
+
+	// Follow redirects through a copy of the client to record them
+	client := *c.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		health.Redirects = append(health.Redirects, req.URL.String())
+		if c.client.CheckRedirect != nil {
+			return c.client.CheckRedirect(req, via)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	start := time.Now()
+	res, err := client.Do(req)
+	health.ResponseTimeMS = time.Since(start).Milliseconds()
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	res.Body.Close()
+	health.StatusCode = res.StatusCode
+	return health
+}
+
+// isFailure reports whether the destination looks gone. Statuses such as 401, 403
+// or 429 mean the server is up but refuses the checker, so they aren't failures.
+func isFailure(health *model.Health) bool {
+	return health.StatusCode == 0 ||
+		health.StatusCode == http.StatusNotFound ||
+		health.StatusCode == http.StatusGone ||
+		health.StatusCode >= http.StatusInternalServerError
+}
+
+// hostLimiter spaces out requests to the same host
+type hostLimiter struct {
+	delay time.Duration
+	mu    sync.Mutex
+	next  map[string]time.Time // Earliest time of the next request, per host
+}
+
+func newHostLimiter(delay time.Duration) *hostLimiter {
+	return &hostLimiter{delay: delay, next: make(map[string]time.Time)}
+}
+
+// wait reserves the next slot for host and sleeps until it comes
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	now := time.Now()
+	slot := now
+	if next, ok := l.next[host]; ok && next.After(now) {
+		slot = next
+	}
+	l.next[host] = slot.Add(l.delay)
+	// Forget hosts whose slots have passed so the map doesn't grow forever
+	for h, next := range l.next {
+		if next.Before(now) {
+			delete(l.next, h)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(slot)):
+		return nil
+	}
+}
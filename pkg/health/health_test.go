@@ -0,0 +1,242 @@
+package health
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// MockHealthRepository holds URLs in memory
+type MockHealthRepository struct {
+	mu   sync.Mutex
+	URLs []*model.URL
+}
+
+func (m *MockHealthRepository) ListDueForCheck(ctx context.Context, checkedBefore time.Time, limit int) ([]*model.URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []*model.URL
+	for _, u := range m.URLs {
+		if len(due) < limit && (u.Health == nil || u.Health.CheckedAt.Before(checkedBefore)) {
+			copied := *u
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (m *MockHealthRepository) SaveHealth(ctx context.Context, shortURL string, health *model.Health) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.URLs {
+		if u.ShortURL == shortURL {
+			u.Health = health
+		}
+	}
+	return nil
+}
+
+// MockEmitter records emitted events
+type MockEmitter struct {
+	Events []string
+	Data   []any
+}
+
+func (m *MockEmitter) Emit(ctx context.Context, event string, data any) error {
+	m.Events = append(m.Events, event)
+	m.Data = append(m.Data, data)
+	return nil
+}
+
+func setupChecker(repo *MockHealthRepository, events *MockEmitter) *Checker {
+	return New(Config{
+		Logger:           mockLogger,
+		Repository:       repo,
+		Interval:         time.Hour,
+		BatchSize:        10,
+		Workers:          2,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+		Events:           events,
+		// The default client refuses the loopback test servers
+		Client: &http.Client{},
+	})
+}
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/new":
+			w.WriteHeader(http.StatusOK)
+		case "/head-unsupported":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	checker := setupChecker(&MockHealthRepository{}, &MockEmitter{})
+
+	health := checker.Check(context.Background(), server.URL+"/old")
+	assert.Equal(t, http.StatusOK, health.StatusCode)
+	assert.Equal(t, []string{server.URL + "/new"}, health.Redirects)
+	assert.False(t, health.CheckedAt.IsZero())
+	assert.False(t, isFailure(health))
+
+	health = checker.Check(context.Background(), server.URL+"/head-unsupported")
+	assert.Equal(t, http.StatusOK, health.StatusCode)
+
+	health = checker.Check(context.Background(), server.URL+"/missing")
+	assert.Equal(t, http.StatusNotFound, health.StatusCode)
+	assert.True(t, isFailure(health))
+}
+
+func TestCheck_ConnectionError(t *testing.T) {
+	server := httptest.NewServer(nil)
+	server.Close()
+	checker := setupChecker(&MockHealthRepository{}, &MockEmitter{})
+
+	health := checker.Check(context.Background(), server.URL)
+	assert.Equal(t, 0, health.StatusCode)
+	assert.NotEmpty(t, health.Error)
+	assert.True(t, isFailure(health))
+}
+
+func TestIsFailure(t *testing.T) {
+	testCases := []struct {
+		status  int
+		failure bool
+	}{
+		{0, true},
+		{http.StatusOK, false},
+		{http.StatusForbidden, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusNotFound, true},
+		{http.StatusGone, true},
+		{http.StatusBadGateway, true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.failure, isFailure(&model.Health{StatusCode: tc.status}), "status %d", tc.status)
+	}
+}
+
+func TestCheckDue_MarksBrokenAfterConsecutiveFailures(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer destination.Close()
+
+	events := &MockEmitter{}
+	repo := &MockHealthRepository{URLs: []*model.URL{{ShortURL: "http://short.com/r/abc123", OriginalURL: destination.URL}}}
+	checker := setupChecker(repo, events)
+	checker.config.Interval = 0 // Every link is due on each run
+
+	checked, err := checker.CheckDue(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, checked)
+	assert.Equal(t, 1, repo.URLs[0].Health.Failures)
+	assert.False(t, repo.URLs[0].Health.Broken)
+	assert.Empty(t, events.Events)
+
+	checker.CheckDue(context.Background())
+	assert.Equal(t, 2, repo.URLs[0].Health.Failures)
+	assert.True(t, repo.URLs[0].Health.Broken)
+	assert.Equal(t, []string{webhook.EventLinkBroken}, events.Events)
+	assert.Equal(t, "http://short.com/r/abc123", events.Data[0].(*model.URL).ShortURL)
+
+	// Still broken, the event isn't emitted twice
+	checker.CheckDue(context.Background())
+	assert.Equal(t, 3, repo.URLs[0].Health.Failures)
+	assert.Len(t, events.Events, 1)
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	checker.CheckDue(context.Background())
+	assert.Equal(t, 0, repo.URLs[0].Health.Failures)
+	assert.False(t, repo.URLs[0].Health.Broken)
+}
+
+func TestCheckDue_ChecksEveryDestination(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer destination.Close()
+
+	repo := &MockHealthRepository{URLs: []*model.URL{{
+		ShortURL:    "http://short.com/r/abc123",
+		OriginalURL: destination.URL + "/home",
+		Variants:    []model.Variant{{Name: "a", URL: destination.URL + "/home"}, {Name: "b", URL: destination.URL + "/b"}},
+		CountryURLs: map[string]string{"FR": destination.URL + "/gone", "DE": destination.URL + "/de"},
+		DeviceRules: []model.DeviceRule{{OS: "ios", URL: "myapp://open"}, {OS: "android", URL: destination.URL + "/android"}},
+	}}}
+	checker := setupChecker(repo, &MockEmitter{})
+
+	_, err := checker.CheckDue(context.Background())
+	assert.Nil(t, err)
+	// Each destination once, deep links skipped, until the first failure
+	assert.Equal(t, []string{"/home", "/b", "/de", "/gone"}, requested)
+	health := repo.URLs[0].Health
+	assert.Equal(t, destination.URL+"/gone", health.URL)
+	assert.Equal(t, http.StatusGone, health.StatusCode)
+	assert.Equal(t, 1, health.Failures)
+}
+
+func TestCheckDue_SkipsRecentlyChecked(t *testing.T) {
+	repo := &MockHealthRepository{URLs: []*model.URL{{
+		ShortURL:    "http://short.com/r/abc123",
+		OriginalURL: "http://example.com",
+		Health:      &model.Health{StatusCode: http.StatusOK, CheckedAt: time.Now()},
+	}}}
+	checker := setupChecker(repo, &MockEmitter{})
+
+	checked, err := checker.CheckDue(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, checked)
+}
+
+func TestHostLimiter(t *testing.T) {
+	limiter := newHostLimiter(50 * time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	limiter.wait(ctx, "a.com")
+	limiter.wait(ctx, "b.com")
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "different hosts don't wait on each other")
+
+	limiter.wait(ctx, "a.com")
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, limiter.wait(cancelled, "a.com"))
+}
@@ -0,0 +1,155 @@
+package janitor
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/webhook"
+)
+
+// metrics is published on /debug/vars
+var metrics = expvar.NewMap("janitor")
+
+type Config struct {
+	Logger      *slog.Logger
+	Purger      repository.URLPurger
+	Interval    time.Duration // Time between two purges
+	GracePeriod time.Duration // How long expired URLs are kept before being purged
+	BatchSize   int           // Maximum number of rows purged per statement
+
+	Events     webhook.Emitter       // Optional, notified of every purged URL
+	Transactor repository.Transactor // Optional, commits each batch of URLs with its events
+
+	Idempotency    repository.IdempotencyPurger // Optional, removes the responses stored for Idempotency-Keys
+	IdempotencyTTL time.Duration                // How long responses are replayed for a given Idempotency-Key
+
+	Deliveries        repository.DeliveryPurger // Optional, removes webhook deliveries that won't be attempted again
+	DeliveryRetention time.Duration             // How long delivered and dead deliveries are kept, 0 keeps them forever
+}
+
+// Janitor periodically archives expired URLs so their short URLs can be reused,
+// forgets the responses stored for Idempotency-Keys that are no longer replayed,
+// and trims the log of finished webhook deliveries.
+type Janitor struct {
+	config Config
+}
+
+func New(config Config) *Janitor {
+	return &Janitor{
+		config: config,
+	}
+}
+
+// Run purges expired URLs every interval until the context is cancelled.
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Purge(ctx); err != nil {
+			j.config.Logger.Error("Failed to purge expired URLs", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge archives, in batches, every URL that expired more than the grace period ago and emits
+// a link.expired event for each, then deletes the Idempotency-Keys older than their TTL and the
+// finished webhook deliveries older than their retention.
+func (j *Janitor) Purge(ctx context.Context) (int64, error) {
+	start := time.Now()
+	expiredBefore := start.Add(-j.config.GracePeriod)
+	metrics.Add("runs", 1)
+
+	total, err := j.inBatches(ctx, "purged_urls", func(limit int) (int64, error) {
+		return j.purgeExpired(ctx, expiredBefore, limit)
+	})
+	if err != nil {
+		return total, fmt.Errorf("purge stopped after %d URLs: %v", total, err)
+	}
+	j.config.Logger.Info("Purged expired URLs", "count", total, "expiredBefore", expiredBefore, "duration", time.Since(start))
+
+	if j.config.Idempotency != nil {
+		storedBefore := start.Add(-j.config.IdempotencyTTL)
+		keys, err := j.inBatches(ctx, "purged_idempotency_keys", func(limit int) (int64, error) {
+			return j.config.Idempotency.PurgeResponses(ctx, storedBefore, limit)
+		})
+		if err != nil {
+			return total, fmt.Errorf("purge stopped after %d Idempotency-Keys: %v", keys, err)
+		}
+		j.config.Logger.Info("Purged Idempotency-Keys", "count", keys, "storedBefore", storedBefore)
+	}
+
+	if j.config.Deliveries != nil && j.config.DeliveryRetention > 0 {
+		createdBefore := start.Add(-j.config.DeliveryRetention)
+		deliveries, err := j.inBatches(ctx, "purged_webhook_deliveries", func(limit int) (int64, error) {
+			return j.config.Deliveries.PurgeDeliveries(ctx, createdBefore, limit)
+		})
+		if err != nil {
+			return total, fmt.Errorf("purge stopped after %d webhook deliveries: %v", deliveries, err)
+		}
+		j.config.Logger.Info("Purged webhook deliveries", "count", deliveries, "createdBefore", createdBefore)
+	}
+	return total, nil
+}
+
+// purgeExpired archives one batch of URLs in the transaction of their link.expired events,
+// a failed emit leaves the whole batch for the next purge
+func (j *Janitor) purgeExpired(ctx context.Context, expiredBefore time.Time, limit int) (int64, error) {
+	var purged []*model.URL
+	work := func(ctx context.Context) error {
+		var err error
+		if purged, err = j.config.Purger.PurgeExpired(ctx, expiredBefore, limit); err != nil {
+			return err
+		}
+		if j.config.Events == nil {
+			return nil
+		}
+		for _, u := range purged {
+			if err := j.config.Events.Emit(ctx, webhook.EventLinkExpired, u.Public()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if j.config.Transactor != nil {
+		err = j.config.Transactor.InTx(ctx, work)
+	} else {
+		err = work(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(purged)), nil
+}
+
+// inBatches runs purge until it deletes less than a full batch, counting the deleted rows in the given metric.
+func (j *Janitor) inBatches(ctx context.Context, metric string, purge func(limit int) (int64, error)) (int64, error) {
+	var total int64
+	for {
+		purged, err := purge(j.config.BatchSize)
+		total += purged
+		metrics.Add(metric, purged)
+		if err != nil {
+			metrics.Add("errors", 1)
+			return total, err
+		}
+		if purged < int64(j.config.BatchSize) {
+			return total, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// MockPurger holds expiry dates of stored URLs
+type MockPurger struct {
+	Expiries []time.Time
+	Batches  []int64
+	Err      error
+}
+
+func (m *MockPurger) PurgeExpired(ctx context.Context, expiredBefore time.Time, limit int) ([]*model.URL, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	var kept []time.Time
+	var purged []*model.URL
+	for _, expiry := range m.Expiries {
+		if expiry.Before(expiredBefore) && len(purged) < limit {
+			purged = append(purged, &model.URL{Expiry: &expiry})
+			continue
+		}
+		kept = append(kept, expiry)
+	}
+	m.Expiries = kept
+	m.Batches = append(m.Batches, int64(len(purged)))
+	return purged, nil
+}
+
+// MockDeliveryPurger holds the creation times and statuses of webhook deliveries
+type MockDeliveryPurger struct {
+	Deliveries []model.Delivery
+}
+
+func (m *MockDeliveryPurger) PurgeDeliveries(ctx context.Context, createdBefore time.Time, limit int) (int64, error) {
+	var kept []model.Delivery
+	var purged int64
+	for _, d := range m.Deliveries {
+		if d.Status != model.DeliveryPending && d.CreatedAt.Before(createdBefore) && purged < int64(limit) {
+			purged++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	m.Deliveries = kept
+	return purged, nil
+}
+
+// MockEmitter records emitted events, or fails with Err
+type MockEmitter struct {
+	Events []string
+	Err    error
+}
+
+func (m *MockEmitter) Emit(ctx context.Context, event string, data any) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Events = append(m.Events, event)
+	return nil
+}
+
+// MockTransactor counts the transactions and those rolled back
+type MockTransactor struct {
+	Transactions, Rollbacks int
+}
+
+func (m *MockTransactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.Transactions++
+	err := fn(ctx)
+	if err != nil {
+		m.Rollbacks++
+	}
+	return err
+}
+
+// MockIdempotencyPurger holds the times responses were stored at
+type MockIdempotencyPurger struct {
+	Stored []time.Time
+}
+
+func (m *MockIdempotencyPurger) PurgeResponses(ctx context.Context, storedBefore time.Time, limit int) (int64, error) {
+	var kept []time.Time
+	var purged int64
+	for _, stored := range m.Stored {
+		if stored.Before(storedBefore) && purged < int64(limit) {
+			purged++
+			continue
+		}
+		kept = append(kept, stored)
+	}
+	m.Stored = kept
+	return purged, nil
+}
+
+func setupJanitor(purger *MockPurger) *Janitor {
+	return New(Config{
+		Logger:      mockLogger,
+		Purger:      purger,
+		Interval:    time.Hour,
+		GracePeriod: 24 * time.Hour,
+		BatchSize:   2,
+	})
+}
+
+func TestPurgeInBatches(t *testing.T) {
+	now := time.Now()
+	purger := &MockPurger{Expiries: []time.Time{
+		now.Add(-72 * time.Hour),
+		now.Add(-48 * time.Hour),
+		now.Add(-30 * time.Hour),
+		now.Add(-12 * time.Hour), // within the grace period
+		now.Add(time.Hour),       // still active
+	}}
+
+	purged, err := setupJanitor(purger).Purge(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), purged)
+	assert.Equal(t, []int64{2, 1}, purger.Batches)
+	assert.Len(t, purger.Expiries, 2)
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	now := time.Now()
+	idempotency := &MockIdempotencyPurger{Stored: []time.Time{
+		now.Add(-72 * time.Hour),
+		now.Add(-48 * time.Hour),
+		now.Add(-30 * time.Hour),
+		now.Add(-time.Hour), // still replayed
+	}}
+	janitor := setupJanitor(&MockPurger{})
+	janitor.config.Idempotency = idempotency
+	janitor.config.IdempotencyTTL = 24 * time.Hour
+
+	_, err := janitor.Purge(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Time{now.Add(-time.Hour)}, idempotency.Stored)
+}
+
+func TestPurgeEmitsExpiredEvents(t *testing.T) {
+	now := time.Now()
+	purger := &MockPurger{Expiries: []time.Time{
+		now.Add(-72 * time.Hour),
+		now.Add(-48 * time.Hour),
+		now.Add(-30 * time.Hour),
+		now.Add(time.Hour), // still active
+	}}
+	events := &MockEmitter{}
+	transactor := &MockTransactor{}
+	janitor := setupJanitor(purger)
+	janitor.config.Events = events
+	janitor.config.Transactor = transactor
+
+	purged, err := janitor.Purge(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), purged)
+	assert.Equal(t, []string{webhook.EventLinkExpired, webhook.EventLinkExpired, webhook.EventLinkExpired}, events.Events)
+	assert.Equal(t, 2, transactor.Transactions, "one transaction per batch")
+}
+
+func TestPurgeEmitErrorRollsBack(t *testing.T) {
+	purger := &MockPurger{Expiries: []time.Time{time.Now().Add(-48 * time.Hour)}}
+	transactor := &MockTransactor{}
+	janitor := setupJanitor(purger)
+	janitor.config.Events = &MockEmitter{Err: errors.New("connection lost")}
+	janitor.config.Transactor = transactor
+
+	purged, err := janitor.Purge(context.Background())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), purged, "the rolled back batch isn't counted")
+	assert.Equal(t, 1, transactor.Rollbacks)
+}
+
+func TestPurgeWebhookDeliveries(t *testing.T) {
+	now := time.Now()
+	deliveries := &MockDeliveryPurger{Deliveries: []model.Delivery{
+		{ID: 1, Status: model.DeliveryDelivered, CreatedAt: now.Add(-72 * time.Hour)},
+		{ID: 2, Status: model.DeliveryDead, CreatedAt: now.Add(-48 * time.Hour)},
+		{ID: 3, Status: model.DeliveryPending, CreatedAt: now.Add(-48 * time.Hour)}, // still retried
+		{ID: 4, Status: model.DeliveryDelivered, CreatedAt: now.Add(-time.Hour)},    // within the retention
+	}}
+	janitor := setupJanitor(&MockPurger{})
+	janitor.config.Deliveries = deliveries
+	janitor.config.DeliveryRetention = 24 * time.Hour
+
+	_, err := janitor.Purge(context.Background())
+
+	assert.Nil(t, err)
+	var kept []int64
+	for _, d := range deliveries.Deliveries {
+		kept = append(kept, d.ID)
+	}
+	assert.Equal(t, []int64{3, 4}, kept)
+}
+
+func TestPurgeError(t *testing.T) {
+	purger := &MockPurger{Err: errors.New("connection lost")}
+
+	_, err := setupJanitor(purger).Purge(context.Background())
+
+	assert.NotNil(t, err)
+}
+
+func TestRunStopsWithContext(t *testing.T) {
+	purger := &MockPurger{Expiries: []time.Time{time.Now().Add(-48 * time.Hour)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		setupJanitor(purger).Run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,207 @@
+package metadata
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/netguard"
+	"url-shortener/pkg/repository"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	maxBodySize = 1 << 20 // Metadata is in the head, no need to read further
+	userAgent   = "url-shortener-metadata/1.0"
+)
+
+type Config struct {
+	Logger        *slog.Logger
+	URLRepository repository.URLRepository
+	Workers       int           // Number of concurrent fetches
+	QueueSize     int           // Links waiting to be fetched, further links are dropped
+	Timeout       time.Duration // Limit for a whole fetch, redirects included
+	Client        *http.Client  // Optional, defaults to a client refusing non-public addresses
+}
+
+// Fetcher fetches the destination of new links in the background and stores its metadata
+type Fetcher struct {
+	logger  *slog.Logger
+	repo    repository.URLRepository
+	workers int
+	timeout time.Duration
+	client  *http.Client
+	queue   chan job
+}
+
+type job struct {
+	shortURL    string
+	originalURL string
+}
+
+func NewFetcher(config Config) *Fetcher {
+	client := config.Client
+	if client == nil {
+		client = netguard.Client(config.Timeout)
+	}
+	return &Fetcher{
+		logger:  config.Logger,
+		repo:    config.URLRepository,
+		workers: config.Workers,
+		timeout: config.Timeout,
+		client:  client,
+		queue:   make(chan job, config.QueueSize),
+	}
+}
+
+// Start runs the workers until the context is cancelled
+func (f *Fetcher) Start(ctx context.Context) {
+	for i := 0; i < f.workers; i++ {
+		go f.work(ctx)
+	}
+}
+
+// Enqueue schedules a fetch without blocking, it returns false when the queue is full
+func (f *Fetcher) Enqueue(shortURL, originalURL string) bool {
+	select {
+	case f.queue <- job{shortURL: shortURL, originalURL: originalURL}:
+		return true
+	default:
+		f.logger.Warn("Metadata queue is full, skipping fetch", "shortURL", shortURL)
+		return false
+	}
+}
+
+func (f *Fetcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-f.queue:
+			f.process(ctx, j)
+		}
+	}
+}
+
+func (f *Fetcher) process(ctx context.Context, j job) {
+	metadata, err := f.Fetch(ctx, j.originalURL)
+	if err != nil {
+		f.logger.Warn("Failed to fetch metadata", "shortURL", j.shortURL, "URL", j.originalURL, "error", err)
+		return
+	}
+	if err := f.repo.SaveMetadata(ctx, j.shortURL, metadata); err != nil {
+		f.logger.Error("Failed to save metadata", "shortURL", j.shortURL, "error", err)
+	}
+}
+
+// Fetch requests the page and extracts its metadata
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*model.Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	metadata := &model.Metadata{StatusCode: res.StatusCode, FetchedAt: time.Now()}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		parseHead(io.LimitReader(res.Body, maxBodySize), res.Request.URL, metadata)
+	}
+	metadata.Sanitize()
+	return metadata, nil
+}
+
+// parseHead reads the title, description and favicon from the head of the page
+func parseHead(body io.Reader, pageURL *url.URL, metadata *model.Metadata) {
+	var ogTitle, ogDescription, favicon string
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+
+loop:
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			break loop
+		case html.TextToken:
+			if inTitle && metadata.Title == "" {
+				metadata.Title = strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttributes := tokenizer.TagName()
+			attributes := map[string]string{}
+			for hasAttributes {
+				var key, value []byte
+				key, value, hasAttributes = tokenizer.TagAttr()
+				attributes[string(key)] = string(value)
+			}
+
+			switch string(name) {
+			case "title":
+				inTitle = tokenType == html.StartTagToken
+			case "body":
+				break loop
+			case "meta":
+				switch {
+				case strings.EqualFold(attributes["name"], "description"):
+					metadata.Description = strings.TrimSpace(attributes["content"])
+				case attributes["property"] == "og:title":
+					ogTitle = strings.TrimSpace(attributes["content"])
+				case attributes["property"] == "og:description":
+					ogDescription = strings.TrimSpace(attributes["content"])
+				}
+			case "link":
+				if isIconRel(attributes["rel"]) && favicon == "" {
+					favicon = attributes["href"]
+				}
+			}
+		}
+	}
+
+	if metadata.Title == "" {
+		metadata.Title = ogTitle
+	}
+	if metadata.Description == "" {
+		metadata.Description = ogDescription
+	}
+	if favicon == "" {
+		favicon = "/favicon.ico"
+	}
+	if faviconURL, err := pageURL.Parse(favicon); err == nil {
+		metadata.FaviconURL = faviconURL.String()
+	}
+}
+
+func isIconRel(rel string) bool {
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		if value == "icon" {
+			return true
+		}
+	}
+	return false
+}
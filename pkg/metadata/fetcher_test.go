@@ -0,0 +1,158 @@
+package metadata
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// MockURLRepository records the metadata saved by the fetcher
+type MockURLRepository struct {
+	repository.URLRepository
+	mu    sync.Mutex
+	saved map[string]*model.Metadata
+}
+
+func (m *MockURLRepository) SaveMetadata(ctx context.Context, shortURL string, metadata *model.Metadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saved[shortURL] = metadata
+	return nil
+}
+
+func (m *MockURLRepository) get(shortURL string) *model.Metadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saved[shortURL]
+}
+
+// setupFetcher uses a plain client, the default one refuses the loopback test server
+func setupFetcher(queueSize int) (*Fetcher, *MockURLRepository) {
+	repo := &MockURLRepository{saved: make(map[string]*model.Metadata)}
+	fetcher := NewFetcher(Config{
+		Logger:        mockLogger,
+		URLRepository: repo,
+		Workers:       2,
+		QueueSize:     queueSize,
+		Timeout:       time.Second,
+		Client:        &http.Client{Timeout: time.Second},
+	})
+	return fetcher, repo
+}
+
+const page = `<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title>
+  Example   Store
+</title>
+<meta name="description" content="Everything you need">
+<meta property="og:title" content="Ignored">
+<link rel="shortcut icon" href="/static/icon.png">
+</head>
+<body><title>Not the title</title></body></html>`
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/shop/", http.StatusMovedPermanently)
+		case "/shop/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, page)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	fetcher, _ := setupFetcher(1)
+
+	metadata, err := fetcher.Fetch(context.Background(), server.URL+"/old")
+	assert.Nil(t, err)
+	assert.Equal(t, "Example Store", metadata.Title)
+	assert.Equal(t, "Everything you need", metadata.Description)
+	assert.Equal(t, server.URL+"/static/icon.png", metadata.FaviconURL)
+	assert.Equal(t, http.StatusOK, metadata.StatusCode)
+	assert.False(t, metadata.FetchedAt.IsZero())
+}
+
+func TestFetch_Fallbacks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html><head><meta property="og:title" content="OG title"><meta property="og:description" content="OG description"></head></html>`)
+	}))
+	defer server.Close()
+	fetcher, _ := setupFetcher(1)
+
+	metadata, err := fetcher.Fetch(context.Background(), server.URL+"/page")
+	assert.Nil(t, err)
+	assert.Equal(t, "OG title", metadata.Title)
+	assert.Equal(t, "OG description", metadata.Description)
+	assert.Equal(t, server.URL+"/favicon.ico", metadata.FaviconURL)
+}
+
+func TestFetch_NotHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.WriteHeader(http.StatusGone)
+		io.WriteString(w, "<title>Not parsed</title>")
+	}))
+	defer server.Close()
+	fetcher, _ := setupFetcher(1)
+
+	metadata, err := fetcher.Fetch(context.Background(), server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGone, metadata.StatusCode)
+	assert.Empty(t, metadata.Title)
+	assert.Empty(t, metadata.FaviconURL)
+}
+
+func TestFetch_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	fetcher, _ := setupFetcher(1)
+	fetcher.timeout = 50 * time.Millisecond
+
+	_, err := fetcher.Fetch(context.Background(), server.URL)
+	assert.NotNil(t, err)
+}
+
+func TestEnqueue_SavesMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, page)
+	}))
+	defer server.Close()
+	fetcher, repo := setupFetcher(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetcher.Start(ctx)
+
+	assert.True(t, fetcher.Enqueue("http://short.com/r/abc123", server.URL))
+	assert.Eventually(t, func() bool { return repo.get("http://short.com/r/abc123") != nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Example Store", repo.get("http://short.com/r/abc123").Title)
+}
+
+func TestEnqueue_DropsWhenQueueIsFull(t *testing.T) {
+	fetcher, _ := setupFetcher(1)
+
+	assert.True(t, fetcher.Enqueue("http://short.com/r/abc123", "http://example.com"))
+	assert.False(t, fetcher.Enqueue("http://short.com/r/def456", "http://example.com"))
+}
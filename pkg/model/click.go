@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// Click is a visit of a short URL that was redirected
+type Click struct {
+	ShortURL    string    `json:"short_url"`
+	Destination string    `json:"destination"` // Where the visitor was sent
+	Referrer    string    `json:"referrer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Country     string    `json:"country,omitempty"` // ISO code resolved from the client address, when GeoIP is enabled
+	Variant     string    `json:"variant,omitempty"` // A/B variant the visitor was sent to
+	Time        time.Time `json:"time"`
+}
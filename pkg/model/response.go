@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// StoredResponse is a response kept to be replayed to clients retrying a request
+// with the same Idempotency-Key
+type StoredResponse struct {
+	RequestHash string // Identifies the request the response was produced for
+	StatusCode  int    // 0 while the request is still being processed
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
@@ -2,40 +2,454 @@ package model
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"url-shortener/pkg/netguard"
+	"url-shortener/pkg/useragent"
 )
 
 // URL represents the structure of stored URLs
 type URL struct {
-	OriginalURL string    `json:"original_url,omitempty"`
-	ShortURL    string    `json:"short_url,omitempty"`
-	Expiry      time.Time `json:"expiry,omitempty"`
-	ClickCount  int64     `json:"click_count,omitempty"`
+	OriginalURL        string     `json:"original_url,omitempty"`
+	ShortURL           string     `json:"short_url,omitempty"`
+	Expiry             *time.Time `json:"expiry,omitempty"` // nil for links that never expire
+	ClickCount         int64      `json:"click_count,omitempty"`
+	ExpiredRedirectURL string     `json:"expired_redirect_url,omitempty"` // Where visitors land once the link has expired
+	CreatedAt          time.Time  `json:"created_at"`
+	CanonicalURL       string     `json:"-"` // Form of OriginalURL the slug was generated from, empty under chosen prefixes
+
+	// Open Graph metadata shown by crawlers unfurling the short URL, instead of the destination's
+	OGTitle       string `json:"og_title,omitempty"`
+	OGDescription string `json:"og_description,omitempty"`
+	OGImage       string `json:"og_image,omitempty"`
+
+	CountryURLs map[string]string `json:"country_urls,omitempty"` // Destinations by ISO 3166-1 alpha-2 country code, overriding OriginalURL
+	DeviceRules []DeviceRule      `json:"device_rules,omitempty"` // Checked in order before CountryURLs, the first match wins
+
+	// Weighted destinations replacing OriginalURL for visitors without a device or country match
+	Variants       []Variant        `json:"variants,omitempty"`
+	StickyVariants bool             `json:"sticky_variants,omitempty"` // Visitors keep their variant through a cookie
+	VariantClicks  map[string]int64 `json:"variant_clicks,omitempty"`  // Clicks by variant name
+
+	UTM          *UTM `json:"utm,omitempty"`           // Added to the destination query, unless already there
+	ForwardQuery bool `json:"forward_query,omitempty"` // Pass the query of the short URL on to the destination, overriding its parameters
+	ForwardPath  bool `json:"forward_path,omitempty"`  // Serve the paths under the short URL, appending them to the destination path
+
+	RequireSignature bool `json:"require_signature,omitempty"` // Only redirect through access URLs signed by the API
+
+	Metadata *Metadata `json:"metadata,omitempty"` // Fetched from the destination after creation
+	Health   *Health   `json:"health,omitempty"`   // Result of the latest destination check
+}
+
+// DeviceRule sends visitors on a platform to their own destination, such as an app store or a deep link.
+// Empty fields match any value.
+type DeviceRule struct {
+	OS     string `json:"os,omitempty"`     // ios, android, windows, macos, linux or other
+	Device string `json:"device,omitempty"` // mobile, tablet or desktop
+	URL    string `json:"url"`              // May use one of the allowed deep link schemes
+}
+
+var (
+	ruleOSes    = []string{useragent.OSiOS, useragent.OSAndroid, useragent.OSWindows, useragent.OSMacOS, useragent.OSLinux, useragent.OSOther}
+	ruleDevices = []string{useragent.DeviceMobile, useragent.DeviceTablet, useragent.DeviceDesktop}
+)
+
+// UTM holds the campaign parameters added to the destination of a link
+type UTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// Values returns the non-empty parameters as utm_source, utm_medium...
+func (u *UTM) Values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"utm_source":   u.Source,
+		"utm_medium":   u.Medium,
+		"utm_campaign": u.Campaign,
+		"utm_term":     u.Term,
+		"utm_content":  u.Content,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+// Variant is one of the destinations a link rotates between
+type Variant struct {
+	Name   string `json:"name"` // Defaults to a, b, c... in order
+	URL    string `json:"url"`
+	Weight int    `json:"weight"` // Relative share of visitors, defaults to 1
+}
+
+// maxVariants bounds the destinations of a link
+const maxVariants = 26
+
+// Visitor describes who follows a link, to pick its destination
+type Visitor struct {
+	Country string
+	OS      string
+	Device  string
+	Variant string // Variant assigned to the visitor, see PickVariant
+}
+
+// Metadata describes the destination page of a link
+type Metadata struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	FaviconURL  string    `json:"favicon_url,omitempty"`
+	StatusCode  int       `json:"status_code,omitempty"` // Status of the final response, after redirects
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Health is the result of the latest check of a link's destinations
+type Health struct {
+	URL            string    `json:"url,omitempty"`         // Destination the result is about, the first failing one
+	StatusCode     int       `json:"status_code,omitempty"` // 0 when no response was received
+	Error          string    `json:"error,omitempty"`
+	ResponseTimeMS int64     `json:"response_time_ms"`
+	Redirects      []string  `json:"redirects,omitempty"` // URLs redirected to, in order
+	Failures       int       `json:"consecutive_failures"`
+	Broken         bool      `json:"broken"` // Set after too many consecutive failures
+	CheckedAt      time.Time `json:"checked_at"`
+}
+
+// Sanitize trims the fetched fields to storable lengths and drops favicons that aren't web URLs.
+func (m *Metadata) Sanitize() {
+	m.Title = truncate(strings.TrimSpace(m.Title), 300)
+	m.Description = truncate(strings.TrimSpace(m.Description), 1000)
+	if !strings.HasPrefix(m.FaviconURL, "http://") && !strings.HasPrefix(m.FaviconURL, "https://") {
+		m.FaviconURL = ""
+	}
+	m.FaviconURL = truncate(m.FaviconURL, 2048)
+}
+
+// HasOpenGraph reports whether the link carries its own Open Graph metadata.
+func (u *URL) HasOpenGraph() bool {
+	return u.OGTitle != "" || u.OGDescription != "" || u.OGImage != ""
+}
+
+// Redacted returns a copy of the link without its destinations, nor the destination
+// metadata, redirect chain and check error that would give them away.
+func (u *URL) Redacted() *URL {
+	redacted := *u
+	redacted.OriginalURL = ""
+	redacted.CountryURLs = nil
+	redacted.DeviceRules = nil
+	redacted.Variants = make([]Variant, len(u.Variants))
+	for i, variant := range u.Variants {
+		variant.URL = ""
+		redacted.Variants[i] = variant
+	}
+	redacted.Metadata = nil
+	if u.Health != nil {
+		health := *u.Health
+		health.URL = ""
+		health.Redirects = nil
+		health.Error = ""
+		redacted.Health = &health
+	}
+	return &redacted
+}
+
+// Public returns the link as anyone may see it: links requiring a signature are redacted.
+func (u *URL) Public() *URL {
+	if !u.RequireSignature {
+		return u
+	}
+	return u.Redacted()
+}
+
+// IsExpired reports whether the link has expired at the given time.
+func (u *URL) IsExpired(now time.Time) bool {
+	return u.Expiry != nil && now.After(*u.Expiry)
 }
 
 // Sanitize cleans and validates the URL structure to prevent injection and ensure data integrity.
-func (u *URL) Sanitize() error {
+// Device rules may send visitors to web URLs and to the given deep link schemes.
+func (u *URL) Sanitize(schemes DeepLinkSchemes) error {
 	if u.OriginalURL == "" {
 		return errors.New("original URL is empty")
 	}
 
-	if !strings.HasPrefix(u.OriginalURL, "http") && !strings.HasPrefix(u.OriginalURL, "https") {
-		return errors.New("unsupported URL scheme")
+	originalURL, err := sanitizeURL(u.OriginalURL)
+	if err != nil {
+		return err
 	}
+	u.OriginalURL = originalURL
 
-	parsedURL, err := url.ParseRequestURI(u.OriginalURL)
-	if err != nil {
+	if u.ExpiredRedirectURL != "" {
+		expiredRedirectURL, err := sanitizeURL(u.ExpiredRedirectURL)
+		if err != nil {
+			return err
+		}
+		u.ExpiredRedirectURL = expiredRedirectURL
+	}
+
+	if u.OGImage != "" {
+		ogImage, err := sanitizeURL(u.OGImage)
+		if err != nil {
+			return err
+		}
+		u.OGImage = ogImage
+	}
+	if len(u.CountryURLs) > 0 {
+		countryURLs := make(map[string]string, len(u.CountryURLs))
+		for country, destination := range u.CountryURLs {
+			code := strings.ToUpper(strings.TrimSpace(country))
+			if !isCountryCode(code) {
+				return fmt.Errorf("invalid country code %q", country)
+			}
+			destination, err := sanitizeURL(destination)
+			if err != nil {
+				return fmt.Errorf("invalid destination for %s: %v", code, err)
+			}
+			countryURLs[code] = destination
+		}
+		u.CountryURLs = countryURLs
+	}
+
+	for i := range u.DeviceRules {
+		rule := &u.DeviceRules[i]
+		rule.OS = strings.ToLower(strings.TrimSpace(rule.OS))
+		rule.Device = strings.ToLower(strings.TrimSpace(rule.Device))
+		if rule.OS != "" && !slices.Contains(ruleOSes, rule.OS) {
+			return fmt.Errorf("invalid device rule OS %q", rule.OS)
+		}
+		if rule.Device != "" && !slices.Contains(ruleDevices, rule.Device) {
+			return fmt.Errorf("invalid device rule device %q", rule.Device)
+		}
+		destination, err := sanitizeDeepLink(rule.URL, schemes)
+		if err != nil {
+			return fmt.Errorf("invalid device rule destination: %v", err)
+		}
+		rule.URL = destination
+	}
+
+	if err := u.sanitizeVariants(); err != nil {
 		return err
 	}
 
-	u.OriginalURL = parsedURL.String()
+	if u.UTM != nil {
+		for _, value := range []*string{&u.UTM.Source, &u.UTM.Medium, &u.UTM.Campaign, &u.UTM.Term, &u.UTM.Content} {
+			*value = truncate(strings.TrimSpace(*value), 200)
+		}
+		if len(u.UTM.Values()) == 0 {
+			u.UTM = nil
+		}
+	}
 
-	// Truncate data to prevent overly long URLs
-	if len(u.OriginalURL) > 2048 {
-		u.OriginalURL = u.OriginalURL[:2048]
+	u.OGTitle = truncate(strings.TrimSpace(u.OGTitle), 300)
+	u.OGDescription = truncate(strings.TrimSpace(u.OGDescription), 1000)
+
+	return nil
+}
+
+func (u *URL) sanitizeVariants() error {
+	if len(u.Variants) > maxVariants {
+		return fmt.Errorf("a link can have at most %d variants", maxVariants)
 	}
+	names := make(map[string]bool, len(u.Variants))
+	for i := range u.Variants {
+		variant := &u.Variants[i]
+		variant.Name = strings.TrimSpace(variant.Name)
+		if variant.Name == "" {
+			variant.Name = string(rune('a' + i))
+		}
+		if !isVariantName(variant.Name) {
+			return fmt.Errorf("invalid variant name %q, use up to 32 letters, digits, - and _", variant.Name)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("duplicate variant name %q", variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight == 0 {
+			variant.Weight = 1
+		}
+		if variant.Weight < 0 {
+			return fmt.Errorf("negative weight for variant %q", variant.Name)
+		}
+		destination, err := sanitizeURL(variant.URL)
+		if err != nil {
+			return fmt.Errorf("invalid destination for variant %q: %v", variant.Name, err)
+		}
+		variant.URL = destination
+	}
+	return nil
+}
+
+// isVariantName keeps names usable as cookie values
+func isVariantName(name string) bool {
+	if len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
 
+// Variant returns the variant with the given name, or nil
+func (u *URL) Variant(name string) *Variant {
+	for i := range u.Variants {
+		if u.Variants[i].Name == name {
+			return &u.Variants[i]
+		}
+	}
 	return nil
 }
+
+// PickVariant returns the name of a variant chosen by weight, for a uniform random
+// number in [0, 1), or "" when the link has no variants.
+func (u *URL) PickVariant(random float64) string {
+	total := 0
+	for _, variant := range u.Variants {
+		total += variant.Weight
+	}
+	target := int(random * float64(total))
+	for _, variant := range u.Variants {
+		if target < variant.Weight {
+			return variant.Name
+		}
+		target -= variant.Weight
+	}
+	return ""
+}
+
+// Destination returns where the visitor is sent: the first matching device rule,
+// then the destination of their country, then their variant, then OriginalURL.
+// The variant is returned when its destination is used.
+func (u *URL) Destination(visitor Visitor) (destination string, variant string) {
+	for _, rule := range u.DeviceRules {
+		if (rule.OS == "" || rule.OS == visitor.OS) && (rule.Device == "" || rule.Device == visitor.Device) {
+			return rule.URL, ""
+		}
+	}
+	if destination, ok := u.CountryURLs[visitor.Country]; ok && visitor.Country != "" {
+		return destination, ""
+	}
+	if v := u.Variant(visitor.Variant); v != nil {
+		return v.URL, v.Name
+	}
+	return u.OriginalURL, ""
+}
+
+// Destinations returns every distinct web destination of the link: the original URL, then
+// the variants, the per-country URLs by country code and the device rules. Deep links
+// to apps are left out, they can't be requested.
+func (u *URL) Destinations() []string {
+	destinations := []string{u.OriginalURL}
+	add := func(destination string) {
+		if (strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://")) && !slices.Contains(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+	for _, v := range u.Variants {
+		add(v.URL)
+	}
+	countries := make([]string, 0, len(u.CountryURLs))
+	for country := range u.CountryURLs {
+		countries = append(countries, country)
+	}
+	slices.Sort(countries)
+	for _, country := range countries {
+		add(u.CountryURLs[country])
+	}
+	for _, rule := range u.DeviceRules {
+		add(rule.URL)
+	}
+	return destinations
+}
+
+func isCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+// truncate cuts s to at most max bytes without splitting a UTF-8 character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// DeepLinkSchemes are the custom schemes, such as "myapp", that device rules may send visitors to
+type DeepLinkSchemes map[string]bool
+
+// unsafeSchemes can run code in the browser and are never allowed as deep links
+var unsafeSchemes = map[string]bool{"javascript": true, "data": true, "vbscript": true, "file": true, "blob": true}
+
+// ParseDeepLinkSchemes normalizes configured deep link schemes, refusing the ones that can run code.
+func ParseDeepLinkSchemes(schemes []string) (DeepLinkSchemes, error) {
+	allowed := make(DeepLinkSchemes, len(schemes))
+	for _, scheme := range schemes {
+		scheme = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(scheme), "://"))
+		if scheme == "" {
+			continue
+		}
+		if unsafeSchemes[scheme] {
+			return nil, fmt.Errorf("scheme %q can't be used for deep links", scheme)
+		}
+		allowed[scheme] = true
+	}
+	return allowed, nil
+}
+
+// sanitizeDeepLink accepts web URLs and URLs with an allowed deep link scheme
+func sanitizeDeepLink(rawURL string, schemes DeepLinkSchemes) (string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(parsedURL.Scheme)
+	if scheme == "http" || scheme == "https" {
+		return sanitizeURL(rawURL)
+	}
+	if !schemes[scheme] {
+		return "", fmt.Errorf("unsupported URL scheme %q", parsedURL.Scheme)
+	}
+	if len(rawURL) > 2048 {
+		return "", errors.New("deep link is too long")
+	}
+	return parsedURL.String(), nil
+}
+
+func sanitizeURL(rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "http") && !strings.HasPrefix(rawURL, "https") {
+		return "", errors.New("unsupported URL scheme")
+	}
+
+	parsedURL, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	// Links to internal services would let the shortener be used to reach them
+	if err := netguard.CheckHost(parsedURL.Hostname()); err != nil {
+		return "", err
+	}
+
+	sanitized := parsedURL.String()
+
+	// Truncate data to prevent overly long URLs
+	if len(sanitized) > 2048 {
+		sanitized = sanitized[:2048]
+	}
+
+	return sanitized, nil
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead" // Given up after too many failed attempts
+)
+
+// Subscription is an endpoint notified of link events
+type Subscription struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // Signs deliveries, only returned when the subscription is created
+	Events    []string  `json:"events"`           // Subscribed event types, empty for all of them
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Sanitize validates the endpoint URL.
+func (s *Subscription) Sanitize() error {
+	if s.URL == "" {
+		return errors.New("webhook URL is empty")
+	}
+	url, err := sanitizeURL(s.URL)
+	if err != nil {
+		return err
+	}
+	s.URL = url
+	return nil
+}
+
+// Delivery is one event sent to one subscription, kept as the delivery log
+type Delivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int64           `json:"subscription_id"`
+	EventID        string          `json:"event_id"` // Same for every delivery of an event, lets receivers drop duplicates
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+
+	// Endpoint of the subscription, loaded with deliveries to send
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
@@ -0,0 +1,95 @@
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxRedirects is the number of redirects followed by Client
+const MaxRedirects = 5
+
+// ErrPrivateAddress is returned for hosts resolving to loopback, private or otherwise internal addresses
+var ErrPrivateAddress = errors.New("address is not public")
+
+// IsPublic reports whether the address is routable on the internet
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, not covered by IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// CheckHost rejects hosts that are obviously internal without resolving them:
+// IP literals of non-public addresses and localhost names
+func CheckHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%s: %w", host, ErrPrivateAddress)
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return nil
+	}
+	if !IsPublic(addr) {
+		return fmt.Errorf("%s: %w", host, ErrPrivateAddress)
+	}
+	return nil
+}
+
+// Dialer returns a dialer refusing to connect to non-public addresses.
+// The check runs on the resolved address, so DNS names pointing inside are caught as well.
+func Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !IsPublic(addrPort.Addr()) {
+				return fmt.Errorf("%s: %w", address, ErrPrivateAddress)
+			}
+			return nil
+		},
+	}
+}
+
+// Client returns an HTTP client that only connects to public addresses,
+// so user-supplied URLs can't be used to reach internal services
+func Client(timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		Proxy:                 nil, // A proxy would connect on our behalf, bypassing the address check
+		DialContext:           Dialer(timeout).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   2,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", MaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect to %s", req.URL.Scheme)
+			}
+			return CheckHost(req.URL.Hostname())
+		},
+	}
+}
@@ -0,0 +1,107 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	testCases := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tc := range testCases {
+		if public := IsPublic(netip.MustParseAddr(tc.addr)); public != tc.public {
+			t.Errorf("IsPublic(%s) = %v; want %v", tc.addr, public, tc.public)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	testCases := []struct {
+		host  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"93.184.216.34", true},
+		{"localhost", false},
+		{"LOCALHOST.", false},
+		{"api.localhost", false},
+		{"127.0.0.1", false},
+		{"[::1]", false},
+		{"169.254.169.254", false},
+	}
+
+	for _, tc := range testCases {
+		err := CheckHost(tc.host)
+		if (err == nil) != tc.valid {
+			t.Errorf("CheckHost(%q) = %v; want valid %v", tc.host, err, tc.valid)
+		}
+		if err != nil && !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("CheckHost(%q) = %v; want ErrPrivateAddress", tc.host, err)
+		}
+	}
+}
+
+func TestDialerRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(nil)
+	defer server.Close()
+
+	_, err := Dialer(time.Second).DialContext(context.Background(), "tcp", server.Listener.Addr().String())
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected a net.OpError, got %T", err)
+	}
+}
+
+func TestClient_RefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private address was reached")
+	}))
+	defer server.Close()
+
+	_, err := Client(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+}
+
+func TestClient_RefusesRedirectsToPrivateHosts(t *testing.T) {
+	client := Client(time.Second)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/admin", nil)
+	err := client.CheckRedirect(req, []*http.Request{httptest.NewRequest(http.MethodGet, "http://example.com", nil)})
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err := client.CheckRedirect(req, make([]*http.Request, MaxRedirects)); err == nil {
+		t.Error("expected redirects past MaxRedirects to be refused")
+	}
+}
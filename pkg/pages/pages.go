@@ -0,0 +1,64 @@
+package pages
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// Renderer renders the HTML pages served to browsers.
+type Renderer struct {
+	templates map[string]*template.Template
+}
+
+// New parses the built-in templates and, when dir is set, any *.html file in it.
+// A file on disk replaces the built-in template of the same name.
+func New(dir string) (*Renderer, error) {
+	templates := make(map[string]*template.Template)
+
+	defaults, err := fs.Glob(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("error listing built-in templates: %v", err)
+	}
+	for _, file := range defaults {
+		tmpl, err := template.ParseFS(defaultTemplates, file)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing built-in template %s: %v", file, err)
+		}
+		templates[path.Base(file)] = tmpl
+	}
+
+	if dir != "" {
+		overrides, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, fmt.Errorf("error listing templates in %s: %v", dir, err)
+		}
+		for _, file := range overrides {
+			tmpl, err := template.ParseFiles(file)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing template %s: %v", file, err)
+			}
+			templates[filepath.Base(file)] = tmpl
+		}
+	}
+
+	return &Renderer{templates: templates}, nil
+}
+
+// Render writes the named template with the given status code.
+func (r *Renderer) Render(w http.ResponseWriter, name string, status int, data any) error {
+	tmpl, ok := r.templates[name]
+	if !ok {
+		return fmt.Errorf("template %s not found", name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	return tmpl.Execute(w, data)
+}
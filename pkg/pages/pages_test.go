@@ -0,0 +1,74 @@
+package pages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderBuiltInTemplate(t *testing.T) {
+	renderer, err := New("")
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	err = renderer.Render(recorder, "not_found.html", http.StatusNotFound, map[string]string{"ShortURL": "tiny.io/r/<abc>"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "tiny.io/r/&lt;abc&gt;")
+}
+
+func TestRenderErrorTemplate(t *testing.T) {
+	renderer, err := New("")
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	err = renderer.Render(recorder, "error.html", http.StatusForbidden, map[string]string{
+		"ShortURL": "tiny.io/r/abc123",
+		"Title":    "Forbidden",
+		"Detail":   "Access URL expired",
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<h1>Forbidden</h1>")
+	assert.Contains(t, recorder.Body.String(), "Access URL expired")
+}
+
+func TestRenderOverriddenTemplate(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "expired.html"), []byte(`<p>Branded {{.ShortURL}}</p>`), 0o644)
+	assert.Nil(t, err)
+
+	renderer, err := New(dir)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	err = renderer.Render(recorder, "expired.html", http.StatusGone, map[string]string{"ShortURL": "tiny.io/r/abc123"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusGone, recorder.Code)
+	assert.Equal(t, "<p>Branded tiny.io/r/abc123</p>", recorder.Body.String())
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	renderer, err := New("")
+	assert.Nil(t, err)
+
+	err = renderer.Render(httptest.NewRecorder(), "missing.html", http.StatusOK, nil)
+	assert.NotNil(t, err)
+}
+
+func TestNewInvalidOverride(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "expired.html"), []byte(`{{.ShortURL`), 0o644)
+	assert.Nil(t, err)
+
+	_, err = New(dir)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,210 @@
+package qr
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "image/jpeg" // Logos may be JPEG files
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	MinSize   = 64
+	MaxSize   = 2048
+	MaxMargin = 16
+
+	logoRatio = 5 // The logo covers 1/logoRatio of the code width
+)
+
+// Options controls how a QR code is rendered
+type Options struct {
+	Size       int // Width and height in pixels, only used for PNG
+	Level      qrcode.RecoveryLevel
+	Margin     int // Quiet zone around the code, in modules
+	Foreground color.RGBA
+	Background color.RGBA
+	Logo       image.Image // Optional, drawn at the center of the code
+}
+
+// DefaultOptions returns black on white options readable by most scanners
+func DefaultOptions() Options {
+	return Options{
+		Size:       256,
+		Level:      qrcode.Medium,
+		Margin:     4,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+}
+
+// ParseLevel parses an error correction level: L, M, Q or H
+func ParseLevel(level string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return qrcode.Low, nil
+	case "M":
+		return qrcode.Medium, nil
+	case "Q":
+		return qrcode.High, nil
+	case "H":
+		return qrcode.Highest, nil
+	default:
+		return 0, fmt.Errorf("invalid error correction level %q, use L, M, Q or H", level)
+	}
+}
+
+// ParseColor parses a hex color such as "ff8800" or "#ff8800cc"
+func ParseColor(hex string) (color.RGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, use RRGGBB or RRGGBBAA", hex)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, use RRGGBB or RRGGBBAA", hex)
+	}
+	if len(hex) == 6 {
+		value = value<<8 | 0xff
+	}
+	return color.RGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// LoadLogo reads a PNG or JPEG logo
+func LoadLogo(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	logo, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding logo %s: %v", path, err)
+	}
+	return logo, nil
+}
+
+// Validate checks the options are within the supported bounds
+func (o Options) Validate() error {
+	if o.Size < MinSize || o.Size > MaxSize {
+		return fmt.Errorf("size must be between %d and %d", MinSize, MaxSize)
+	}
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return fmt.Errorf("margin must be between 0 and %d", MaxMargin)
+	}
+	return nil
+}
+
+// PNG writes the QR code of content as a PNG image
+func PNG(w io.Writer, content string, options Options) error {
+	modules, err := encode(content, options)
+	if err != nil {
+		return err
+	}
+
+	total := len(modules) + 2*options.Margin
+	img := image.NewRGBA(image.Rect(0, 0, options.Size, options.Size))
+	for y := 0; y < options.Size; y++ {
+		for x := 0; x < options.Size; x++ {
+			img.SetRGBA(x, y, options.Background)
+			row, col := y*total/options.Size-options.Margin, x*total/options.Size-options.Margin
+			if row >= 0 && row < len(modules) && col >= 0 && col < len(modules) && modules[row][col] {
+				img.SetRGBA(x, y, options.Foreground)
+			}
+		}
+	}
+
+	if options.Logo != nil {
+		drawLogo(img, options)
+	}
+	return png.Encode(w, img)
+}
+
+// SVG writes the QR code of content as an SVG image, scaled to its viewport
+func SVG(w io.Writer, content string, options Options) error {
+	modules, err := encode(content, options)
+	if err != nil {
+		return err
+	}
+
+	total := len(modules) + 2*options.Margin
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges">`, total, total, options.Size, options.Size)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" %s/>`, total, total, svgFill(options.Background))
+	svg.WriteString(`<path d="`)
+	for row, line := range modules {
+		for col, dark := range line {
+			if dark {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", col+options.Margin, row+options.Margin)
+			}
+		}
+	}
+	fmt.Fprintf(&svg, `" %s/>`, svgFill(options.Foreground))
+
+	if options.Logo != nil {
+		var logo strings.Builder
+		encoder := base64.NewEncoder(base64.StdEncoding, &logo)
+		if err := png.Encode(encoder, options.Logo); err != nil {
+			return err
+		}
+		encoder.Close()
+		box := float64(len(modules)) / logoRatio
+		offset := (float64(total) - box) / 2
+		fmt.Fprintf(&svg, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" %s/>`, offset, offset, box, box, svgFill(options.Background))
+		fmt.Fprintf(&svg, `<image x="%.2f" y="%.2f" width="%.2f" height="%.2f" href="data:image/png;base64,%s"/>`, offset, offset, box, box, logo.String())
+	}
+	svg.WriteString("</svg>\n")
+
+	_, err = io.WriteString(w, svg.String())
+	return err
+}
+
+// encode returns the dark modules of the code, without quiet zone
+func encode(content string, options Options) ([][]bool, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if content == "" {
+		return nil, errors.New("content is empty")
+	}
+
+	level := options.Level
+	if options.Logo != nil {
+		// The logo hides part of the code, only the highest level recovers from it reliably
+		level = qrcode.Highest
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	return code.Bitmap(), nil
+}
+
+// drawLogo scales the logo to the center of the image, over a background square
+func drawLogo(img *image.RGBA, options Options) {
+	box := options.Size / logoRatio
+	offset := (options.Size - box) / 2
+	bounds := options.Logo.Bounds()
+	for y := 0; y < box; y++ {
+		for x := 0; x < box; x++ {
+			img.SetRGBA(offset+x, offset+y, options.Background)
+			c := options.Logo.At(bounds.Min.X+x*bounds.Dx()/box, bounds.Min.Y+y*bounds.Dy()/box)
+			if _, _, _, a := c.RGBA(); a > 0 {
+				img.Set(offset+x, offset+y, c)
+			}
+		}
+	}
+}
+
+func svgFill(c color.RGBA) string {
+	return fmt.Sprintf(`fill="#%02x%02x%02x" fill-opacity="%.3f"`, c.R, c.G, c.B, float64(c.A)/0xff)
+}
@@ -0,0 +1,129 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+)
+
+const content = "http://tiny.io/r/abc123"
+
+func TestPNG(t *testing.T) {
+	options := DefaultOptions()
+	options.Foreground = color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff}
+	var out bytes.Buffer
+
+	err := PNG(&out, content, options)
+	assert.Nil(t, err)
+
+	img, err := png.Decode(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 256, 256), img.Bounds())
+
+	modules := len(bitmap(t, qrcode.Medium))
+	total := modules + 2*options.Margin
+	moduleSize := 256 / total
+	// The quiet zone is background, the finder pattern starts right after it
+	assert.Equal(t, options.Background, color.RGBAModel.Convert(img.At(0, 0)))
+	finder := options.Margin*256/total + moduleSize/2
+	assert.Equal(t, options.Foreground, color.RGBAModel.Convert(img.At(finder, finder)))
+}
+
+func TestPNGWithLogo(t *testing.T) {
+	logo := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	red := color.RGBA{R: 0xff, A: 0xff}
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			logo.SetRGBA(x, y, red)
+		}
+	}
+	options := DefaultOptions()
+	options.Logo = logo
+	var out bytes.Buffer
+
+	err := PNG(&out, content, options)
+	assert.Nil(t, err)
+
+	img, err := png.Decode(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, red, color.RGBAModel.Convert(img.At(128, 128)))
+}
+
+func TestSVG(t *testing.T) {
+	options := DefaultOptions()
+	options.Margin = 2
+	options.Background = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0}
+	var out bytes.Buffer
+
+	err := SVG(&out, content, options)
+	assert.Nil(t, err)
+
+	total := len(bitmap(t, qrcode.Medium)) + 4
+	svg := out.String()
+	assert.True(t, strings.HasPrefix(svg, "<svg "))
+	assert.Contains(t, svg, fmt.Sprintf(`viewBox="0 0 %d %d"`, total, total))
+	assert.Contains(t, svg, `width="256"`)
+	assert.Contains(t, svg, "M2 2h1v1h-1z")
+	assert.Contains(t, svg, `fill="#ffffff" fill-opacity="0.000"`)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	testCases := []func(*Options){
+		func(o *Options) { o.Size = 10 },
+		func(o *Options) { o.Size = 10000 },
+		func(o *Options) { o.Margin = -1 },
+		func(o *Options) { o.Margin = 100 },
+	}
+
+	for _, change := range testCases {
+		options := DefaultOptions()
+		change(&options)
+		assert.NotNil(t, PNG(&bytes.Buffer{}, content, options))
+		assert.NotNil(t, SVG(&bytes.Buffer{}, content, options))
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	testCases := map[string]qrcode.RecoveryLevel{"L": qrcode.Low, "m": qrcode.Medium, "Q": qrcode.High, "h": qrcode.Highest}
+	for input, expected := range testCases {
+		level, err := ParseLevel(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, level)
+	}
+
+	_, err := ParseLevel("X")
+	assert.NotNil(t, err)
+}
+
+func TestParseColor(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected color.RGBA
+		valid    bool
+	}{
+		{"ff8800", color.RGBA{R: 0xff, G: 0x88, A: 0xff}, true},
+		{"#FF880080", color.RGBA{R: 0xff, G: 0x88, A: 0x80}, true},
+		{"f80", color.RGBA{}, false},
+		{"gggggg", color.RGBA{}, false},
+	}
+
+	for _, tc := range testCases {
+		c, err := ParseColor(tc.input)
+		assert.Equal(t, tc.valid, err == nil, tc.input)
+		assert.Equal(t, tc.expected, c, tc.input)
+	}
+}
+
+func bitmap(t *testing.T, level qrcode.RecoveryLevel) [][]bool {
+	code, err := qrcode.New(content, level)
+	assert.Nil(t, err)
+	code.DisableBorder = true
+	return code.Bitmap()
+}
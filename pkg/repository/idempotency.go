@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"url-shortener/pkg/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresIdempotencyRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresIdempotencyRepository(db *pgxpool.Pool) IdempotencyRepository {
+	return &PostgresIdempotencyRepository{db: db}
+}
+
+func (r *PostgresIdempotencyRepository) Reserve(ctx context.Context, key, requestHash string, reservedAt, storedAfter, startedAfter time.Time) (bool, error) {
+	// Keys stored too long ago, and requests in progress for too long, are free again
+	query := `INSERT INTO idempotency_keys (key, request_hash, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = NULL, body = NULL,
+			created_at = EXCLUDED.created_at
+		WHERE idempotency_keys.created_at <= $4 OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at <= $5)`
+	tag, err := r.db.Exec(ctx, query, key, requestHash, reservedAt, storedAfter, startedAfter)
+	if err != nil {
+		return false, fmt.Errorf("error reserving idempotency key: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresIdempotencyRepository) FindResponse(ctx context.Context, key string, storedAfter time.Time) (*model.StoredResponse, error) {
+	query := `SELECT request_hash, COALESCE(status_code, 0), COALESCE(content_type, ''), COALESCE(body, ''), created_at
+		FROM idempotency_keys WHERE key = $1 AND created_at > $2`
+	var response model.StoredResponse
+	err := r.db.QueryRow(ctx, query, key, storedAfter).Scan(&response.RequestHash, &response.StatusCode, &response.ContentType, &response.Body, &response.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving stored response: %v", err)
+	}
+	return &response, nil
+}
+
+func (r *PostgresIdempotencyRepository) SaveResponse(ctx context.Context, key string, response *model.StoredResponse) error {
+	query := `INSERT INTO idempotency_keys (key, request_hash, status_code, content_type, body, created_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status_code = EXCLUDED.status_code, content_type = EXCLUDED.content_type, body = EXCLUDED.body, created_at = EXCLUDED.created_at`
+	_, err := r.db.Exec(ctx, query, key, response.RequestHash, response.StatusCode, response.ContentType, response.Body, response.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error saving stored response: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresIdempotencyRepository) Release(ctx context.Context, key string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND status_code IS NULL`, key)
+	if err != nil {
+		return fmt.Errorf("error releasing idempotency key: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresIdempotencyRepository) PurgeResponses(ctx context.Context, storedBefore time.Time, limit int) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE key IN (
+		SELECT key FROM idempotency_keys WHERE created_at < $1 ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED
+	)`
+	tag, err := r.db.Exec(ctx, query, storedBefore, limit)
+	if err != nil {
+		return 0, fmt.Errorf("error purging idempotency keys: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
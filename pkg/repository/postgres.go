@@ -2,61 +2,321 @@ package repository
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"url-shortener/pkg/model"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type PostgresURLRepository struct {
-	db *pgx.Conn // to replace with pool for scaling
+	db              *pgxpool.Pool
+	gracePeriod     time.Duration         // How long expired URLs keep their short URL, as long as the janitor keeps them
+	deepLinkSchemes model.DeepLinkSchemes // Custom schemes device rules may send visitors to
 }
 
-func NewPostgresURLRepository(db *pgx.Conn) URLRepository {
-	return &PostgresURLRepository{db: db}
+func NewPostgresURLRepository(db *pgxpool.Pool, gracePeriod time.Duration, deepLinkSchemes model.DeepLinkSchemes) URLRepository {
+	return &PostgresURLRepository{db: db, gracePeriod: gracePeriod, deepLinkSchemes: deepLinkSchemes}
+}
+
+// saveQuery only overwrites rows that expired before the cutoff passed as $6, so live links keep their stats
+// and recently expired ones keep serving their expired_redirect_url until the grace period is over.
+// The metadata and health of the previous link are cleared, they describe another destination.
+const saveQuery = `INSERT INTO urls (short_url, original_url, expiry, click_count, expired_redirect_url, created_at, og_title, og_description, og_image,
+		country_urls, device_rules, variants, sticky_variants, variant_clicks, utm, forward_query, forward_path, require_signature, canonical_url)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), $11, $12, $13, $14, $15, $16, $17, $18, $19, NULLIF($20, ''))
+	ON CONFLICT (short_url) DO UPDATE SET original_url = EXCLUDED.original_url, expiry = EXCLUDED.expiry, click_count = EXCLUDED.click_count,
+		expired_redirect_url = EXCLUDED.expired_redirect_url, created_at = EXCLUDED.created_at, og_title = EXCLUDED.og_title,
+		og_description = EXCLUDED.og_description, og_image = EXCLUDED.og_image, country_urls = EXCLUDED.country_urls,
+		device_rules = EXCLUDED.device_rules, variants = EXCLUDED.variants, sticky_variants = EXCLUDED.sticky_variants,
+		variant_clicks = EXCLUDED.variant_clicks, utm = EXCLUDED.utm, forward_query = EXCLUDED.forward_query,
+		forward_path = EXCLUDED.forward_path, require_signature = EXCLUDED.require_signature, canonical_url = EXCLUDED.canonical_url,
+		meta_title = NULL, meta_description = NULL, meta_favicon_url = NULL, meta_status_code = NULL, meta_fetched_at = NULL,
+		health_url = NULL, health_status_code = NULL, health_error = NULL, health_response_ms = NULL, health_redirects = NULL,
+		health_failures = 0, health_broken = false, health_checked_at = NULL
+	WHERE urls.expiry < $6`
+
+// saveArgs returns the parameters of saveQuery, rows expired before the cutoff are overwritten
+func saveArgs(url *model.URL, cutoff time.Time) []any {
+	return []any{url.ShortURL, url.OriginalURL, url.Expiry, url.ClickCount, url.ExpiredRedirectURL, cutoff, url.CreatedAt, url.OGTitle, url.OGDescription, url.OGImage,
+		url.CountryURLs, url.DeviceRules, url.Variants, url.StickyVariants, url.VariantClicks,
+		url.UTM, url.ForwardQuery, url.ForwardPath, url.RequireSignature, url.CanonicalURL}
+}
+
+// urlColumns are the columns scanned by scanURL
+const urlColumns = `short_url, original_url, expiry, click_count, COALESCE(expired_redirect_url, ''), created_at, COALESCE(og_title, ''), COALESCE(og_description, ''), COALESCE(og_image, ''),
+	country_urls, device_rules, variants, sticky_variants, variant_clicks, utm, forward_query, forward_path, require_signature, COALESCE(canonical_url, ''),
+	COALESCE(meta_title, ''), COALESCE(meta_description, ''), COALESCE(meta_favicon_url, ''), COALESCE(meta_status_code, 0), meta_fetched_at,
+	COALESCE(health_url, ''), COALESCE(health_status_code, 0), COALESCE(health_error, ''), COALESCE(health_response_ms, 0), health_redirects, health_failures, health_broken, health_checked_at`
+
+func scanURL(row pgx.Row) (*model.URL, error) {
+	var url model.URL
+	var metadata model.Metadata
+	var health model.Health
+	var fetchedAt, checkedAt *time.Time
+	err := row.Scan(&url.ShortURL, &url.OriginalURL, &url.Expiry, &url.ClickCount, &url.ExpiredRedirectURL, &url.CreatedAt, &url.OGTitle, &url.OGDescription, &url.OGImage,
+		&url.CountryURLs, &url.DeviceRules, &url.Variants, &url.StickyVariants, &url.VariantClicks, &url.UTM, &url.ForwardQuery, &url.ForwardPath, &url.RequireSignature, &url.CanonicalURL,
+		&metadata.Title, &metadata.Description, &metadata.FaviconURL, &metadata.StatusCode, &fetchedAt,
+		&health.URL, &health.StatusCode, &health.Error, &health.ResponseTimeMS, &health.Redirects, &health.Failures, &health.Broken, &checkedAt)
+	if err != nil {
+		return nil, err
+	}
+	if checkedAt != nil {
+		health.CheckedAt = *checkedAt
+		url.Health = &health
+	}
+	// Metadata is only set once the destination has been fetched
+	if fetchedAt != nil {
+		metadata.FetchedAt = *fetchedAt
+		url.Metadata = &metadata
+	}
+	return &url, nil
 }
 
 func (r *PostgresURLRepository) Save(ctx context.Context, url *model.URL) error {
-	if err := url.Sanitize(); err != nil {
+	if err := url.Sanitize(r.deepLinkSchemes); err != nil {
 		return fmt.Errorf("failed to sanitize URL: %v", err)
 	}
+	now := time.Now()
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = now
+	}
 
-	query := `INSERT INTO urls (short_url, original_url, expiry, click_count) VALUES ($1, $2, $3, $4) ON CONFLICT (short_url) DO UPDATE SET original_url = EXCLUDED.original_url, expiry = EXCLUDED.expiry, click_count = EXCLUDED.click_count`
-	_, err := r.db.Exec(ctx, query, url.ShortURL, url.OriginalURL, url.Expiry, url.ClickCount)
+	tag, err := conn(ctx, r.db).Exec(ctx, saveQuery, saveArgs(url, now.Add(-r.gracePeriod))...)
 	if err != nil {
 		return fmt.Errorf("error saving URL to database: %v", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyExists
+	}
 	return nil
 }
 
+func (r *PostgresURLRepository) SaveBatch(ctx context.Context, urls []*model.URL) []error {
+	errs := make([]error, len(urls))
+	now := time.Now()
+	batch := &pgx.Batch{}
+	queued := make([]int, 0, len(urls))
+	for i, url := range urls {
+		if err := url.Sanitize(r.deepLinkSchemes); err != nil {
+			errs[i] = fmt.Errorf("failed to sanitize URL: %v", err)
+			continue
+		}
+		if url.CreatedAt.IsZero() {
+			url.CreatedAt = now
+		}
+		batch.Queue(saveQuery, saveArgs(url, now.Add(-r.gracePeriod))...)
+		queued = append(queued, i)
+	}
+	if len(queued) == 0 {
+		return errs
+	}
+
+	results := conn(ctx, r.db).SendBatch(ctx, batch)
+	defer results.Close()
+	for _, i := range queued {
+		tag, err := results.Exec()
+		switch {
+		case err != nil:
+			errs[i] = fmt.Errorf("error saving URL to database: %v", err)
+		case tag.RowsAffected() == 0:
+			errs[i] = ErrAlreadyExists
+		}
+	}
+	return errs
+}
+
 func (r *PostgresURLRepository) Find(ctx context.Context, shortURL string) (*model.URL, error) {
-	query := `SELECT original_url, expiry, click_count FROM urls WHERE short_url = $1`
-	var originalURL string
-	var expiry time.Time
-	var clickCount int64
-	err := r.db.QueryRow(ctx, query, shortURL).Scan(&originalURL, &expiry, &clickCount)
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE short_url = $1`
+	url, err := scanURL(conn(ctx, r.db).QueryRow(ctx, query, shortURL))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("URL not found")
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
 		}
-		return nil, fmt.Errorf("error retrieving URL from database: %v", err)
+		return nil, fmt.Errorf("error retrieving URL from database: %w", err)
 	}
-	return &model.URL{
-		OriginalURL: originalURL,
-		ShortURL:    shortURL,
-		Expiry:      expiry,
-		ClickCount:  clickCount,
-	}, nil
+	return url, nil
 }
 
-func (r *PostgresURLRepository) IncrementClickCount(ctx context.Context, shortURL string) error {
-	query := `UPDATE urls SET click_count = click_count + 1 WHERE short_url = $1`
-	_, err := r.db.Exec(ctx, query, shortURL)
+func (r *PostgresURLRepository) FindPrefix(ctx context.Context, shortURLs []string) (*model.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE short_url = ANY($1) AND forward_path
+		ORDER BY length(short_url) DESC LIMIT 1`
+	url, err := scanURL(conn(ctx, r.db).QueryRow(ctx, query, shortURLs))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error retrieving URL from database: %w", err)
+	}
+	return url, nil
+}
+
+func (r *PostgresURLRepository) ListPrefixes(ctx context.Context) ([]string, error) {
+	rows, err := conn(ctx, r.db).Query(ctx, `SELECT short_url FROM urls WHERE forward_path`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing prefixes: %v", err)
+	}
+	defer rows.Close()
+
+	var shortURLs []string
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, fmt.Errorf("error listing prefixes: %v", err)
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	return shortURLs, rows.Err()
+}
+
+func (r *PostgresURLRepository) FindByCanonicalURLs(ctx context.Context, canonicalURLs []string) ([]*model.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE canonical_url = ANY($1) AND (expiry IS NULL OR expiry > $2) ORDER BY created_at`
+	return r.queryURLs(ctx, query, canonicalURLs, time.Now())
+}
+
+func (r *PostgresURLRepository) CountSlugs(ctx context.Context, shortURLPrefix string) (map[int]int64, error) {
+	query := `SELECT length(short_url) - length($1), count(*) FROM urls WHERE starts_with(short_url, $1) GROUP BY 1`
+	rows, err := conn(ctx, r.db).Query(ctx, query, shortURLPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error counting slugs: %v", err)
+	}
+	defer rows.Close()
+
+	counts := map[int]int64{}
+	for rows.Next() {
+		var length int
+		var count int64
+		if err := rows.Scan(&length, &count); err != nil {
+			return nil, fmt.Errorf("error counting slugs: %v", err)
+		}
+		counts[length] = count
+	}
+	return counts, rows.Err()
+}
+
+func (r *PostgresURLRepository) List(ctx context.Context, options ListOptions) ([]*model.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE short_url > $1`
+	if options.Broken {
+		query += ` AND health_broken`
+	}
+	query += ` ORDER BY short_url LIMIT $2`
+	return r.queryURLs(ctx, query, options.After, options.Limit)
+}
+
+func (r *PostgresURLRepository) ListDueForCheck(ctx context.Context, checkedBefore time.Time, limit int) ([]*model.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls
+		WHERE (health_checked_at IS NULL OR health_checked_at < $1) AND (expiry IS NULL OR expiry > $2)
+		ORDER BY health_checked_at NULLS FIRST LIMIT $3`
+	return r.queryURLs(ctx, query, checkedBefore, time.Now(), limit)
+}
+
+// queryURLs runs a query selecting urlColumns and collects the rows
+func (r *PostgresURLRepository) queryURLs(ctx context.Context, query string, args ...any) ([]*model.URL, error) {
+	rows, err := conn(ctx, r.db).Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing URLs: %v", err)
+	}
+	defer rows.Close()
+
+	urls := []*model.URL{}
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading URL: %v", err)
+		}
+		urls = append(urls, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing URLs: %v", err)
+	}
+	return urls, nil
+}
+
+func (r *PostgresURLRepository) ForEach(ctx context.Context, fn func(url *model.URL) error) error {
+	query := `SELECT ` + urlColumns + ` FROM urls ORDER BY short_url`
+	rows, err := conn(ctx, r.db).Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("error listing URLs: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return fmt.Errorf("error reading URL: %v", err)
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error listing URLs: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresURLRepository) IncrementClickCount(ctx context.Context, shortURL string, variant string) error {
+	query := `UPDATE urls SET click_count = click_count + 1,
+		variant_clicks = CASE WHEN $2::text = '' THEN variant_clicks
+			ELSE jsonb_set(COALESCE(variant_clicks, '{}'), ARRAY[$2], to_jsonb(COALESCE((variant_clicks->>$2)::bigint, 0) + 1)) END
+		WHERE short_url = $1`
+	_, err := conn(ctx, r.db).Exec(ctx, query, shortURL, variant)
 	if err != nil {
 		return fmt.Errorf("error incrementing click count: %v", err)
 	}
 	return nil
 }
+
+func (r *PostgresURLRepository) UpdateExpiry(ctx context.Context, shortURL string, expiry *time.Time) error {
+	query := `UPDATE urls SET expiry = $2 WHERE short_url = $1`
+	tag, err := conn(ctx, r.db).Exec(ctx, query, shortURL, expiry)
+	if err != nil {
+		return fmt.Errorf("error updating expiry: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresURLRepository) SaveMetadata(ctx context.Context, shortURL string, metadata *model.Metadata) error {
+	query := `UPDATE urls SET meta_title = $2, meta_description = $3, meta_favicon_url = $4, meta_status_code = $5, meta_fetched_at = $6
+		WHERE short_url = $1`
+	_, err := conn(ctx, r.db).Exec(ctx, query, shortURL, metadata.Title, metadata.Description, metadata.FaviconURL, metadata.StatusCode, metadata.FetchedAt)
+	if err != nil {
+		return fmt.Errorf("error saving metadata: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresURLRepository) SaveHealth(ctx context.Context, shortURL string, health *model.Health) error {
+	query := `UPDATE urls SET health_status_code = $2, health_error = $3, health_response_ms = $4, health_redirects = $5,
+		health_failures = $6, health_broken = $7, health_checked_at = $8, health_url = NULLIF($9, '')
+		WHERE short_url = $1`
+	_, err := conn(ctx, r.db).Exec(ctx, query, shortURL, health.StatusCode, health.Error, health.ResponseTimeMS, health.Redirects,
+		health.Failures, health.Broken, health.CheckedAt, health.URL)
+	if err != nil {
+		return fmt.Errorf("error saving health: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresURLRepository) PurgeExpired(ctx context.Context, expiredBefore time.Time, limit int) ([]*model.URL, error) {
+	// SKIP LOCKED keeps concurrent purges from waiting on each other's batches
+	query := `WITH purged AS (
+		DELETE FROM urls WHERE short_url IN (
+			SELECT short_url FROM urls WHERE expiry < $1 ORDER BY expiry LIMIT $2 FOR UPDATE SKIP LOCKED
+		) RETURNING *
+	), archived AS (
+		INSERT INTO urls_archive (short_url, data) SELECT short_url, to_jsonb(purged) FROM purged
+	)
+	SELECT ` + urlColumns + ` FROM purged ORDER BY expiry`
+	urls, err := r.queryURLs(ctx, query, expiredBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error purging expired URLs: %v", err)
+	}
+	return urls, nil
+}
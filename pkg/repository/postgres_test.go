@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+// schema returns the statements of sql/init.sh
+func schema(t *testing.T) string {
+	script, err := os.ReadFile("../../sql/init.sh")
+	assert.Nil(t, err)
+	_, statements, _ := strings.Cut(string(script), "<<-EOSQL\n")
+	statements, _, _ = strings.Cut(statements, "\nEOSQL")
+	return statements
+}
+
+// urlsColumns returns the columns of the urls table created by sql/init.sh
+func urlsColumns(t *testing.T) []string {
+	table := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS urls \((.*?)\n\);`).FindStringSubmatch(schema(t))
+	assert.NotNil(t, table)
+	var columns []string
+	for _, line := range strings.Split(table[1], "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		columns = append(columns, strings.Fields(line)[0])
+	}
+	return columns
+}
+
+func TestSaveQuery_ReplacesEveryColumn(t *testing.T) {
+	_, set, _ := strings.Cut(saveQuery, "DO UPDATE SET")
+	for _, column := range urlsColumns(t) {
+		if column == "short_url" {
+			continue
+		}
+		assert.Regexp(t, `\b`+column+` = `, set, "a link reusing an expired short URL would inherit %s", column)
+	}
+}
+
+// testPool connects to the database of TEST_DATABASE_URL and creates the schema in a schema of its own
+func testPool(t *testing.T) *pgxpool.Pool {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	name := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	config, err := pgxpool.ParseConfig(url)
+	assert.Nil(t, err)
+	config.ConnConfig.RuntimeParams["search_path"] = name
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	assert.Nil(t, err)
+	_, err = pool.Exec(ctx, "CREATE SCHEMA "+name)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		pool.Exec(ctx, "DROP SCHEMA "+name+" CASCADE")
+		pool.Close()
+	})
+	_, err = pool.Exec(ctx, schema(t))
+	assert.Nil(t, err)
+	return pool
+}
+
+func TestSave_ExpiredURLReplaced(t *testing.T) {
+	ctx := context.Background()
+	repo := NewPostgresURLRepository(testPool(t), time.Hour, nil)
+	const shortURL = "http://short.com/r/abc123"
+
+	expired := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: shortURL, OriginalURL: "https://old.example.com", Expiry: &expired, ClickCount: 7}))
+	assert.Nil(t, repo.SaveMetadata(ctx, shortURL, &model.Metadata{Title: "Old page", StatusCode: 200, FetchedAt: time.Now()}))
+	assert.Nil(t, repo.SaveHealth(ctx, shortURL, &model.Health{StatusCode: 404, Failures: 3, Broken: true, Redirects: []string{"https://old.example.com/gone"}, CheckedAt: time.Now()}))
+
+	expiry := time.Now().Add(time.Hour)
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: shortURL, OriginalURL: "https://new.example.com", Expiry: &expiry}))
+	u, err := repo.Find(ctx, shortURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://new.example.com", u.OriginalURL)
+	assert.Equal(t, int64(0), u.ClickCount)
+	assert.Nil(t, u.Metadata)
+	assert.Nil(t, u.Health)
+	broken, err := repo.List(ctx, ListOptions{Limit: 10, Broken: true})
+	assert.Nil(t, err)
+	assert.Empty(t, broken)
+
+	// Live links, and links expired within the grace period, keep their short URL
+	assert.ErrorIs(t, repo.Save(ctx, &model.URL{ShortURL: shortURL, OriginalURL: "https://other.example.com"}), ErrAlreadyExists)
+	recent := time.Now().Add(-time.Minute)
+	assert.Nil(t, repo.UpdateExpiry(ctx, shortURL, &recent))
+	assert.ErrorIs(t, repo.Save(ctx, &model.URL{ShortURL: shortURL, OriginalURL: "https://other.example.com"}), ErrAlreadyExists)
+}
+
+func TestFindByCanonicalURLs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewPostgresURLRepository(testPool(t), time.Hour, nil)
+	expired := time.Now().Add(-time.Minute)
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: "http://short.com/r/abc123", OriginalURL: "https://example.com/", CanonicalURL: "https://example.com"}))
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: "http://short.com/r/def456", OriginalURL: "https://example.org", CanonicalURL: "https://example.org", Expiry: &expired}))
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: "http://short.com/r/docs", OriginalURL: "https://example.com"}))
+
+	urls, err := repo.FindByCanonicalURLs(ctx, []string{"https://example.com", "https://example.org"})
+
+	assert.Nil(t, err)
+	assert.Len(t, urls, 1)
+	assert.Equal(t, "http://short.com/r/abc123", urls[0].ShortURL)
+	assert.Equal(t, "https://example.com", urls[0].CanonicalURL)
+}
+
+func TestInTx_EnqueueCommitsWithSave(t *testing.T) {
+	ctx := context.Background()
+	pool := testPool(t)
+	repo := NewPostgresURLRepository(pool, time.Hour, nil)
+	webhooks := NewPostgresWebhookRepository(pool)
+	transactor := NewPostgresTransactor(pool)
+	assert.Nil(t, webhooks.SaveSubscription(ctx, &model.Subscription{URL: "https://hooks.example.com", Secret: "whsec_test", Events: []string{}}))
+	save := func(shortURL, eventID string, fail error) error {
+		return transactor.InTx(ctx, func(ctx context.Context) error {
+			if err := repo.Save(ctx, &model.URL{ShortURL: shortURL, OriginalURL: "https://example.com"}); err != nil {
+				return err
+			}
+			if _, err := webhooks.Enqueue(ctx, eventID, "link.created", []byte(`{}`)); err != nil {
+				return err
+			}
+			return fail
+		})
+	}
+
+	assert.NotNil(t, save("http://short.com/r/abc123", "rolled-back", fmt.Errorf("emit failed")))
+	assert.Nil(t, save("http://short.com/r/def456", "committed", nil))
+
+	_, err := repo.Find(ctx, "http://short.com/r/abc123")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = repo.Find(ctx, "http://short.com/r/def456")
+	assert.Nil(t, err)
+	deliveries, err := webhooks.ListDeliveries(ctx, 1, "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, "committed", deliveries[0].EventID)
+}
+
+func TestPurgeExpired_ReturnsArchivedURLs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewPostgresURLRepository(testPool(t), time.Hour, nil)
+	expired := time.Now().Add(-2 * time.Hour)
+	live := time.Now().Add(time.Hour)
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: "http://short.com/r/abc123", OriginalURL: "https://example.com", Expiry: &expired}))
+	assert.Nil(t, repo.Save(ctx, &model.URL{ShortURL: "http://short.com/r/def456", OriginalURL: "https://example.org", Expiry: &live}))
+
+	purged, err := repo.PurgeExpired(ctx, time.Now().Add(-time.Hour), 10)
+
+	assert.Nil(t, err)
+	assert.Len(t, purged, 1)
+	assert.Equal(t, "https://example.com", purged[0].OriginalURL)
+	_, err = repo.Find(ctx, "http://short.com/r/abc123")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -2,12 +2,111 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"url-shortener/pkg/model"
 )
 
+// ErrAlreadyExists is returned by Save when a live URL already holds the short URL.
+var ErrAlreadyExists = errors.New("short URL already exists")
+
+// ErrNotFound is returned when no stored row matches, other errors mean the lookup failed.
+var ErrNotFound = errors.New("not found")
+
 type URLRepository interface {
+	// Save stores the URL, replacing any URL with the same short URL that expired more than the grace period ago.
 	Save(ctx context.Context, url *model.URL) error
+	// SaveBatch saves the URLs in a single round trip, returning one error slot per URL.
+	SaveBatch(ctx context.Context, urls []*model.URL) []error
 	Find(ctx context.Context, shortURL string) (*model.URL, error)
-	IncrementClickCount(ctx context.Context, shortURL string) error
+	// FindByCanonicalURLs returns the live links generated from the canonical URLs, oldest first.
+	FindByCanonicalURLs(ctx context.Context, canonicalURLs []string) ([]*model.URL, error)
+	// CountSlugs counts the links whose short URL starts with the prefix, by length of the rest.
+	CountSlugs(ctx context.Context, shortURLPrefix string) (map[int]int64, error)
+	// FindPrefix returns the path forwarding link with the longest of the short URLs.
+	FindPrefix(ctx context.Context, shortURLs []string) (*model.URL, error)
+	// ListPrefixes returns the short URLs of every path forwarding link.
+	ListPrefixes(ctx context.Context) ([]string, error)
+	// List returns a page of URLs ordered by short URL.
+	List(ctx context.Context, options ListOptions) ([]*model.URL, error)
+	// ForEach calls fn for every stored URL without loading them all in memory, stopping at the first error.
+	ForEach(ctx context.Context, fn func(url *model.URL) error) error
+	// IncrementClickCount counts a click, and a click of the variant when it isn't empty.
+	IncrementClickCount(ctx context.Context, shortURL string, variant string) error
+	UpdateExpiry(ctx context.Context, shortURL string, expiry *time.Time) error
+	SaveMetadata(ctx context.Context, shortURL string, metadata *model.Metadata) error
+	URLPurger
+	HealthRepository
+}
+
+// ListOptions selects a page of URLs.
+type ListOptions struct {
+	After  string // Only URLs with a greater short URL are listed, for keyset pagination
+	Limit  int
+	Broken bool // Only list URLs whose destination is marked broken
+}
+
+// URLPurger removes expired URLs, freeing their short URLs for reuse.
+type URLPurger interface {
+	// PurgeExpired archives up to limit URLs that expired before the given time
+	// and returns the archived URLs.
+	PurgeExpired(ctx context.Context, expiredBefore time.Time, limit int) ([]*model.URL, error)
+}
+
+// HealthRepository stores the results of destination health checks.
+type HealthRepository interface {
+	// ListDueForCheck returns up to limit live URLs not checked since the given time, least recently checked first.
+	ListDueForCheck(ctx context.Context, checkedBefore time.Time, limit int) ([]*model.URL, error)
+	SaveHealth(ctx context.Context, shortURL string, health *model.Health) error
+}
+
+// WebhookRepository stores webhook subscriptions and the outbox of their deliveries.
+type WebhookRepository interface {
+	SaveSubscription(ctx context.Context, subscription *model.Subscription) error
+	ListSubscriptions(ctx context.Context) ([]*model.Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64) error
+	// Enqueue adds a pending delivery of the event for every subscription to its type and returns how many were added.
+	// Called in Transactor.InTx, the deliveries are only sent once the change they report commits.
+	Enqueue(ctx context.Context, eventID, event string, payload []byte) (int64, error)
+	// ClaimDue returns up to limit pending deliveries due at the given time, and holds them
+	// until leaseUntil so concurrent dispatchers don't send them too.
+	ClaimDue(ctx context.Context, now, leaseUntil time.Time, limit int) ([]*model.Delivery, error)
+	// SaveAttempt stores the outcome of a delivery attempt.
+	SaveAttempt(ctx context.Context, delivery *model.Delivery) error
+	// ListDeliveries returns the latest deliveries of a subscription, optionally only those with the given status.
+	ListDeliveries(ctx context.Context, subscriptionID int64, status string, limit int) ([]*model.Delivery, error)
+	// Redeliver makes a delivered or dead delivery pending again.
+	Redeliver(ctx context.Context, id int64) error
+	DeliveryPurger
+}
+
+// DeliveryPurger removes the webhook deliveries that won't be attempted again.
+type DeliveryPurger interface {
+	// PurgeDeliveries deletes up to limit delivered or dead deliveries created before the given time
+	// and returns how many were deleted.
+	PurgeDeliveries(ctx context.Context, createdBefore time.Time, limit int) (int64, error)
+}
+
+// ErrWebhookNotFound is returned for unknown webhook subscriptions and deliveries.
+var ErrWebhookNotFound = fmt.Errorf("webhook subscription or delivery %w", ErrNotFound)
+
+type IdempotencyRepository interface {
+	// Reserve marks a request with the key as in progress since reservedAt. It returns false when the key holds
+	// a response stored after storedAfter, or a request in progress since after startedAfter.
+	Reserve(ctx context.Context, key, requestHash string, reservedAt, storedAfter, startedAfter time.Time) (bool, error)
+	// FindResponse returns the response stored for the key after the given time, or nil if there is none.
+	// Requests still in progress have a response without a status code.
+	FindResponse(ctx context.Context, key string, storedAfter time.Time) (*model.StoredResponse, error)
+	SaveResponse(ctx context.Context, key string, response *model.StoredResponse) error
+	// Release frees the key of a request that failed, so that it can be retried.
+	Release(ctx context.Context, key string) error
+	IdempotencyPurger
+}
+
+// IdempotencyPurger removes the responses that are no longer replayed.
+type IdempotencyPurger interface {
+	// PurgeResponses deletes up to limit keys stored before the given time and returns how many were deleted.
+	PurgeResponses(ctx context.Context, storedBefore time.Time, limit int) (int64, error)
 }
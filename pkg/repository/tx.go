@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Transactor runs work in a single database transaction.
+type Transactor interface {
+	// InTx calls fn with a context carrying the transaction, repository calls made with it join
+	// the transaction. It commits when fn returns nil and rolls back otherwise. Nested calls
+	// join the outer transaction.
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type PostgresTransactor struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresTransactor(db *pgxpool.Pool) Transactor {
+	return &PostgresTransactor{db: db}
+}
+
+type txKey struct{}
+
+func (t *PostgresTransactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// querier is implemented by both the pool and its transactions
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// conn returns the transaction carried by ctx, or the pool outside of InTx
+func conn(ctx context.Context, db *pgxpool.Pool) querier {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return db
+}
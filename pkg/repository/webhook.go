@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"url-shortener/pkg/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresWebhookRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresWebhookRepository(db *pgxpool.Pool) WebhookRepository {
+	return &PostgresWebhookRepository{db: db}
+}
+
+// deliveryColumns are the columns scanned by scanDelivery, from webhook_deliveries joined with webhook_subscriptions
+const deliveryColumns = `d.id, d.subscription_id, d.event_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+	COALESCE(d.last_status_code, 0), COALESCE(d.last_error, ''), d.created_at, d.delivered_at, s.url, s.secret`
+
+func scanDelivery(row pgx.Row) (*model.Delivery, error) {
+	var d model.Delivery
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt, &d.URL, &d.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r *PostgresWebhookRepository) SaveSubscription(ctx context.Context, subscription *model.Subscription) error {
+	if subscription.CreatedAt.IsZero() {
+		subscription.CreatedAt = time.Now()
+	}
+	query := `INSERT INTO webhook_subscriptions (url, secret, events, created_at) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := conn(ctx, r.db).QueryRow(ctx, query, subscription.URL, subscription.Secret, subscription.Events, subscription.CreatedAt).Scan(&subscription.ID)
+	if err != nil {
+		return fmt.Errorf("error saving webhook subscription: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresWebhookRepository) ListSubscriptions(ctx context.Context) ([]*model.Subscription, error) {
+	query := `SELECT id, url, events, created_at FROM webhook_subscriptions ORDER BY id`
+	rows, err := conn(ctx, r.db).Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhook subscriptions: %v", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []*model.Subscription{}
+	for rows.Next() {
+		var s model.Subscription
+		if err := rows.Scan(&s.ID, &s.URL, &s.Events, &s.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading webhook subscription: %v", err)
+		}
+		subscriptions = append(subscriptions, &s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing webhook subscriptions: %v", err)
+	}
+	return subscriptions, nil
+}
+
+func (r *PostgresWebhookRepository) DeleteSubscription(ctx context.Context, id int64) error {
+	// Deliveries are deleted along, through ON DELETE CASCADE
+	tag, err := conn(ctx, r.db).Exec(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting webhook subscription: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *PostgresWebhookRepository) Enqueue(ctx context.Context, eventID, event string, payload []byte) (int64, error) {
+	query := `INSERT INTO webhook_deliveries (subscription_id, event_id, event, payload)
+		SELECT id, $1, $2, $3 FROM webhook_subscriptions WHERE cardinality(events) = 0 OR $2 = ANY(events)`
+	tag, err := conn(ctx, r.db).Exec(ctx, query, eventID, event, payload)
+	if err != nil {
+		return 0, fmt.Errorf("error enqueuing webhook deliveries: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (r *PostgresWebhookRepository) ClaimDue(ctx context.Context, now, leaseUntil time.Time, limit int) ([]*model.Delivery, error) {
+	// SKIP LOCKED lets several dispatchers claim disjoint batches
+	query := `WITH d AS (
+		UPDATE webhook_deliveries SET next_attempt_at = $2 WHERE id IN (
+			SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at LIMIT $3 FOR UPDATE SKIP LOCKED
+		) RETURNING *
+	)
+	SELECT ` + deliveryColumns + ` FROM d JOIN webhook_subscriptions s ON s.id = d.subscription_id ORDER BY d.id`
+	return r.queryDeliveries(ctx, query, now, leaseUntil, limit)
+}
+
+func (r *PostgresWebhookRepository) SaveAttempt(ctx context.Context, delivery *model.Delivery) error {
+	query := `UPDATE webhook_deliveries SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = NULLIF($5, 0),
+		last_error = NULLIF($6, ''), delivered_at = $7 WHERE id = $1`
+	_, err := conn(ctx, r.db).Exec(ctx, query, delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastStatusCode,
+		delivery.LastError, delivery.DeliveredAt)
+	if err != nil {
+		return fmt.Errorf("error saving webhook delivery: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresWebhookRepository) ListDeliveries(ctx context.Context, subscriptionID int64, status string, limit int) ([]*model.Delivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id
+		WHERE d.subscription_id = $1 AND ($2 = '' OR d.status = $2) ORDER BY d.id DESC LIMIT $3`
+	return r.queryDeliveries(ctx, query, subscriptionID, status, limit)
+}
+
+func (r *PostgresWebhookRepository) Redeliver(ctx context.Context, id int64) error {
+	query := `UPDATE webhook_deliveries SET status = 'pending', next_attempt_at = $2, delivered_at = NULL WHERE id = $1`
+	tag, err := conn(ctx, r.db).Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("error requeuing webhook delivery: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *PostgresWebhookRepository) PurgeDeliveries(ctx context.Context, createdBefore time.Time, limit int) (int64, error) {
+	// SKIP LOCKED leaves alone the rows a redelivery is updating
+	query := `DELETE FROM webhook_deliveries WHERE id IN (
+		SELECT id FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1 ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED
+	)`
+	tag, err := conn(ctx, r.db).Exec(ctx, query, createdBefore, limit)
+	if err != nil {
+		return 0, fmt.Errorf("error purging webhook deliveries: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (r *PostgresWebhookRepository) queryDeliveries(ctx context.Context, query string, args ...any) ([]*model.Delivery, error) {
+	rows, err := conn(ctx, r.db).Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*model.Delivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing webhook deliveries: %v", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,167 @@
+package shortener
+
+import (
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// DefaultTrackingParams are query parameters identifying a campaign or a click rather than a page
+var DefaultTrackingParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"gbraid",
+	"wbraid",
+	"msclkid",
+	"yclid",
+	"twclid",
+	"igshid",
+	"mc_cid",
+	"mc_eid",
+	"_hsenc",
+	"_hsmi",
+	"mkt_tok",
+}
+
+// Canonicalization selects the optional steps of URL canonicalization. Scheme and host case,
+// default ports, trailing dots in hosts, percent-encoding and IDN hosts are always normalized.
+type Canonicalization struct {
+	StripWWW       bool     // Treat www.example.com as example.com, which most but not all sites do
+	StripFragment  bool     // Ignore the part after #, which is never sent to the site
+	TrackingParams []string // Query parameters to ignore, a name ending with * matches by prefix
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// canonicalizeURL normalizes the URL so that addresses of the same page give the same slug
+func canonicalizeURL(rawURL string, rules Canonicalization) (string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	parsedURL.Scheme = strings.ToLower(parsedURL.Scheme)
+	if parsedURL.Host != "" {
+		parsedURL.Host = canonicalizeHost(parsedURL, rules.StripWWW)
+	}
+
+	path := normalizeEscapes(parsedURL.EscapedPath())
+	if path == "" && parsedURL.Host != "" {
+		path = "/"
+	}
+	if parsedURL.Path, err = url.PathUnescape(path); err != nil {
+		return "", err
+	}
+	parsedURL.RawPath = path
+
+	parsedURL.RawQuery = canonicalizeQuery(parsedURL.RawQuery, rules.TrackingParams)
+	parsedURL.ForceQuery = false
+
+	if rules.StripFragment {
+		parsedURL.Fragment, parsedURL.RawFragment = "", ""
+	} else {
+		fragment := normalizeEscapes(parsedURL.EscapedFragment())
+		if parsedURL.Fragment, err = url.PathUnescape(fragment); err != nil {
+			return "", err
+		}
+		parsedURL.RawFragment = fragment
+	}
+	return parsedURL.String(), nil
+}
+
+// canonicalizeHost lowercases the host, converts international names to punycode,
+// and drops trailing dots and the default port of the scheme
+func canonicalizeHost(u *url.URL, stripWWW bool) string {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.String()
+		if addr.Is6() {
+			host = "[" + host + "]"
+		}
+	} else if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	} else if ascii, err := idna.Punycode.ToASCII(host); err == nil {
+		// Names such as those with underscores fail the lookup rules but are still reachable
+		host = ascii
+	}
+	if stripWWW {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	return host
+}
+
+// normalizeEscapes decodes escaped unreserved characters and uppercases the other escapes,
+// so that "%7euser/caf%c3%a9" becomes "~user/caf%C3%A9"
+func normalizeEscapes(escaped string) string {
+	var normalized strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '%' && i+2 < len(escaped) && isHex(escaped[i+1]) && isHex(escaped[i+2]) {
+			b := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+			if isUnreserved(b) {
+				normalized.WriteByte(b)
+			} else {
+				normalized.WriteString("%" + strings.ToUpper(escaped[i+1:i+3]))
+			}
+			i += 2
+			continue
+		}
+		normalized.WriteByte(escaped[i])
+	}
+	return normalized.String()
+}
+
+// Normalize and sort query parameters to avoid duplicates when their order changes,
+// leaving out tracking parameters
+func canonicalizeQuery(rawQuery string, tracking []string) string {
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for key := range params {
+		if isTrackingParam(key, tracking) {
+			delete(params, key)
+		}
+	}
+	return encodeQuery(params)
+}
+
+// isTrackingParam reports whether the parameter matches one of the names, ignoring case
+func isTrackingParam(key string, tracking []string) bool {
+	key = strings.ToLower(key)
+	for _, name := range tracking {
+		name = strings.ToLower(name)
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnreserved(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '.' || b == '_' || b == '~'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,97 @@
+package shortener
+
+import (
+	"errors"
+	"strings"
+)
+
+// maxRerolls bounds the slugs tried for one URL before giving up
+const maxRerolls = 32
+
+// ErrNoAllowedSlug is returned when every slug tried for a URL was rejected by the filter
+var ErrNoAllowedSlug = errors.New("no allowed slug found")
+
+// DefaultBlocklist are words refused anywhere in a slug. Words that are common
+// inside harmless ones, such as "ass" in "class", are left out.
+var DefaultBlocklist = []string{
+	"bitch",
+	"cock",
+	"cunt",
+	"dick",
+	"fag",
+	"fuck",
+	"nazi",
+	"nigg",
+	"penis",
+	"piss",
+	"porn",
+	"shit",
+	"slut",
+	"twat",
+	"wank",
+	"whore",
+}
+
+// DefaultReserved are words refused as a whole slug or prefix segment,
+// since links named after them could pass for pages of the service
+var DefaultReserved = []string{
+	"account",
+	"admin",
+	"api",
+	"login",
+	"logout",
+	"password",
+	"settings",
+	"signin",
+	"signup",
+	"static",
+}
+
+// ambiguousChars are easily mistaken for one another when a slug is read or typed
+const ambiguousChars = "0O1lI"
+
+// leetspeak maps look-alike characters to the letter they stand for. l and 1 both map
+// to i, so words are matched whichever of the three they are written with.
+var leetspeak = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"l", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"8", "b",
+	"9", "g",
+	"-", "",
+	"_", "",
+	"/", "",
+)
+
+// SlugFilter rejects slugs and prefixes that are offensive, reserved or hard to read
+type SlugFilter struct {
+	Blocklist        []string // Refused anywhere, also when spelled with look-alike digits such as "5h1t"
+	Reserved         []string // Refused as a whole slug or prefix segment, ignoring case
+	ExcludeAmbiguous bool     // Refuse 0, O, 1, l and I
+}
+
+// Allows reports whether the slug passes the filter. For prefixes, reserved words are
+// checked against each segment and blocked words against the whole prefix.
+func (f *SlugFilter) Allows(slug string) bool {
+	if f.ExcludeAmbiguous && strings.ContainsAny(slug, ambiguousChars) {
+		return false
+	}
+	for _, segment := range strings.Split(slug, "/") {
+		for _, word := range f.Reserved {
+			if strings.EqualFold(segment, word) {
+				return false
+			}
+		}
+	}
+	skeleton := leetspeak.Replace(strings.ToLower(slug))
+	for _, word := range f.Blocklist {
+		if word = leetspeak.Replace(strings.ToLower(word)); word != "" && strings.Contains(skeleton, word) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,18 @@
 package shortener
 
 type Shortener interface {
-	GenerateShortURL(url string) (string, error)
+	// GenerateShortURL returns the short URL of the URL, attempt 0 first, then the next ones
+	// when the previous are held by links to other pages.
+	GenerateShortURL(url string, attempt int) (string, error)
 	IsValidShortURL(url string) bool
+	IsValidSlug(slug string) bool
+	// AllowsSlug reports whether the slug filter lets the slug through.
+	AllowsSlug(slug string) bool
+	IsValidPrefix(prefix string) bool
+	PrefixCandidates(url string) []string
+	// RegisterPrefix records the short URL of a new path forwarding link.
+	RegisterPrefix(url string)
+	BuildShortURL(slug string) string
+	NormalizeShortURL(url string) string
+	CanonicalizeURL(url string) (string, error)
 }
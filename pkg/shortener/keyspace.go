@@ -0,0 +1,74 @@
+package shortener
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+)
+
+// SlugCounter counts the links whose short URL starts with the given prefix, by length of the rest
+type SlugCounter interface {
+	CountSlugs(ctx context.Context, shortURLPrefix string) (map[int]int64, error)
+}
+
+// UpdateSlugLength recounts the links of each domain and moves its generation to longer slugs
+// while the share of the keyspace in use at its current length is past the threshold.
+// Slugs never get shorter again.
+func (s *CanonicalShortener) UpdateSlugLength(ctx context.Context, counter SlugCounter) error {
+	if s.config.GrowthThreshold <= 0 {
+		return nil
+	}
+	for host, current := range s.lengths {
+		counts, err := counter.CountSlugs(ctx, s.shortURLBase(host))
+		if err != nil {
+			return err
+		}
+
+		from := int(current.Load())
+		length := from
+		for length < s.config.MaxSlugLength && float64(s.used(counts, length)) >= s.config.GrowthThreshold*keyspace(len(s.config.Alphabet), length) {
+			length++
+		}
+		if length != from {
+			s.config.Logger.Info("Slug length increased", "host", host, "from", from, "to", length, "links", s.used(counts, from))
+			current.Store(int64(length))
+		}
+	}
+	return nil
+}
+
+// shortURLBase returns what short URLs of the host start with, the domain with its host replaced
+func (s *CanonicalShortener) shortURLBase(host string) string {
+	return strings.Replace(s.config.Domain, s.host, host, 1) + s.config.Prefix
+}
+
+// Run updates the slug length every interval until the context is done
+func (s *CanonicalShortener) Run(ctx context.Context, counter SlugCounter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.UpdateSlugLength(ctx, counter); err != nil {
+			s.config.Logger.Error("Failed to count slugs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// used returns the links with slugs of the length, signed ones being longer by their checksum
+func (s *CanonicalShortener) used(counts map[int]int64, length int) int64 {
+	used := counts[length+s.signatureLength()]
+	if s.config.Signing != nil && s.config.Signing.AcceptUnsigned {
+		used += counts[length]
+	}
+	return used
+}
+
+// keyspace returns the number of slugs of the length
+func keyspace(alphabetSize, length int) float64 {
+	return math.Pow(float64(alphabetSize), float64(length))
+}
@@ -0,0 +1,215 @@
+package shortener
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxPrefixDepth is the number of path segments a prefix can have
+const maxPrefixDepth = 5
+
+var prefixSegment = regexp.MustCompile("^[a-zA-Z0-9_-]{1,64}$")
+
+// ErrUnsafePath is returned for forwarded paths that could escape the destination path
+var ErrUnsafePath = errors.New("unsafe path")
+
+// IsValidPrefix reports whether prefix can name a path forwarding link, such as "docs"
+// or "docs/internal": up to 5 segments of letters, digits, - and _, allowed by the slug filter.
+// With signed slugs, prefixes shaped like slugs are refused since they could not be served.
+func (s *CanonicalShortener) IsValidPrefix(prefix string) bool {
+	if s.config.Signing != nil && s.hasSlugShape(prefix) {
+		return false
+	}
+	return isPrefix(prefix) && s.config.Filter.Allows(prefix)
+}
+
+// PrefixLister lists the short URLs of the stored path forwarding links
+type PrefixLister interface {
+	ListPrefixes(ctx context.Context) ([]string, error)
+}
+
+// LoadPrefixes replaces the registered prefixes with those of the stored path forwarding links.
+// They are only kept with signed slugs, see IsValidShortURL.
+func (s *CanonicalShortener) LoadPrefixes(ctx context.Context, lister PrefixLister) error {
+	if s.config.Signing == nil {
+		return nil
+	}
+	shortURLs, err := lister.ListPrefixes(ctx)
+	if err != nil {
+		return err
+	}
+	prefixes := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		if prefix, ok := s.pathOf(shortURL); ok {
+			prefixes[prefix] = true
+		}
+	}
+	s.prefixesMu.Lock()
+	s.prefixes = prefixes
+	s.prefixesMu.Unlock()
+	return nil
+}
+
+// RegisterPrefix records the short URL of a new path forwarding link, so that its paths
+// are served before the next LoadPrefixes.
+func (s *CanonicalShortener) RegisterPrefix(shortURL string) {
+	if s.config.Signing == nil {
+		return
+	}
+	prefix, ok := s.pathOf(shortURL)
+	if !ok {
+		return
+	}
+	s.prefixesMu.Lock()
+	defer s.prefixesMu.Unlock()
+	if s.prefixes == nil {
+		s.prefixes = make(map[string]bool)
+	}
+	s.prefixes[prefix] = true
+}
+
+// RunPrefixes reloads the registered prefixes every interval until the context is done,
+// picking up the prefixes created by other instances
+func (s *CanonicalShortener) RunPrefixes(ctx context.Context, lister PrefixLister, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.LoadPrefixes(ctx, lister); err != nil {
+			s.config.Logger.Error("Failed to load prefixes", "error", err)
+		}
+	}
+}
+
+// isRegistered reports whether the path is a registered prefix or lies under one
+func (s *CanonicalShortener) isRegistered(path string) bool {
+	if s.config.CaseInsensitive {
+		path = strings.ToLower(path)
+	}
+	segments := strings.Split(path, "/")
+	s.prefixesMu.RLock()
+	defer s.prefixesMu.RUnlock()
+	for i := min(len(segments), maxPrefixDepth); i > 0; i-- {
+		if s.prefixes[strings.Join(segments[:i], "/")] {
+			return true
+		}
+	}
+	return false
+}
+
+// pathOf returns the path of a short URL after the prefix of short URLs, lowercased with case-insensitive slugs
+func (s *CanonicalShortener) pathOf(shortURL string) (string, bool) {
+	if _, rest, ok := strings.Cut(shortURL, "://"); ok {
+		shortURL = rest
+	}
+	URL, err := url.Parse("http://" + shortURL)
+	if err != nil {
+		return "", false
+	}
+	path, ok := strings.CutPrefix(URL.Path, s.config.Prefix)
+	if !ok || path == "" {
+		return "", false
+	}
+	if s.config.CaseInsensitive {
+		path = strings.ToLower(path)
+	}
+	return path, true
+}
+
+// isPrefix reports whether prefix has the form of a prefix
+func isPrefix(prefix string) bool {
+	segments := strings.Split(prefix, "/")
+	if len(segments) > maxPrefixDepth {
+		return false
+	}
+	for _, segment := range segments {
+		if !prefixSegment.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrefixCandidates returns the short URLs of the prefixes that could serve the given
+// short URL with a path after them, longest first. "host/r/docs/api/v2" gives
+// "host/r/docs/api" and "host/r/docs".
+func (s *CanonicalShortener) PrefixCandidates(u string) []string {
+	URL, err := url.Parse("http://" + u)
+	if err != nil {
+		return nil
+	}
+	path, ok := strings.CutPrefix(URL.EscapedPath(), s.config.Prefix)
+	if !ok {
+		return nil
+	}
+
+	segments := strings.Split(path, "/")
+	depth := 0
+	for depth < len(segments)-1 && depth < maxPrefixDepth && prefixSegment.MatchString(segments[depth]) {
+		depth++
+	}
+	candidates := make([]string, 0, depth)
+	for i := depth; i > 0; i-- {
+		candidates = append(candidates, s.NormalizeShortURL(URL.Host+s.config.Prefix+strings.Join(segments[:i], "/")))
+	}
+	return candidates
+}
+
+// ForwardPath appends the escaped path to the path of the destination URL, keeping its query
+// and fragment: "https://docs.example.com/?v=1" and "api/v2" give "https://docs.example.com/api/v2?v=1".
+// The path is passed on as it was received. Paths with dot segments, empty segments or
+// backslashes are refused, including encoded and double encoded ones.
+func ForwardPath(destination, path string) (string, error) {
+	if path == "" {
+		return destination, nil
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" && i < len(segments)-1 {
+			return "", ErrUnsafePath
+		}
+		if !isSafeSegment(segment) {
+			return "", ErrUnsafePath
+		}
+	}
+
+	base, fragment, hasFragment := strings.Cut(destination, "#")
+	base, query, hasQuery := strings.Cut(base, "?")
+	forwarded := strings.TrimSuffix(base, "/") + "/" + path
+	if hasQuery {
+		forwarded += "?" + query
+	}
+	if hasFragment {
+		forwarded += "#" + fragment
+	}
+	return forwarded, nil
+}
+
+// isSafeSegment decodes the escaped segment until nothing is left to decode, and
+// reports whether it stays a single segment other than "." and "..".
+func isSafeSegment(segment string) bool {
+	for round := 0; round < 3; round++ {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			// The segment was received escaped, after the first round a % is literal
+			return round > 0
+		}
+		if strings.ContainsAny(decoded, "/\\\x00") || decoded == "." || decoded == ".." {
+			return false
+		}
+		if decoded == segment {
+			return true
+		}
+		segment = decoded
+	}
+	// Still encoded after three rounds, no legitimate path needs that
+	return false
+}
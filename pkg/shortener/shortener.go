@@ -1,43 +1,122 @@
 package shortener
 
 import (
+	"crypto/sha256"
 	"fmt"
-	"hash/crc32"
 	"log/slog"
+	"math/big"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-const charset = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+const (
+	// DefaultAlphabet is used for slugs unless configured otherwise
+	DefaultAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	// LowercaseAlphabet is the default with case-insensitive slugs
+	LowercaseAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+)
 
 type Config struct {
-	Logger     *slog.Logger
-	Domain     string
-	Prefix     string
-	SlugLength int
+	Logger            *slog.Logger
+	Domain            string
+	Prefix            string
+	SlugLength        int
+	DomainSlugLengths map[string]int   // Slug length by host, overriding SlugLength
+	MaxSlugLength     int              // Longest slugs generated as the keyspace fills up, SlugLength if lower
+	GrowthThreshold   float64          // Share of the keyspace in use past which slugs get longer, 0 disables growth
+	Alphabet          string           // Characters of slugs, DefaultAlphabet or LowercaseAlphabet when empty
+	CaseInsensitive   bool             // Serve slugs and prefixes whatever their case, the alphabet must be lowercase
+	Canonicalization  Canonicalization // Optional normalizations of the URLs slugs are generated from
+	Filter            SlugFilter       // Slugs and prefixes refused
+	Signing           *Signing         // Checksums of generated slugs, nil disables them
 }
 
 type CanonicalShortener struct {
-	config Config
+	config  Config
+	host    string                   // Host of the domain short URLs are built on
+	lengths map[string]*atomic.Int64 // Length of the slugs generated now by host, grows with the keyspace usage
+
+	prefixesMu sync.RWMutex
+	prefixes   map[string]bool // Paths of the path forwarding links, kept with signed slugs
 }
 
-func NewShortener(config Config) Shortener {
-	return &CanonicalShortener{
-		config: config,
+func NewShortener(config Config) *CanonicalShortener {
+	if config.Alphabet == "" {
+		config.Alphabet = DefaultAlphabet
+		if config.CaseInsensitive {
+			config.Alphabet = LowercaseAlphabet
+		}
+	}
+	s := &CanonicalShortener{config: config, host: hostOf(config.Domain), lengths: make(map[string]*atomic.Int64)}
+	s.track(s.host)
+	for host := range config.DomainSlugLengths {
+		s.track(host)
 	}
+	return s
 }
 
-func (s *CanonicalShortener) GenerateShortURL(url string) (string, error) {
-	url, err := canonicalizeURL(url)
+// ValidateAlphabet checks that the alphabet can be used for slugs: at least two distinct
+// letters, digits, - or _, and no uppercase letter with case-insensitive slugs.
+func ValidateAlphabet(alphabet string, caseInsensitive bool) error {
+	if alphabet == "" {
+		return nil
+	}
+	if len(alphabet) < 2 {
+		return fmt.Errorf("slug alphabet needs at least two characters")
+	}
+	for i, c := range alphabet {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in slug alphabet, use letters, digits, - and _", c)
+		}
+		if strings.ContainsRune(alphabet[:i], c) {
+			return fmt.Errorf("duplicate character %q in slug alphabet", c)
+		}
+		if caseInsensitive && c >= 'A' && c <= 'Z' {
+			return fmt.Errorf("uppercase %q in slug alphabet with case-insensitive slugs", c)
+		}
+	}
+	return nil
+}
+
+// GenerateShortURL returns the short URL of the canonical form of the URL, see GenerateSlug for attempts.
+func (s *CanonicalShortener) GenerateShortURL(url string, attempt int) (string, error) {
+	url, err := canonicalizeURL(url, s.config.Canonicalization)
 	if err != nil {
 		return "", err
 	}
-	slug, err := s.GenerateSlug(url)
+	slug, err := s.GenerateSlug(url, attempt)
 	if err != nil {
 		return "", err
 	}
-	return s.config.Domain + s.config.Prefix + slug, nil
+	return s.BuildShortURL(slug), nil
+}
+
+// BuildShortURL returns the short URL under which the given slug is served.
+func (s *CanonicalShortener) BuildShortURL(slug string) string {
+	if s.config.CaseInsensitive {
+		slug = strings.ToLower(slug)
+	}
+	return s.config.Domain + s.config.Prefix + slug
+}
+
+// NormalizeShortURL returns the short URL a link is stored under. With case-insensitive
+// slugs, the path after the prefix is lowercased.
+func (s *CanonicalShortener) NormalizeShortURL(u string) string {
+	if !s.config.CaseInsensitive {
+		return u
+	}
+	host, path, ok := strings.Cut(u, s.config.Prefix)
+	if !ok {
+		return u
+	}
+	return host + s.config.Prefix + strings.ToLower(path)
+}
+
+// CanonicalizeURL returns the form of the URL short URLs are generated from.
+func (s *CanonicalShortener) CanonicalizeURL(url string) (string, error) {
+	return canonicalizeURL(url, s.config.Canonicalization)
 }
 
 func (s *CanonicalShortener) IsValidShortURL(u string) bool {
@@ -47,58 +126,157 @@ func (s *CanonicalShortener) IsValidShortURL(u string) bool {
 		return false
 	}
 
-	if !strings.HasPrefix(URL.Path, s.config.Prefix) {
+	path, ok := strings.CutPrefix(URL.Path, s.config.Prefix)
+	if !ok {
 		return false
 	}
-	return s.isValidSlug(strings.TrimPrefix(URL.Path, s.config.Prefix))
+	if s.isSlug(path, URL.Host) {
+		return true
+	}
+	// With signed slugs, anything else was made up or mistyped unless a path forwarding link serves it
+	if s.config.Signing != nil {
+		return s.isRegistered(path)
+	}
+	// Anything under a valid prefix may be served by a path forwarding link
+	prefix, _, _ := strings.Cut(path, "/")
+	return isPrefix(prefix)
+}
+
+// GenerateSlug takes an URL string and returns a deterministic slug of the current length.
+// Slugs rejected by the filter are re-rolled by hashing the URL with a counter,
+// so a URL keeps getting the same slug. Later attempts, made when the slug is held
+// by a link to another page, go on with the counter and return the next allowed slugs.
+func (s *CanonicalShortener) GenerateSlug(url string, attempt int) (string, error) {
+	length := s.SlugLength()
+	input := url
+	for counter := 1; counter <= maxRerolls; counter++ {
+		hash := sha256.Sum256([]byte(input))
+		slug := encode(hash[:], s.config.Alphabet, length)
+		if s.config.Signing != nil {
+			slug = s.sign(slug)
+		}
+		if s.config.Filter.Allows(slug) {
+			if attempt == 0 {
+				return slug, nil
+			}
+			attempt--
+		}
+		input = fmt.Sprintf("%s\x00%d", url, counter)
+	}
+	return "", ErrNoAllowedSlug
+}
+
+// SlugLength returns the length of the slugs generated now
+func (s *CanonicalShortener) SlugLength() int {
+	return s.currentLength(s.host)
+}
+
+// IsValidSlug reports whether the slug could have been generated by this shortener:
+// characters of the alphabet, from the configured length of the domain up to the longest
+// slugs generated, followed by a valid checksum when slugs are signed.
+func (s *CanonicalShortener) IsValidSlug(slug string) bool {
+	return s.isSlug(slug, s.host)
+}
+
+// isSlug reports whether the slug could have been generated on the host
+func (s *CanonicalShortener) isSlug(slug, host string) bool {
+	if s.config.CaseInsensitive {
+		slug = strings.ToLower(slug)
+	}
+	if s.config.Signing == nil {
+		return s.hasShape(slug, host, 0)
+	}
+	if s.hasShape(slug, host, s.signatureLength()) && s.verify(slug) {
+		return true
+	}
+	return s.config.Signing.AcceptUnsigned && s.hasShape(slug, host, 0)
+}
+
+// AllowsSlug reports whether the slug filter lets through a slug that wasn't generated,
+// such as one kept from an import
+func (s *CanonicalShortener) AllowsSlug(slug string) bool {
+	if s.config.CaseInsensitive {
+		slug = strings.ToLower(slug)
+	}
+	return s.config.Filter.Allows(slug)
 }
 
-// GenerateSlug takes an URL string and returns a deterministic 6-character slug.
-// to change with an implementation with less collision probability
-func (s *CanonicalShortener) GenerateSlug(url string) (string, error) {
-	hash := crc32.ChecksumIEEE([]byte(url))
-	return base62Encode(hash, s.config.SlugLength), nil
+// hasSlugShape reports whether the slug has the length and characters of a generated
+// one, whether or not its checksum is valid
+func (s *CanonicalShortener) hasSlugShape(slug string) bool {
+	if s.config.CaseInsensitive {
+		slug = strings.ToLower(slug)
+	}
+	return s.hasShape(slug, s.host, s.signatureLength()) ||
+		s.config.Signing != nil && s.config.Signing.AcceptUnsigned && s.hasShape(slug, s.host, 0)
 }
 
-func (s *CanonicalShortener) isValidSlug(slug string) bool {
-	if len(slug) != s.config.SlugLength {
+// hasShape reports whether the slug is made of the alphabet, and without its extra
+// characters between the configured length of the host and the longest slugs generated on it
+func (s *CanonicalShortener) hasShape(slug, host string, extra int) bool {
+	if length := len(slug) - extra; length < s.domainSlugLength(host) || length > s.maxSlugLength(host) {
 		return false
 	}
-	match, _ := regexp.MatchString("^[a-zA-Z0-9]+$", slug)
-	return match
+	for _, c := range slug {
+		if !strings.ContainsRune(s.config.Alphabet, c) {
+			return false
+		}
+	}
+	return true
 }
 
-func base62Encode(number uint32, length int) string {
-	encoded := make([]byte, length)
+// track starts following the length of the slugs generated on the host
+func (s *CanonicalShortener) track(host string) {
+	length := new(atomic.Int64)
+	length.Store(int64(s.domainSlugLength(host)))
+	s.lengths[host] = length
+}
 
-	base := uint32(len(charset))
-	for i := length - 1; i >= 0; i-- {
-		encoded[i] = charset[number%base]
-		number /= base
+// domainSlugLength returns the configured slug length of the host
+func (s *CanonicalShortener) domainSlugLength(host string) int {
+	if length, ok := s.config.DomainSlugLengths[host]; ok {
+		return length
 	}
+	return s.config.SlugLength
+}
 
-	return string(encoded)
+// currentLength returns the length of the slugs generated now on the host
+func (s *CanonicalShortener) currentLength(host string) int {
+	if length, ok := s.lengths[host]; ok {
+		return int(length.Load())
+	}
+	return s.domainSlugLength(host)
 }
 
-// Normalize the URL to its canonical form
-func canonicalizeURL(rawURL string) (string, error) {
-	parsedURL, err := url.Parse(rawURL)
-	if err != nil {
-		return "", err
+// maxSlugLength returns the longest slugs that may have been generated on the host
+func (s *CanonicalShortener) maxSlugLength(host string) int {
+	return max(s.domainSlugLength(host), s.config.MaxSlugLength, s.currentLength(host))
+}
+
+// hostOf returns the host of a domain given with or without a scheme
+func hostOf(domain string) string {
+	if _, host, ok := strings.Cut(domain, "://"); ok {
+		return host
 	}
-	parsedURL.Host = strings.TrimPrefix(parsedURL.Host, "www.")
-	parsedURL.RawQuery = canonicalizeQuery(parsedURL.RawQuery)
-	return parsedURL.String(), nil
+	return domain
 }
 
-// Normalize and sort query parameters
-// to avoid duplicated when the order of parameters change
-func canonicalizeQuery(rawQuery string) string {
-	params, err := url.ParseQuery(rawQuery)
-	if err != nil {
-		return rawQuery
+// encode writes the hash in the alphabet, keeping its last length digits
+func encode(hash []byte, alphabet string, length int) string {
+	number := new(big.Int).SetBytes(hash)
+	base := big.NewInt(int64(len(alphabet)))
+	digit := new(big.Int)
+
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		number.DivMod(number, base, digit)
+		encoded[i] = alphabet[digit.Int64()]
 	}
+	return string(encoded)
+}
 
+// encodeQuery encodes the parameters sorted by key
+func encodeQuery(params url.Values) string {
 	canonicalQuery := url.Values{}
 	for key, values := range params {
 		canonicalQuery[key] = values
@@ -106,3 +284,54 @@ func canonicalizeQuery(rawQuery string) string {
 
 	return canonicalQuery.Encode()
 }
+
+// MergeQuery adds params to the query of the destination URL. Parameters the destination
+// already has are replaced when override is set, and left as they are otherwise.
+// Only the query changes: the fragment and the existing parameters are kept byte for byte.
+func MergeQuery(destination string, params url.Values, override bool) string {
+	if len(params) == 0 {
+		return destination
+	}
+	base, fragment, hasFragment := strings.Cut(destination, "#")
+	base, rawQuery, _ := strings.Cut(base, "?")
+
+	var kept []string
+	added := url.Values{}
+	for key, values := range params {
+		added[key] = values
+	}
+	if rawQuery != "" {
+		for _, param := range strings.Split(rawQuery, "&") {
+			key := queryKey(param)
+			if _, ok := params[key]; ok {
+				if !override {
+					delete(added, key)
+					kept = append(kept, param)
+				}
+				continue
+			}
+			kept = append(kept, param)
+		}
+	}
+	if encoded := encodeQuery(added); encoded != "" {
+		kept = append(kept, encoded)
+	}
+
+	merged := base
+	if query := strings.Join(kept, "&"); query != "" {
+		merged += "?" + query
+	}
+	if hasFragment {
+		merged += "#" + fragment
+	}
+	return merged
+}
+
+// queryKey returns the decoded key of a raw key=value pair
+func queryKey(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+	if decoded, err := url.QueryUnescape(key); err == nil {
+		return decoded
+	}
+	return key
+}
@@ -0,0 +1,98 @@
+package shortener
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// minSecretLength is the shortest signing secret accepted, in bytes
+const minSecretLength = 16
+
+// Signing appends a key ID and an HMAC checksum to generated slugs, so that made up
+// or mistyped slugs are refused without looking them up
+type Signing struct {
+	Keys           map[byte][]byte // Secrets by key ID, older keys are kept to verify existing slugs
+	KeyID          byte            // Key signing new slugs
+	ChecksumLength int             // Characters of checksum after the key ID
+	AcceptUnsigned bool            // Keep serving slugs generated before signing was enabled
+}
+
+// ParseSigning builds the signing settings from "id:secret" entries, where id is one
+// lowercase letter or digit of the alphabet. keyID selects the key of new slugs, the first
+// one by default. It returns nil without entries.
+func ParseSigning(entries []string, keyID string, checksumLength int, alphabet string) (*Signing, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if alphabet == "" {
+		alphabet = LowercaseAlphabet
+	}
+	if checksumLength < 1 {
+		return nil, fmt.Errorf("checksum length must be positive, got %d", checksumLength)
+	}
+
+	signing := &Signing{Keys: make(map[byte][]byte, len(entries)), ChecksumLength: checksumLength}
+	for i, entry := range entries {
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || len(id) != 1 || !(id[0] >= 'a' && id[0] <= 'z' || id[0] >= '0' && id[0] <= '9') {
+			return nil, fmt.Errorf("invalid signing key %d, use id:secret with a one character id", i+1)
+		}
+		if !strings.Contains(alphabet, id) {
+			return nil, fmt.Errorf("signing key id %q is not in the slug alphabet", id)
+		}
+		if _, ok := signing.Keys[id[0]]; ok {
+			return nil, fmt.Errorf("duplicate signing key id %q", id)
+		}
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("signing key %q is shorter than %d bytes", id, minSecretLength)
+		}
+		signing.Keys[id[0]] = []byte(secret)
+		if i == 0 {
+			signing.KeyID = id[0]
+		}
+	}
+	if keyID != "" {
+		if _, ok := signing.Keys[keyID[0]]; len(keyID) != 1 || !ok {
+			return nil, fmt.Errorf("unknown signing key id %q", keyID)
+		}
+		signing.KeyID = keyID[0]
+	}
+	return signing, nil
+}
+
+// signatureLength returns the characters added to signed slugs
+func (s *CanonicalShortener) signatureLength() int {
+	if s.config.Signing == nil {
+		return 0
+	}
+	return 1 + s.config.Signing.ChecksumLength
+}
+
+// sign appends the current key ID and the checksum to the slug
+func (s *CanonicalShortener) sign(slug string) string {
+	keyID := s.config.Signing.KeyID
+	return slug + string(keyID) + s.checksum(keyID, slug)
+}
+
+// verify reports whether the slug ends with a valid key ID and checksum
+func (s *CanonicalShortener) verify(slug string) bool {
+	split := len(slug) - s.signatureLength()
+	if split < 0 {
+		return false
+	}
+	keyID := slug[split]
+	if _, ok := s.config.Signing.Keys[keyID]; !ok {
+		return false
+	}
+	return hmac.Equal([]byte(slug[split+1:]), []byte(s.checksum(keyID, slug[:split])))
+}
+
+// checksum returns the HMAC of the slug with the key, written in the alphabet
+func (s *CanonicalShortener) checksum(keyID byte, slug string) string {
+	mac := hmac.New(sha256.New, s.config.Signing.Keys[keyID])
+	mac.Write([]byte{keyID})
+	mac.Write([]byte(slug))
+	return encode(mac.Sum(nil), s.config.Alphabet, s.config.Signing.ChecksumLength)
+}
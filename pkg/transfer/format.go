@@ -0,0 +1,339 @@
+package transfer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"url-shortener/pkg/model"
+)
+
+// Format is the file format links are exported to or imported from
+type Format string
+
+const (
+	FormatCSV    Format = "csv"    // Our own CSV export
+	FormatJSONL  Format = "jsonl"  // Our own JSON Lines export
+	FormatBitly  Format = "bitly"  // Bitly CSV export
+	FormatYOURLS Format = "yourls" // YOURLS CSV export
+)
+
+// csvHeader is the header of CSV exports, it is also understood by imports
+var csvHeader = append([]string{"short_url", "original_url", "expiry", "click_count", "expired_redirect_url", "created_at"}, linkColumns...)
+
+// linkColumns carry the rest of the link in CSV exports, named after its JSON fields.
+// Text columns hold the value itself, the others its JSON encoding.
+var linkColumns = []string{"og_title", "og_description", "og_image", "country_urls", "device_rules", "variants", "sticky_variants",
+	"variant_clicks", "utm", "forward_query", "forward_path", "require_signature", "metadata", "health"}
+
+var textColumns = map[string]bool{"og_title": true, "og_description": true, "og_image": true}
+
+// csvColumns lists the accepted header names of each column for an imported CSV format
+type csvColumns struct {
+	slug, url, expiry, clicks, expiredRedirectURL, createdAt []string
+	link                                                     bool // The file may have the linkColumns
+}
+
+var importColumns = map[Format]csvColumns{
+	FormatCSV: {
+		slug:               []string{"short_url"},
+		url:                []string{"original_url"},
+		expiry:             []string{"expiry"},
+		clicks:             []string{"click_count"},
+		expiredRedirectURL: []string{"expired_redirect_url"},
+		createdAt:          []string{"created_at"},
+		link:               true,
+	},
+	FormatBitly: {
+		slug:   []string{"link", "bitlink", "short_link", "short_url", "custom_bitlink"},
+		url:    []string{"long_url", "original_url", "destination_url"},
+		clicks: []string{"clicks", "total_clicks", "user_clicks"},
+	},
+	FormatYOURLS: {
+		slug:   []string{"keyword", "shorturl", "short_url"},
+		url:    []string{"url", "longurl", "long_url"},
+		clicks: []string{"clicks"},
+	},
+}
+
+// Record is a link read from an import file
+type Record struct {
+	Line      int // Line or row of the record in the file, starting at 1
+	model.URL     // The fields the file has. ShortURL is written as in the file and may be empty, CreatedAt is zero when the file doesn't say
+}
+
+// Reader reads records from an import file, returning io.EOF once it is exhausted
+type Reader interface {
+	Read() (*Record, error)
+}
+
+// Writer writes links to an export file
+type Writer interface {
+	Write(url *model.URL) error
+	Flush() error
+}
+
+// ParseFormat returns the format with the given name, defaulting to CSV
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case "":
+		return FormatCSV, nil
+	case FormatCSV, FormatJSONL, FormatBitly, FormatYOURLS:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q", name)
+	}
+}
+
+// ContentType returns the media type of files in the format
+func (f Format) ContentType() string {
+	if f == FormatJSONL {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatJSONL:
+		return &jsonlWriter{encoder: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("links can't be exported as %s", format)
+	}
+}
+
+func NewReader(r io.Reader, format Format) (Reader, error) {
+	if format == FormatJSONL {
+		// Fields this version doesn't know would be lost, refuse them rather than import a different link
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		return &jsonlReader{decoder: decoder}, nil
+	}
+	columns, ok := importColumns[format]
+	if !ok {
+		return nil, fmt.Errorf("links can't be imported from %s", format)
+	}
+	return newCSVReader(r, columns)
+}
+
+type csvWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (c *csvWriter) Write(url *model.URL) error {
+	if !c.headerWritten {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.headerWritten = true
+	}
+	expiry := ""
+	if url.Expiry != nil {
+		expiry = url.Expiry.Format(time.RFC3339Nano)
+	}
+	row := []string{url.ShortURL, url.OriginalURL, expiry, strconv.FormatInt(url.ClickCount, 10), url.ExpiredRedirectURL, url.CreatedAt.Format(time.RFC3339Nano)}
+
+	encoded, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return err
+	}
+	for _, column := range linkColumns {
+		value, ok := fields[column]
+		switch {
+		case !ok:
+			row = append(row, "")
+		case textColumns[column]:
+			var text string
+			if err := json.Unmarshal(value, &text); err != nil {
+				return err
+			}
+			row = append(row, text)
+		default:
+			row = append(row, string(value))
+		}
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Flush() error {
+	if !c.headerWritten {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.headerWritten = true
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) Write(url *model.URL) error {
+	return j.encoder.Encode(url)
+}
+
+func (j *jsonlWriter) Flush() error {
+	return nil
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	line    int
+	columns map[string]int // Index of each field in the rows, -1 when absent
+	link    []string       // linkColumns present in the file
+}
+
+func newCSVReader(r io.Reader, columns csvColumns) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	for i, name := range header {
+		header[i] = normalizeColumn(name)
+	}
+
+	c := &csvReader{r: reader, line: 1, columns: map[string]int{
+		"slug":                 findColumn(header, columns.slug),
+		"url":                  findColumn(header, columns.url),
+		"expiry":               findColumn(header, columns.expiry),
+		"clicks":               findColumn(header, columns.clicks),
+		"expired_redirect_url": findColumn(header, columns.expiredRedirectURL),
+		"created_at":           findColumn(header, columns.createdAt),
+	}}
+	if c.columns["url"] < 0 {
+		return nil, fmt.Errorf("CSV header has none of the URL columns %v", columns.url)
+	}
+	if columns.link {
+		for _, column := range linkColumns {
+			if c.columns[column] = findColumn(header, []string{column}); c.columns[column] >= 0 {
+				c.link = append(c.link, column)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *csvReader) Read() (*Record, error) {
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	c.line++
+
+	record := &Record{Line: c.line}
+	if err := c.readLink(row, &record.URL); err != nil {
+		return nil, fmt.Errorf("line %d: %v", c.line, err)
+	}
+	record.ShortURL = c.field(row, "slug")
+	record.OriginalURL = c.field(row, "url")
+	record.ExpiredRedirectURL = c.field(row, "expired_redirect_url")
+	if expiry := c.field(row, "expiry"); expiry != "" {
+		parsed, err := time.Parse(time.RFC3339, expiry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry: %v", c.line, err)
+		}
+		record.Expiry = &parsed
+	}
+	if createdAt := c.field(row, "created_at"); createdAt != "" {
+		record.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid creation date: %v", c.line, err)
+		}
+	}
+	if clicks := c.field(row, "clicks"); clicks != "" {
+		record.ClickCount, err = strconv.ParseInt(clicks, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid click count: %v", c.line, err)
+		}
+	}
+	return record, nil
+}
+
+// readLink decodes the linkColumns of the row into url
+func (c *csvReader) readLink(row []string, url *model.URL) error {
+	fields := map[string]json.RawMessage{}
+	for _, column := range c.link {
+		value := c.field(row, column)
+		switch {
+		case value == "":
+		case textColumns[column]:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			fields[column] = encoded
+		default:
+			fields[column] = json.RawMessage(value)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("invalid link columns: %v", err)
+	}
+	if err := json.Unmarshal(encoded, url); err != nil {
+		return fmt.Errorf("invalid link columns: %v", err)
+	}
+	return nil
+}
+
+func (c *csvReader) field(row []string, name string) string {
+	index := c.columns[name]
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[index])
+}
+
+type jsonlReader struct {
+	decoder *json.Decoder
+	line    int
+}
+
+func (j *jsonlReader) Read() (*Record, error) {
+	record := &Record{}
+	if err := j.decoder.Decode(&record.URL); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("record %d: %v", j.line+1, err)
+	}
+	j.line++
+	record.Line = j.line
+	return record, nil
+}
+
+// normalizeColumn lowercases a header name and drops the byte order mark spreadsheets may add
+func normalizeColumn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+func findColumn(header []string, names []string) int {
+	for _, name := range names {
+		for i, column := range header {
+			if column == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
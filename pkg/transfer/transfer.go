@@ -0,0 +1,387 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/shortener"
+	"url-shortener/pkg/webhook"
+)
+
+const importBatchSize = 500 // Links saved per database round trip
+
+// Export streams every stored link to w and returns how many were written.
+// view, when not nil, returns the link as it should be written.
+func Export(ctx context.Context, w io.Writer, format Format, repo repository.URLRepository, view func(url *model.URL) *model.URL) (int, error) {
+	writer, err := NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = repo.ForEach(ctx, func(url *model.URL) error {
+		count++
+		if view != nil {
+			url = view(url)
+		}
+		return writer.Write(url)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, writer.Flush()
+}
+
+type Config struct {
+	Logger        *slog.Logger
+	URLRepository repository.URLRepository
+	Shortener     shortener.Shortener
+
+	Events     webhook.Emitter       // Optional, notified of every imported link
+	Transactor repository.Transactor // Optional, commits each batch of links with its events
+
+	DeepLinkSchemes model.DeepLinkSchemes // Custom schemes device rules may send visitors to
+}
+
+// Importer stores links read from other shorteners' exports, keeping their slugs where possible
+type Importer struct {
+	logger     *slog.Logger
+	repo       repository.URLRepository
+	shortener  shortener.Shortener
+	events     webhook.Emitter
+	transactor repository.Transactor
+	schemes    model.DeepLinkSchemes
+}
+
+func NewImporter(config Config) *Importer {
+	return &Importer{
+		logger:     config.Logger,
+		repo:       config.URLRepository,
+		shortener:  config.Shortener,
+		events:     config.Events,
+		transactor: config.Transactor,
+		schemes:    config.DeepLinkSchemes,
+	}
+}
+
+// Conflict describes a record that could not be imported as it was
+type Conflict struct {
+	Line        int    `json:"line"`
+	Slug        string `json:"slug,omitempty"`
+	OriginalURL string `json:"original_url,omitempty"`
+	ShortURL    string `json:"short_url,omitempty"` // Short URL the link was imported under, empty when it wasn't imported
+	Reason      string `json:"reason"`
+}
+
+// Report summarizes an import
+type Report struct {
+	Imported int        `json:"imported"` // Links stored, including renamed ones
+	Existing int        `json:"existing"` // Links that were already stored
+	Renamed  []Conflict `json:"renamed"`  // Links stored under a new slug
+	Failed   []Conflict `json:"failed"`   // Records that were not imported
+}
+
+// importItem is a record waiting for its batch to be saved
+type importItem struct {
+	record    *Record
+	slug      string // Slug of the record, empty when it has none
+	url       *model.URL
+	renamed   string // Why the original slug wasn't kept, empty if it was
+	generated bool   // The short URL was generated, the record had no slug or it wasn't kept
+}
+
+// Import reads every record and saves them in batches.
+// Links without an expiry in the file never expire, as in the shorteners they come from.
+func (i *Importer) Import(ctx context.Context, reader Reader) (*Report, error) {
+	report := &Report{Renamed: []Conflict{}, Failed: []Conflict{}}
+	batch := make([]importItem, 0, importBatchSize)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			i.saveBatch(ctx, batch, report)
+			return report, err
+		}
+
+		item, err := i.prepare(record)
+		if err != nil {
+			report.Failed = append(report.Failed, conflictOf(record, i.slugOf(record.ShortURL), "", err.Error()))
+			continue
+		}
+		batch = append(batch, item)
+		if len(batch) == importBatchSize {
+			i.saveBatch(ctx, batch, report)
+			batch = batch[:0]
+		}
+	}
+	i.saveBatch(ctx, batch, report)
+
+	i.logger.Info("Links imported", "imported", report.Imported, "existing", report.Existing, "renamed", len(report.Renamed), "failed", len(report.Failed))
+	return report, nil
+}
+
+func (i *Importer) prepare(record *Record) (importItem, error) {
+	url := &model.URL{}
+	*url = record.URL
+	url.ShortURL, url.CanonicalURL = "", ""
+	if err := url.Sanitize(i.schemes); err != nil {
+		return importItem{}, fmt.Errorf("invalid URL: %v", err)
+	}
+
+	item := importItem{record: record, slug: i.slugOf(record.ShortURL), url: url}
+	switch {
+	// Slugs from other shorteners were never filtered, they go through the filter of generated ones
+	case item.slug != "" && i.shortener.IsValidSlug(item.slug):
+		if i.shortener.AllowsSlug(item.slug) {
+			url.ShortURL = i.shortener.BuildShortURL(item.slug)
+		} else {
+			item.renamed = fmt.Sprintf("slug %q is refused by the slug filter", item.slug)
+		}
+	// Prefixes are only kept for path forwarding links, as /create makes them
+	case item.slug != "" && url.ForwardPath && i.shortener.IsValidPrefix(item.slug):
+		url.ShortURL = i.shortener.BuildShortURL(item.slug)
+		return item, nil
+	}
+
+	canonical, err := i.shortener.CanonicalizeURL(url.OriginalURL)
+	if err != nil {
+		return importItem{}, fmt.Errorf("failed to shorten URL: %v", err)
+	}
+	url.CanonicalURL = canonical
+	if url.ShortURL != "" {
+		return item, nil
+	}
+	if item.slug != "" && item.renamed == "" {
+		item.renamed = fmt.Sprintf("slug %q is not valid here", item.slug)
+	}
+	shortURL, err := i.shortener.GenerateShortURL(url.OriginalURL, 0)
+	if err != nil {
+		return importItem{}, fmt.Errorf("failed to shorten URL: %v", err)
+	}
+	url.ShortURL = shortURL
+	item.generated = true
+	return item, nil
+}
+
+func (i *Importer) saveBatch(ctx context.Context, batch []importItem, report *Report) {
+	if len(batch) == 0 {
+		return
+	}
+	// Links without a slug of their own are not imported again when the page is already shortened
+	if err := i.skipShortened(ctx, batch, report); err != nil {
+		for _, item := range batch {
+			report.Failed = append(report.Failed, conflictOf(item.record, item.slug, "", err.Error()))
+		}
+		return
+	}
+	var pending []importItem
+	var urls []*model.URL
+	for _, item := range batch {
+		if item.url != nil {
+			pending = append(pending, item)
+			urls = append(urls, item.url)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	// The links of the batch commit with their link.created events, the report is only filled once they did
+	var errs []error
+	err := i.inTx(ctx, func(ctx context.Context) error {
+		errs = i.repo.SaveBatch(ctx, urls)
+		for j := range errs {
+			item := &pending[j]
+			if errors.Is(errs[j], repository.ErrAlreadyExists) {
+				errs[j] = i.resolveTaken(ctx, item)
+			}
+			if errs[j] != nil || item.url == nil {
+				continue
+			}
+			i.saveFetched(ctx, item.url)
+			if i.events != nil {
+				if err := i.events.Emit(ctx, webhook.EventLinkCreated, item.url.Public()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, item := range pending {
+			report.Failed = append(report.Failed, conflictOf(item.record, item.slug, "", err.Error()))
+		}
+		return
+	}
+
+	for j, err := range errs {
+		item := pending[j]
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, conflictOf(item.record, item.slug, "", err.Error()))
+		case item.url == nil:
+			report.Existing++
+		default:
+			report.Imported++
+			if item.url.ForwardPath {
+				i.shortener.RegisterPrefix(item.url.ShortURL)
+			}
+			if item.renamed != "" {
+				report.Renamed = append(report.Renamed, conflictOf(item.record, item.slug, item.url.ShortURL, item.renamed))
+			}
+		}
+	}
+}
+
+// inTx runs fn in a transaction when a Transactor is configured
+func (i *Importer) inTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if i.transactor == nil {
+		return fn(ctx)
+	}
+	return i.transactor.InTx(ctx, fn)
+}
+
+// saveFetched stores the metadata and health the link was exported with, which Save leaves out
+func (i *Importer) saveFetched(ctx context.Context, url *model.URL) {
+	if url.Metadata != nil {
+		if err := i.repo.SaveMetadata(ctx, url.ShortURL, url.Metadata); err != nil {
+			i.logger.Error("Failed to import metadata", "shortURL", url.ShortURL, "error", err)
+		}
+	}
+	if url.Health != nil {
+		if err := i.repo.SaveHealth(ctx, url.ShortURL, url.Health); err != nil {
+			i.logger.Error("Failed to import health", "shortURL", url.ShortURL, "error", err)
+		}
+	}
+}
+
+// skipShortened counts the generated items whose page is already shortened as existing, and clears their url.
+func (i *Importer) skipShortened(ctx context.Context, batch []importItem, report *Report) error {
+	var canonicalURLs []string
+	for _, item := range batch {
+		if item.generated {
+			canonicalURLs = append(canonicalURLs, item.url.CanonicalURL)
+		}
+	}
+	if len(canonicalURLs) == 0 {
+		return nil
+	}
+	existing, err := i.repo.FindByCanonicalURLs(ctx, canonicalURLs)
+	if err != nil {
+		return err
+	}
+	for j := range batch {
+		item := &batch[j]
+		for _, e := range existing {
+			if item.generated && e.CanonicalURL == item.url.CanonicalURL && e.RequireSignature == item.url.RequireSignature {
+				item.url = nil
+				report.Existing++
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// resolveTaken handles an item whose short URL is held by a live link. It clears item.url
+// when that link is the same one, or saves the item under the next generated short URL,
+// unless its short URL is a prefix.
+func (i *Importer) resolveTaken(ctx context.Context, item *importItem) error {
+	attempt := 0
+	if item.generated {
+		attempt = 1
+	}
+	for ; ; attempt++ {
+		same, err := i.isSameLink(ctx, item.url)
+		if err != nil {
+			return err
+		}
+		if same {
+			item.url = nil
+			return nil
+		}
+		// Prefixes are chosen, they are not replaced by generated slugs
+		if item.url.CanonicalURL == "" {
+			return errors.New("short URL already taken")
+		}
+
+		shortURL, err := i.shortener.GenerateShortURL(item.url.OriginalURL, attempt)
+		if errors.Is(err, shortener.ErrNoAllowedSlug) {
+			return errors.New("short URL already taken")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to shorten URL: %v", err)
+		}
+		item.url.ShortURL = shortURL
+		if !item.generated {
+			item.generated = true
+			item.renamed = fmt.Sprintf("slug %q is already taken", item.slug)
+		}
+		if err := i.repo.Save(ctx, item.url); !errors.Is(err, repository.ErrAlreadyExists) {
+			return err
+		}
+	}
+}
+
+// isSameLink reports whether the live link stored under the short URL of u points to the same canonical URL
+// and requires a signature alike
+func (i *Importer) isSameLink(ctx context.Context, u *model.URL) (bool, error) {
+	existing, err := i.repo.Find(ctx, u.ShortURL)
+	if err != nil {
+		return false, err
+	}
+	// Expired links keep their short URL during the purge grace period
+	if existing.IsExpired(time.Now()) || existing.RequireSignature != u.RequireSignature {
+		return false, nil
+	}
+	canonical, err := i.shortener.CanonicalizeURL(u.OriginalURL)
+	if err != nil {
+		return false, err
+	}
+	existingCanonical, err := i.shortener.CanonicalizeURL(existing.OriginalURL)
+	if err != nil {
+		return false, err
+	}
+	return canonical == existingCanonical, nil
+}
+
+// slugOf extracts the slug from a short URL. The path after our own short URL base is the slug,
+// so prefixes such as "docs/api" are kept whole. Other shorteners' slugs, as in "https://bit.ly/3abcXYZ",
+// are the last path segment, and values without a path are taken as the slug itself.
+func (i *Importer) slugOf(shortURL string) string {
+	base := withoutScheme(i.shortener.BuildShortURL(""))
+	if slug, ok := strings.CutPrefix(withoutScheme(shortURL), base); ok && base != "" {
+		return strings.TrimRight(slug, "/")
+	}
+	shortURL = strings.TrimRight(shortURL, "/")
+	if i := strings.LastIndex(shortURL, "/"); i >= 0 {
+		return shortURL[i+1:]
+	}
+	return shortURL
+}
+
+// withoutScheme drops the scheme of a URL, short URLs are stored with or without one depending on the configured domain
+func withoutScheme(u string) string {
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		return rest
+	}
+	return u
+}
+
+func conflictOf(record *Record, slug, shortURL, reason string) Conflict {
+	return Conflict{
+		Line:        record.Line,
+		Slug:        slug,
+		OriginalURL: record.OriginalURL,
+		ShortURL:    shortURL,
+		Reason:      reason,
+	}
+}
@@ -0,0 +1,446 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+	"url-shortener/pkg/shortener"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// MockURLRepository implements the parts of repository.URLRepository used by imports and exports
+type MockURLRepository struct {
+	repository.URLRepository
+	Store map[string]*model.URL
+}
+
+func (m *MockURLRepository) Save(ctx context.Context, url *model.URL) error {
+	if existing, ok := m.Store[url.ShortURL]; ok && !existing.IsExpired(time.Now()) {
+		return repository.ErrAlreadyExists
+	}
+	m.Store[url.ShortURL] = url
+	return nil
+}
+
+func (m *MockURLRepository) SaveBatch(ctx context.Context, urls []*model.URL) []error {
+	errs := make([]error, len(urls))
+	for i, url := range urls {
+		errs[i] = m.Save(ctx, url)
+	}
+	return errs
+}
+
+func (m *MockURLRepository) Find(ctx context.Context, shortURL string) (*model.URL, error) {
+	if u, ok := m.Store[shortURL]; ok {
+		return u, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (m *MockURLRepository) FindByCanonicalURLs(ctx context.Context, canonicalURLs []string) ([]*model.URL, error) {
+	var urls []*model.URL
+	for _, u := range m.Store {
+		if u.CanonicalURL != "" && slices.Contains(canonicalURLs, u.CanonicalURL) && !u.IsExpired(time.Now()) {
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
+func (m *MockURLRepository) ForEach(ctx context.Context, fn func(url *model.URL) error) error {
+	var shortURLs []string
+	for shortURL := range m.Store {
+		shortURLs = append(shortURLs, shortURL)
+	}
+	sort.Strings(shortURLs)
+	for _, shortURL := range shortURLs {
+		if err := fn(m.Store[shortURL]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockURLRepository) SaveMetadata(ctx context.Context, shortURL string, metadata *model.Metadata) error {
+	m.Store[shortURL].Metadata = metadata
+	return nil
+}
+
+func (m *MockURLRepository) SaveHealth(ctx context.Context, shortURL string, health *model.Health) error {
+	m.Store[shortURL].Health = health
+	return nil
+}
+
+// MockEmitter records the emitted events and their data, or fails with Err
+type MockEmitter struct {
+	Events []string
+	Data   []any
+	Err    error
+}
+
+func (m *MockEmitter) Emit(ctx context.Context, event string, data any) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Events = append(m.Events, event)
+	m.Data = append(m.Data, data)
+	return nil
+}
+
+// MockTransactor counts the transactions and those rolled back
+type MockTransactor struct {
+	Transactions, Rollbacks int
+}
+
+func (m *MockTransactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.Transactions++
+	err := fn(ctx)
+	if err != nil {
+		m.Rollbacks++
+	}
+	return err
+}
+
+func setupImporter() (*Importer, *MockURLRepository) {
+	repo := &MockURLRepository{Store: make(map[string]*model.URL)}
+	return NewImporter(Config{
+		Logger:        mockLogger,
+		URLRepository: repo,
+		Shortener: shortener.NewShortener(shortener.Config{
+			Domain:     "tiny.io",
+			Prefix:     "/r/",
+			SlugLength: 6,
+			Logger:     mockLogger,
+		}),
+	}), repo
+}
+
+func TestExportCSV(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	repo := &MockURLRepository{Store: map[string]*model.URL{
+		"tiny.io/r/abc123": {ShortURL: "tiny.io/r/abc123", OriginalURL: "http://a.com", Expiry: &expiry, ClickCount: 7, CreatedAt: createdAt},
+		"tiny.io/r/def456": {ShortURL: "tiny.io/r/def456", OriginalURL: "http://b.com/?q=1,2", CreatedAt: createdAt},
+	}}
+	var out bytes.Buffer
+
+	count, err := Export(context.Background(), &out, FormatCSV, repo, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "short_url,original_url,expiry,click_count,expired_redirect_url,created_at,og_title,og_description,og_image,"+
+		"country_urls,device_rules,variants,sticky_variants,variant_clicks,utm,forward_query,forward_path,require_signature,metadata,health\n"+
+		"tiny.io/r/abc123,http://a.com,2030-01-02T03:04:05Z,7,,2024-01-02T03:04:05Z,,,,,,,,,,,,,,\n"+
+		"tiny.io/r/def456,\"http://b.com/?q=1,2\",,0,,2024-01-02T03:04:05Z,,,,,,,,,,,,,,\n", out.String())
+}
+
+func TestExportJSONL(t *testing.T) {
+	repo := &MockURLRepository{Store: map[string]*model.URL{
+		"tiny.io/r/abc123": {ShortURL: "tiny.io/r/abc123", OriginalURL: "http://a.com", ClickCount: 7, CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+	}}
+	var out bytes.Buffer
+
+	_, err := Export(context.Background(), &out, FormatJSONL, repo, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, `{"original_url":"http://a.com","short_url":"tiny.io/r/abc123","click_count":7,"created_at":"2024-01-02T03:04:05Z"}`+"\n", out.String())
+}
+
+func TestExportUnsupportedFormat(t *testing.T) {
+	repo := &MockURLRepository{Store: make(map[string]*model.URL)}
+
+	_, err := Export(context.Background(), io.Discard, FormatBitly, repo, nil)
+
+	assert.NotNil(t, err)
+}
+
+func TestReadBitlyCSV(t *testing.T) {
+	file := "\ufeffTitle,Long URL,Link,Created,Clicks\n" +
+		"Home,https://example.com/,https://bit.ly/3xYz9Ab,2023-01-01,12\n" +
+		"Docs,https://example.com/docs,bit.ly/docs01,2023-01-02,\n"
+	reader, err := NewReader(strings.NewReader(file), FormatBitly)
+	assert.Nil(t, err)
+
+	first, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, &Record{Line: 2, URL: model.URL{ShortURL: "https://bit.ly/3xYz9Ab", OriginalURL: "https://example.com/", ClickCount: 12}}, first)
+	second, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, &Record{Line: 3, URL: model.URL{ShortURL: "bit.ly/docs01", OriginalURL: "https://example.com/docs"}}, second)
+	_, err = reader.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadYOURLSCSV(t *testing.T) {
+	file := "keyword,url,title,timestamp,ip,clicks\n" +
+		"promo1,https://example.com/promo,Promo,2023-01-01 10:00:00,127.0.0.1,3\n"
+	reader, err := NewReader(strings.NewReader(file), FormatYOURLS)
+	assert.Nil(t, err)
+
+	record, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, &Record{Line: 2, URL: model.URL{ShortURL: "promo1", OriginalURL: "https://example.com/promo", ClickCount: 3}}, record)
+}
+
+func TestReadCSVMissingURLColumn(t *testing.T) {
+	_, err := NewReader(strings.NewReader("keyword,title\n"), FormatYOURLS)
+
+	assert.NotNil(t, err)
+}
+
+func TestReadInvalidClickCount(t *testing.T) {
+	reader, err := NewReader(strings.NewReader("keyword,url,clicks\nabc,http://a.com,many\n"), FormatYOURLS)
+	assert.Nil(t, err)
+
+	_, err = reader.Read()
+	assert.NotNil(t, err)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	source := &MockURLRepository{Store: map[string]*model.URL{
+		"tiny.io/r/abc123": {ShortURL: "tiny.io/r/abc123", OriginalURL: "http://a.com", Expiry: &expiry, ClickCount: 7, CreatedAt: createdAt},
+	}}
+	for _, format := range []Format{FormatCSV, FormatJSONL} {
+		var out bytes.Buffer
+		_, err := Export(context.Background(), &out, format, source, nil)
+		assert.Nil(t, err)
+
+		importer, repo := setupImporter()
+		reader, err := NewReader(&out, format)
+		assert.Nil(t, err)
+		report, err := importer.Import(context.Background(), reader)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Imported)
+		assert.Equal(t, source.Store["tiny.io/r/abc123"].OriginalURL, repo.Store["tiny.io/r/abc123"].OriginalURL)
+		assert.Equal(t, int64(7), repo.Store["tiny.io/r/abc123"].ClickCount)
+		assert.True(t, expiry.Equal(*repo.Store["tiny.io/r/abc123"].Expiry))
+		assert.True(t, createdAt.Equal(repo.Store["tiny.io/r/abc123"].CreatedAt))
+	}
+}
+
+func TestExportImportRoundTrip_EveryField(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	expiry := at.Add(24 * time.Hour)
+	link := &model.URL{
+		ShortURL:           "tiny.io/r/abc123",
+		OriginalURL:        "https://example.com/page",
+		Expiry:             &expiry,
+		ClickCount:         7,
+		ExpiredRedirectURL: "https://example.com/expired",
+		CreatedAt:          at,
+		OGTitle:            "Title, with a comma",
+		OGDescription:      "Description \"quoted\"",
+		OGImage:            "https://example.com/og.png",
+		CountryURLs:        map[string]string{"FR": "https://example.fr/page"},
+		DeviceRules:        []model.DeviceRule{{OS: "ios", URL: "https://apps.apple.com/app/id1"}},
+		Variants:           []model.Variant{{Name: "a", URL: "https://example.com/a", Weight: 1}, {Name: "b", URL: "https://example.com/b", Weight: 3}},
+		StickyVariants:     true,
+		VariantClicks:      map[string]int64{"a": 2, "b": 5},
+		UTM:                &model.UTM{Source: "news", Campaign: "spring"},
+		ForwardQuery:       true,
+		ForwardPath:        true,
+		RequireSignature:   true,
+		Metadata:           &model.Metadata{Title: "Page", StatusCode: 200, FetchedAt: at},
+		Health:             &model.Health{URL: "https://example.com/a", StatusCode: 301, ResponseTimeMS: 12, Redirects: []string{"https://example.com/moved"}, Failures: 1, CheckedAt: at},
+	}
+	for _, format := range []Format{FormatCSV, FormatJSONL} {
+		source := &MockURLRepository{Store: map[string]*model.URL{link.ShortURL: link}}
+		var out bytes.Buffer
+		_, err := Export(context.Background(), &out, format, source, nil)
+		assert.Nil(t, err)
+
+		importer, repo := setupImporter()
+		reader, err := NewReader(&out, format)
+		assert.Nil(t, err)
+		report, err := importer.Import(context.Background(), reader)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Imported, format)
+		imported := *repo.Store[link.ShortURL]
+		assert.NotEmpty(t, imported.CanonicalURL)
+		imported.CanonicalURL = ""
+		assert.Equal(t, *link, imported, format)
+	}
+}
+
+func TestSlugOf(t *testing.T) {
+	importer, _ := setupImporter()
+	testCases := map[string]string{
+		"tiny.io/r/abc123":         "abc123",
+		"https://tiny.io/r/abc123": "abc123",
+		"tiny.io/r/docs/api":       "docs/api",
+		"https://bit.ly/3xYz9Ab":   "3xYz9Ab",
+		"bit.ly/docs01/":           "docs01",
+		"promo1":                   "promo1",
+		"":                         "",
+	}
+	for shortURL, expected := range testCases {
+		assert.Equal(t, expected, importer.slugOf(shortURL), shortURL)
+	}
+}
+
+func TestImportPrefixLink(t *testing.T) {
+	importer, repo := setupImporter()
+	file := `{"original_url":"https://example.com/docs","short_url":"tiny.io/r/docs/api","forward_path":true}` + "\n"
+	reader, err := NewReader(strings.NewReader(file), FormatJSONL)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Imported)
+	assert.Empty(t, report.Renamed)
+	assert.True(t, repo.Store["tiny.io/r/docs/api"].ForwardPath)
+	assert.Empty(t, repo.Store["tiny.io/r/docs/api"].CanonicalURL)
+}
+
+func TestReadJSONLUnknownField(t *testing.T) {
+	reader, err := NewReader(strings.NewReader(`{"original_url":"https://example.com","tags":["a"]}`+"\n"), FormatJSONL)
+	assert.Nil(t, err)
+
+	_, err = reader.Read()
+
+	assert.NotNil(t, err)
+}
+
+func TestImportConflicts(t *testing.T) {
+	importer, repo := setupImporter()
+	repo.Store["tiny.io/r/taken1"] = &model.URL{ShortURL: "tiny.io/r/taken1", OriginalURL: "http://other.com"}
+	repo.Store["tiny.io/r/same01"] = &model.URL{ShortURL: "tiny.io/r/same01", OriginalURL: "http://same.com"}
+	file := "keyword,url,clicks\n" +
+		"keep01,http://keep.com,1\n" +
+		"taken1,http://taken.com,2\n" +
+		"same01,http://same.com,3\n" +
+		"toolongslug,http://long.com,4\n" +
+		"bad001,javascript:alert(1),5\n" +
+		",http://noslug.com,6\n"
+	reader, err := NewReader(strings.NewReader(file), FormatYOURLS)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Imported)
+	assert.Equal(t, 1, report.Existing)
+	assert.Equal(t, "http://keep.com", repo.Store["tiny.io/r/keep01"].OriginalURL)
+	assert.Equal(t, "http://other.com", repo.Store["tiny.io/r/taken1"].OriginalURL)
+	assert.Equal(t, int64(0), repo.Store["tiny.io/r/same01"].ClickCount)
+
+	assert.Len(t, report.Renamed, 2)
+	assert.Equal(t, "taken1", report.Renamed[0].Slug)
+	assert.Equal(t, "http://taken.com", repo.Store[report.Renamed[0].ShortURL].OriginalURL)
+	assert.Equal(t, "toolongslug", report.Renamed[1].Slug)
+	assert.Equal(t, "http://long.com", repo.Store[report.Renamed[1].ShortURL].OriginalURL)
+
+	assert.Len(t, report.Failed, 1)
+	assert.Equal(t, 6, report.Failed[0].Line)
+}
+
+func TestImportGeneratedSlugs(t *testing.T) {
+	importer, repo := setupImporter()
+	canonical, _ := importer.shortener.CanonicalizeURL("http://shortened.com")
+	repo.Store["tiny.io/r/abc123"] = &model.URL{ShortURL: "tiny.io/r/abc123", OriginalURL: "http://shortened.com", CanonicalURL: canonical}
+	taken, _ := importer.shortener.GenerateShortURL("http://new.com", 0)
+	repo.Store[taken] = &model.URL{ShortURL: taken, OriginalURL: "http://other.com"}
+	file := "keyword,url,clicks\n" +
+		",http://shortened.com,1\n" +
+		",http://new.com,2\n"
+	reader, err := NewReader(strings.NewReader(file), FormatYOURLS)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Existing)
+	assert.Equal(t, 1, report.Imported)
+	assert.Equal(t, "http://other.com", repo.Store[taken].OriginalURL)
+	rerolled, _ := importer.shortener.GenerateShortURL("http://new.com", 1)
+	assert.Equal(t, "http://new.com", repo.Store[rerolled].OriginalURL)
+}
+
+func TestImportEmitsCreatedEvents(t *testing.T) {
+	importer, repo := setupImporter()
+	events := &MockEmitter{}
+	transactor := &MockTransactor{}
+	importer.events = events
+	importer.transactor = transactor
+	repo.Store["tiny.io/r/same01"] = &model.URL{ShortURL: "tiny.io/r/same01", OriginalURL: "http://same.com"}
+	file := `{"short_url":"keep01","original_url":"http://keep.com"}` + "\n" +
+		`{"short_url":"same01","original_url":"http://same.com"}` + "\n" +
+		`{"short_url":"priv01","original_url":"http://private.com","require_signature":true}` + "\n"
+	reader, err := NewReader(strings.NewReader(file), FormatJSONL)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, transactor.Transactions)
+	assert.Equal(t, []string{"link.created", "link.created"}, events.Events)
+	assert.Equal(t, "http://keep.com", events.Data[0].(*model.URL).OriginalURL)
+	assert.Empty(t, events.Data[1].(*model.URL).OriginalURL, "private links are redacted")
+}
+
+func TestImportEmitFailureFailsBatch(t *testing.T) {
+	importer, _ := setupImporter()
+	transactor := &MockTransactor{}
+	importer.events = &MockEmitter{Err: errors.New("connection lost")}
+	importer.transactor = transactor
+	file := `{"short_url":"keep01","original_url":"http://keep.com"}` + "\n" +
+		`{"short_url":"keep02","original_url":"http://other.com"}` + "\n"
+	reader, err := NewReader(strings.NewReader(file), FormatJSONL)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Imported)
+	assert.Len(t, report.Failed, 2)
+	assert.Equal(t, 1, transactor.Rollbacks)
+}
+
+func TestImportFilteredSlugs(t *testing.T) {
+	importer, repo := setupImporter()
+	importer.shortener = shortener.NewShortener(shortener.Config{
+		Domain:     "tiny.io",
+		Prefix:     "/r/",
+		SlugLength: 6,
+		Logger:     mockLogger,
+		Filter:     shortener.SlugFilter{Blocklist: shortener.DefaultBlocklist, ExcludeAmbiguous: true},
+	})
+	file := "keyword,url,clicks\n" +
+		"keepme,http://keep.com,1\n" +
+		"shitzz,http://blocked.com,2\n" +
+		"abO0xy,http://ambiguous.com,3\n"
+	reader, err := NewReader(strings.NewReader(file), FormatYOURLS)
+	assert.Nil(t, err)
+
+	report, err := importer.Import(context.Background(), reader)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Imported)
+	assert.Equal(t, "http://keep.com", repo.Store["tiny.io/r/keepme"].OriginalURL)
+	assert.NotContains(t, repo.Store, "tiny.io/r/shitzz")
+	assert.NotContains(t, repo.Store, "tiny.io/r/abO0xy")
+	assert.Len(t, report.Renamed, 2)
+	for _, renamed := range report.Renamed {
+		assert.Contains(t, renamed.Reason, "slug filter")
+		assert.NotEmpty(t, repo.Store[renamed.ShortURL])
+	}
+}
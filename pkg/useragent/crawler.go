@@ -0,0 +1,49 @@
+package useragent
+
+import "strings"
+
+// DefaultCrawlers lists User-Agent substrings of the bots that unfurl links into cards
+var DefaultCrawlers = []string{
+	"facebookexternalhit",
+	"Facebot",
+	"Twitterbot",
+	"Slackbot",
+	"LinkedInBot",
+	"Discordbot",
+	"TelegramBot",
+	"WhatsApp",
+	"Pinterest",
+	"redditbot",
+	"SkypeUriPreview",
+	"Iframely",
+	"Embedly",
+	"vkShare",
+	"Mastodon",
+	"Bluesky",
+}
+
+// CrawlerMatcher recognizes crawlers from their User-Agent
+type CrawlerMatcher struct {
+	patterns []string
+}
+
+// NewCrawlerMatcher matches User-Agents containing any of the patterns, ignoring case
+func NewCrawlerMatcher(patterns []string) *CrawlerMatcher {
+	lowered := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			lowered = append(lowered, strings.ToLower(pattern))
+		}
+	}
+	return &CrawlerMatcher{patterns: lowered}
+}
+
+func (m *CrawlerMatcher) IsCrawler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, pattern := range m.patterns {
+		if strings.Contains(userAgent, pattern) {
+			return true
+		}
+	}
+	return false
+}
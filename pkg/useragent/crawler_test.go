@@ -0,0 +1,62 @@
+package useragent
+
+import "testing"
+
+func TestIsCrawler(t *testing.T) {
+	matcher := NewCrawlerMatcher(DefaultCrawlers)
+	testCases := []struct {
+		userAgent string
+		crawler   bool
+	}{
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"Twitterbot/1.0", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", true},
+		{"WhatsApp/2.23.20.0 A", true},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15", false},
+		{"curl/8.4.0", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if crawler := matcher.IsCrawler(tc.userAgent); crawler != tc.crawler {
+			t.Errorf("IsCrawler(%q) = %v; want %v", tc.userAgent, crawler, tc.crawler)
+		}
+	}
+}
+
+func TestIsCrawlerCustomPatterns(t *testing.T) {
+	matcher := NewCrawlerMatcher([]string{" ", "InternalPreview"})
+
+	if !matcher.IsCrawler("internalpreview/2.0") {
+		t.Error("expected custom pattern to match ignoring case")
+	}
+	if matcher.IsCrawler("Twitterbot/1.0") {
+		t.Error("expected default patterns to be replaced")
+	}
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		userAgent string
+		device    Device
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", Device{OSiOS, DeviceMobile}},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1", Device{OSiOS, DeviceTablet}},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Mobile Safari/537.36", Device{OSAndroid, DeviceMobile}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36", Device{OSAndroid, DeviceTablet}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36", Device{OSWindows, DeviceDesktop}},
+		{"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Mobile Safari/537.36 Edge/15.14977", Device{OSOther, DeviceMobile}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15", Device{OSMacOS, DeviceDesktop}},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", Device{OSLinux, DeviceDesktop}},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36", Device{OSLinux, DeviceDesktop}},
+		{"curl/8.4.0", Device{OSOther, DeviceDesktop}},
+		{"", Device{OSOther, DeviceDesktop}},
+	}
+
+	for _, tc := range testCases {
+		if device := Parse(tc.userAgent); device != tc.device {
+			t.Errorf("Parse(%q) = %+v; want %+v", tc.userAgent, device, tc.device)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package useragent
+
+import "strings"
+
+// Operating systems reported by Parse
+const (
+	OSiOS     = "ios"
+	OSAndroid = "android"
+	OSWindows = "windows"
+	OSMacOS   = "macos"
+	OSLinux   = "linux"
+	OSOther   = "other"
+)
+
+// Device types reported by Parse
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+)
+
+// Device is the platform a request comes from
+type Device struct {
+	OS   string
+	Type string
+}
+
+// Parse recognizes the platform from a User-Agent. iPads in desktop mode
+// present themselves as Macs and can't be told apart.
+func Parse(userAgent string) Device {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "windows phone"):
+		return Device{OS: OSOther, Type: DeviceMobile}
+	case strings.Contains(ua, "ipad"):
+		return Device{OS: OSiOS, Type: DeviceTablet}
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"):
+		return Device{OS: OSiOS, Type: DeviceMobile}
+	case strings.Contains(ua, "android"):
+		// Android tablets leave "Mobile" out of their User-Agent
+		if strings.Contains(ua, "mobile") {
+			return Device{OS: OSAndroid, Type: DeviceMobile}
+		}
+		return Device{OS: OSAndroid, Type: DeviceTablet}
+	case strings.Contains(ua, "windows"):
+		return Device{OS: OSWindows, Type: DeviceDesktop}
+	case strings.Contains(ua, "macintosh"), strings.Contains(ua, "mac os x"):
+		return Device{OS: OSMacOS, Type: DeviceDesktop}
+	case strings.Contains(ua, "linux"), strings.Contains(ua, "cros"), strings.Contains(ua, "x11"):
+		return Device{OS: OSLinux, Type: DeviceDesktop}
+	case strings.Contains(ua, "mobile"):
+		return Device{OS: OSOther, Type: DeviceMobile}
+	default:
+		return Device{OS: OSOther, Type: DeviceDesktop}
+	}
+}
@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/netguard"
+	"url-shortener/pkg/repository"
+)
+
+// Event types
+const (
+	EventLinkCreated = "link.created"
+	EventLinkUpdated = "link.updated"
+	EventLinkClicked = "link.clicked" // Sampled, see Config.ClickSampleRate
+	EventLinkBroken  = "link.broken"
+	EventLinkExpired = "link.expired" // Sent when the janitor purges the link, once its grace period is over
+)
+
+// Events lists the types subscriptions can choose from. Links are never deleted through the API
+// and have no click limit, so no event reports either.
+var Events = []string{EventLinkCreated, EventLinkUpdated, EventLinkClicked, EventLinkBroken, EventLinkExpired}
+
+// Headers sent with every delivery
+const (
+	IDHeader        = "Webhook-Id" // Event ID, the same across retries
+	EventHeader     = "Webhook-Event"
+	SignatureHeader = "Webhook-Signature"
+)
+
+// metrics is published on /debug/vars
+var metrics = expvar.NewMap("webhooks")
+
+// Emitter records events for delivery. Emitting in the transaction of the change
+// an event reports, see repository.Transactor, stores both or neither.
+type Emitter interface {
+	Emit(ctx context.Context, event string, data any) error
+}
+
+type Config struct {
+	Logger          *slog.Logger
+	Repository      repository.WebhookRepository
+	Client          *http.Client  // Optional, defaults to a client refusing non-public addresses
+	Timeout         time.Duration // Limit for a single delivery attempt
+	PollInterval    time.Duration // Wait before looking for due deliveries again once all are sent
+	BatchSize       int           // Deliveries claimed and sent concurrently
+	MaxAttempts     int           // Attempts before a delivery is dead-lettered
+	BackoffBase     time.Duration // Wait after the first failed attempt, doubled after each of the next ones
+	BackoffMax      time.Duration
+	ClickSampleRate float64 // Share of clicks emitted as events, between 0 and 1
+}
+
+// Dispatcher stores events in the outbox and delivers them, retrying failed deliveries.
+type Dispatcher struct {
+	config Config
+	client *http.Client
+}
+
+func New(config Config) *Dispatcher {
+	client := config.Client
+	if client == nil {
+		client = netguard.Client(config.Timeout)
+	}
+	return &Dispatcher{config: config, client: client}
+}
+
+// envelope is the body of every delivery
+type envelope struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// Emit adds the event to the outbox of every subscription to its type.
+func (d *Dispatcher) Emit(ctx context.Context, event string, data any) error {
+	if event == EventLinkClicked && mathrand.Float64() >= d.config.ClickSampleRate {
+		return nil
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(envelope{ID: id, Type: event, CreatedAt: time.Now(), Data: data})
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %v", event, err)
+	}
+	enqueued, err := d.config.Repository.Enqueue(ctx, id, event, payload)
+	if err != nil {
+		return err
+	}
+	metrics.Add("enqueued", enqueued)
+	return nil
+}
+
+// Run sends due deliveries until the context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		sent, err := d.DeliverDue(ctx)
+		if err != nil {
+			d.config.Logger.Error("Failed to deliver webhooks", "error", err)
+		}
+
+		// A full batch means more deliveries are waiting
+		wait := d.config.PollInterval
+		if err == nil && sent == d.config.BatchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// DeliverDue sends one batch of due deliveries and returns how many were attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	now := time.Now()
+	// The lease outlives the attempts, deliveries of a crashed dispatcher are retried once it ends
+	deliveries, err := d.config.Repository.ClaimDue(ctx, now, now.Add(d.config.Timeout+time.Minute), d.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *model.Delivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// deliver makes one attempt and schedules the next one, or dead-letters the delivery
+func (d *Dispatcher) deliver(ctx context.Context, delivery *model.Delivery) {
+	delivery.Attempts++
+	statusCode, err := d.send(ctx, delivery)
+	now := time.Now()
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+
+	switch {
+	case err == nil:
+		delivery.Status = model.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		metrics.Add("delivered", 1)
+	case delivery.Attempts >= d.config.MaxAttempts:
+		delivery.Status = model.DeliveryDead
+		delivery.LastError = err.Error()
+		metrics.Add("dead", 1)
+		d.config.Logger.Warn("Webhook delivery dead-lettered", "delivery", delivery.ID, "subscription", delivery.SubscriptionID, "attempts", delivery.Attempts, "error", err)
+	default:
+		delivery.NextAttemptAt = now.Add(Backoff(d.config.BackoffBase, d.config.BackoffMax, delivery.Attempts))
+		delivery.LastError = err.Error()
+		metrics.Add("failed", 1)
+		d.config.Logger.Info("Webhook delivery failed", "delivery", delivery.ID, "attempts", delivery.Attempts, "next", delivery.NextAttemptAt, "error", err)
+	}
+
+	if err := d.config.Repository.SaveAttempt(ctx, delivery); err != nil {
+		d.config.Logger.Error("Failed to save webhook delivery", "delivery", delivery.ID, "error", err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery *model.Delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, delivery.EventID)
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, time.Now(), delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("receiver responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Backoff returns the wait after the given number of failed attempts
+func Backoff(base, max time.Duration, attempts int) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	return min(wait, max)
+}
+
+// Sign returns the signature header of a body sent at the given time:
+// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + signature(secret, t, body)
+}
+
+// Verify checks a signature header, rejecting timestamps further than tolerance from now
+// so captured deliveries can't be replayed later.
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var t string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return errors.New("missing signature timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp out of tolerance")
+	}
+	expected := signature(secret, t, body)
+	if !slices.ContainsFunc(signatures, func(s string) bool { return hmac.Equal([]byte(s), []byte(expected)) }) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random signing secret
+func NewSecret() (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + secret, nil
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
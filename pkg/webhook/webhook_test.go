@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"url-shortener/pkg/model"
+	"url-shortener/pkg/repository"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// MockWebhookRepository keeps subscriptions and deliveries in memory
+type MockWebhookRepository struct {
+	repository.WebhookRepository
+	mu            sync.Mutex
+	Subscriptions []*model.Subscription
+	Deliveries    []*model.Delivery
+}
+
+func (m *MockWebhookRepository) Enqueue(ctx context.Context, eventID, event string, payload []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var enqueued int64
+	for _, s := range m.Subscriptions {
+		if len(s.Events) == 0 || slices.Contains(s.Events, event) {
+			m.Deliveries = append(m.Deliveries, &model.Delivery{
+				ID:             int64(len(m.Deliveries) + 1),
+				SubscriptionID: s.ID,
+				EventID:        eventID,
+				Event:          event,
+				Payload:        payload,
+				Status:         model.DeliveryPending,
+				NextAttemptAt:  time.Now(),
+				URL:            s.URL,
+				Secret:         s.Secret,
+			})
+			enqueued++
+		}
+	}
+	return enqueued, nil
+}
+
+func (m *MockWebhookRepository) ClaimDue(ctx context.Context, now, leaseUntil time.Time, limit int) ([]*model.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []*model.Delivery
+	for _, d := range m.Deliveries {
+		if len(due) < limit && d.Status == model.DeliveryPending && !d.NextAttemptAt.After(now) {
+			d.NextAttemptAt = leaseUntil
+			copied := *d
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (m *MockWebhookRepository) SaveAttempt(ctx context.Context, delivery *model.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deliveries[delivery.ID-1] = delivery
+	return nil
+}
+
+// makeDue lets retries run without waiting for their backoff
+func (m *MockWebhookRepository) makeDue() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.Deliveries {
+		d.NextAttemptAt = time.Now()
+	}
+}
+
+func setupDispatcher(receiverURL string) (*Dispatcher, *MockWebhookRepository) {
+	repo := &MockWebhookRepository{Subscriptions: []*model.Subscription{
+		{ID: 1, URL: receiverURL, Secret: "whsec_test"},
+		{ID: 2, URL: receiverURL, Secret: "whsec_other", Events: []string{EventLinkBroken}},
+	}}
+	return New(Config{
+		Logger:          mockLogger,
+		Repository:      repo,
+		Client:          &http.Client{}, // The default client refuses the loopback receiver
+		Timeout:         time.Second,
+		BatchSize:       10,
+		MaxAttempts:     3,
+		BackoffBase:     time.Second,
+		BackoffMax:      time.Minute,
+		ClickSampleRate: 1,
+	}), repo
+}
+
+func TestEmit(t *testing.T) {
+	dispatcher, repo := setupDispatcher("http://example.com/hook")
+
+	assert.Nil(t, dispatcher.Emit(context.Background(), EventLinkCreated, &model.URL{ShortURL: "http://short.com/r/abc123"}))
+	assert.Len(t, repo.Deliveries, 1, "only the subscription to all events gets link.created")
+	assert.Equal(t, int64(1), repo.Deliveries[0].SubscriptionID)
+
+	var body envelope
+	assert.Nil(t, json.Unmarshal(repo.Deliveries[0].Payload, &body))
+	assert.Equal(t, EventLinkCreated, body.Type)
+	assert.Equal(t, repo.Deliveries[0].EventID, body.ID)
+
+	assert.Nil(t, dispatcher.Emit(context.Background(), EventLinkBroken, &model.URL{}))
+	assert.Len(t, repo.Deliveries, 3)
+	assert.Equal(t, repo.Deliveries[1].EventID, repo.Deliveries[2].EventID)
+}
+
+func TestEmit_SamplesClicks(t *testing.T) {
+	dispatcher, repo := setupDispatcher("http://example.com/hook")
+	dispatcher.config.ClickSampleRate = 0
+
+	assert.Nil(t, dispatcher.Emit(context.Background(), EventLinkClicked, &model.Click{}))
+	assert.Empty(t, repo.Deliveries)
+}
+
+func TestDeliverDue_SignedDelivery(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.Header, body}
+	}))
+	defer receiver.Close()
+	dispatcher, repo := setupDispatcher(receiver.URL)
+	dispatcher.Emit(context.Background(), EventLinkCreated, &model.URL{ShortURL: "http://short.com/r/abc123"})
+
+	sent, err := dispatcher.DeliverDue(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sent)
+
+	request := <-requests
+	assert.Equal(t, "application/json", request.header.Get("Content-Type"))
+	assert.Equal(t, EventLinkCreated, request.header.Get(EventHeader))
+	assert.Equal(t, repo.Deliveries[0].EventID, request.header.Get(IDHeader))
+	assert.Nil(t, Verify("whsec_test", request.header.Get(SignatureHeader), request.body, time.Now(), 5*time.Minute))
+	assert.NotNil(t, Verify("whsec_other", request.header.Get(SignatureHeader), request.body, time.Now(), 5*time.Minute))
+
+	delivery := repo.Deliveries[0]
+	assert.Equal(t, model.DeliveryDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.LastStatusCode)
+	assert.NotNil(t, delivery.DeliveredAt)
+
+	sent, _ = dispatcher.DeliverDue(context.Background())
+	assert.Equal(t, 0, sent, "delivered deliveries aren't sent again")
+}
+
+func TestDeliverDue_RetriesWithBackoff(t *testing.T) {
+	var mu sync.Mutex
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	dispatcher, repo := setupDispatcher(receiver.URL)
+	dispatcher.Emit(context.Background(), EventLinkUpdated, &model.URL{})
+
+	dispatcher.DeliverDue(context.Background())
+	delivery := repo.Deliveries[0]
+	assert.Equal(t, model.DeliveryPending, delivery.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	assert.Contains(t, delivery.LastError, "503")
+	assert.WithinDuration(t, time.Now().Add(time.Second), delivery.NextAttemptAt, 500*time.Millisecond)
+
+	sent, _ := dispatcher.DeliverDue(context.Background())
+	assert.Equal(t, 0, sent, "retries wait for their backoff")
+
+	repo.makeDue()
+	dispatcher.DeliverDue(context.Background())
+	delivery = repo.Deliveries[0]
+	assert.Equal(t, model.DeliveryDelivered, delivery.Status)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Empty(t, delivery.LastError)
+}
+
+func TestDeliverDue_DeadLetters(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	dispatcher, repo := setupDispatcher(receiver.URL)
+	dispatcher.Emit(context.Background(), EventLinkUpdated, &model.URL{})
+
+	for i := 0; i < 3; i++ {
+		repo.makeDue()
+		dispatcher.DeliverDue(context.Background())
+	}
+	delivery := repo.Deliveries[0]
+	assert.Equal(t, model.DeliveryDead, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+
+	repo.makeDue()
+	sent, _ := dispatcher.DeliverDue(context.Background())
+	assert.Equal(t, 0, sent, "dead deliveries aren't retried")
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{7, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.wait, Backoff(30*time.Second, 30*time.Minute, tc.attempts), "attempt %d", tc.attempts)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"link.created"}`)
+	now := time.Now()
+	header := Sign("secret", now, body)
+
+	assert.Nil(t, Verify("secret", header, body, now, time.Minute))
+	assert.NotNil(t, Verify("secret", header, []byte(`{"type":"link.deleted"}`), now, time.Minute), "tampered body")
+	assert.NotNil(t, Verify("secret", header, body, now.Add(2*time.Minute), time.Minute), "replayed too late")
+	assert.NotNil(t, Verify("secret", "v1=abc", body, now, time.Minute), "missing timestamp")
+}
@@ -2,11 +2,136 @@
 
 set -e
 
+# Safe to run again on an existing database: tables and indexes are only created when
+# missing, and the ALTER statements bring tables created by earlier versions up to date,
+# e.g. docker compose exec postgres bash /docker-entrypoint-initdb.d/init.sh
 psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
 CREATE TABLE IF NOT EXISTS urls (
     short_url VARCHAR(255) PRIMARY KEY,
     original_url TEXT NOT NULL,
-    expiry TIMESTAMP NOT NULL,
-    click_count INT DEFAULT 0
+    expiry TIMESTAMP,
+    click_count INT DEFAULT 0,
+    expired_redirect_url TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    og_title TEXT,
+    og_description TEXT,
+    og_image TEXT,
+    -- Destinations overriding original_url, keyed by ISO country code
+    country_urls JSONB,
+    -- Destinations by visitor platform, checked in order before country_urls
+    device_rules JSONB,
+    -- Weighted A/B destinations and their clicks by variant name
+    variants JSONB,
+    sticky_variants BOOLEAN NOT NULL DEFAULT false,
+    variant_clicks JSONB,
+    -- Campaign parameters added to the destination, and whether the short URL query is passed on
+    utm JSONB,
+    forward_query BOOLEAN NOT NULL DEFAULT false,
+    -- Paths under the short URL are appended to the destination
+    forward_path BOOLEAN NOT NULL DEFAULT false,
+    -- Only redirect requests carrying a valid access signature
+    require_signature BOOLEAN NOT NULL DEFAULT false,
+    -- Canonical form of original_url the slug was generated from, NULL under chosen prefixes
+    canonical_url TEXT,
+    -- Destination metadata, fetched in the background after creation
+    meta_title TEXT,
+    meta_description TEXT,
+    meta_favicon_url TEXT,
+    meta_status_code INT,
+    meta_fetched_at TIMESTAMP,
+    -- Latest destination health check
+    health_url TEXT,
+    health_status_code INT,
+    health_error TEXT,
+    health_response_ms INT,
+    health_redirects TEXT[],
+    health_failures INT NOT NULL DEFAULT 0,
+    health_broken BOOLEAN NOT NULL DEFAULT false,
+    health_checked_at TIMESTAMP
 );
+
+-- Upgrades of urls tables created by earlier versions: links may never expire, and the columns added since
+ALTER TABLE urls ALTER COLUMN expiry DROP NOT NULL;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS expired_redirect_url TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS og_title TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS og_description TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS og_image TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS meta_title TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS meta_description TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS meta_favicon_url TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS meta_status_code INT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS meta_fetched_at TIMESTAMP;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_status_code INT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_error TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_response_ms INT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_redirects TEXT[];
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_failures INT NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_broken BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_checked_at TIMESTAMP;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_url TEXT;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS country_urls JSONB;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS device_rules JSONB;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS variants JSONB;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS sticky_variants BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS variant_clicks JSONB;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm JSONB;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_query BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_path BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS require_signature BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS canonical_url TEXT;
+
+CREATE INDEX IF NOT EXISTS urls_expiry_idx ON urls (expiry);
+CREATE INDEX IF NOT EXISTS urls_health_checked_at_idx ON urls (health_checked_at NULLS FIRST);
+CREATE INDEX IF NOT EXISTS urls_canonical_url_idx ON urls (canonical_url);
+CREATE INDEX IF NOT EXISTS urls_forward_path_idx ON urls (short_url) WHERE forward_path;
+
+-- Expired URLs purged from urls, kept whole for auditing
+CREATE TABLE IF NOT EXISTS urls_archive (
+    short_url VARCHAR(255) NOT NULL,
+    data JSONB NOT NULL,
+    archived_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- Responses replayed to clients retrying with the same Idempotency-Key, without a status while the request is in progress
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INT,
+    content_type TEXT,
+    body BYTEA,
+    created_at TIMESTAMP NOT NULL
+);
+ALTER TABLE idempotency_keys ALTER COLUMN status_code DROP NOT NULL;
+ALTER TABLE idempotency_keys ALTER COLUMN content_type DROP NOT NULL;
+ALTER TABLE idempotency_keys ALTER COLUMN body DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+-- Endpoints notified of link events
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- Outbox of webhook deliveries, kept afterwards as the delivery log until WEBHOOK_RETENTION is over
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    event_id VARCHAR(64) NOT NULL,
+    event TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_status_code INT,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_finished_idx ON webhook_deliveries (created_at) WHERE status <> 'pending';
 EOSQL